@@ -0,0 +1,35 @@
+package v1beta1
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSetCondition(t *testing.T) {
+	transition := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	conditions := []Condition{{Type: ConditionReady, Status: corev1.ConditionFalse, Reason: "Pending", LastTransitionTime: transition}}
+
+	// a changed reason or message is no transition
+	SetCondition(&conditions, Condition{Type: ConditionReady, Status: corev1.ConditionFalse, Reason: "Waiting", Message: "still waiting", ObservedGeneration: 2})
+	ready := FindCondition(conditions, ConditionReady)
+	if len(conditions) != 1 || ready.Reason != "Waiting" || ready.Message != "still waiting" || ready.ObservedGeneration != 2 {
+		t.Errorf("expected the condition to be replaced, got %+v", conditions)
+	}
+	if !ready.LastTransitionTime.Equal(&transition) {
+		t.Errorf("expected the transition time %s to be kept, got %s", transition, ready.LastTransitionTime)
+	}
+
+	SetCondition(&conditions, Condition{Type: ConditionReady, Status: corev1.ConditionTrue, Reason: "Reconciled"})
+	ready = FindCondition(conditions, ConditionReady)
+	if ready.Status != corev1.ConditionTrue || !ready.LastTransitionTime.After(transition.Time) {
+		t.Errorf("expected the transition time to move past %s on a status change, got %+v", transition, ready)
+	}
+
+	SetCondition(&conditions, Condition{Type: ConditionKeyIssued, Status: corev1.ConditionTrue, Reason: "Issued"})
+	if len(conditions) != 2 || FindCondition(conditions, ConditionKeyIssued).LastTransitionTime.IsZero() {
+		t.Errorf("expected a new condition with a transition time, got %+v", conditions)
+	}
+}
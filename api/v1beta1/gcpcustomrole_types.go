@@ -0,0 +1,76 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CustomRoleStage is the launch stage of a custom role
+// +kubebuilder:validation:Enum=ALPHA;BETA;GA;DEPRECATED;DISABLED;EAP
+type CustomRoleStage string
+
+const (
+	CustomRoleStageAlpha      CustomRoleStage = "ALPHA"
+	CustomRoleStageBeta       CustomRoleStage = "BETA"
+	CustomRoleStageGA         CustomRoleStage = "GA"
+	CustomRoleStageDeprecated CustomRoleStage = "DEPRECATED"
+	CustomRoleStageDisabled   CustomRoleStage = "DISABLED"
+	CustomRoleStageEAP        CustomRoleStage = "EAP"
+)
+
+// GcpCustomRoleSpec defines the desired state of GcpCustomRole
+type GcpCustomRoleSpec struct {
+	// Project the role is created in, defaults to the default project of the namespace restriction
+	// or the project of the controller credentials
+	Project string `json:"project,omitempty"`
+	// RoleId is the id of the role in the project, defaults to an id derived from namespace and name
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z0-9_\.]{3,64}$`
+	RoleId      string `json:"roleId,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// Permissions are the permissions the role grants, e.g. storage.objects.get
+	// +kubebuilder:validation:MinItems=1
+	Permissions []string `json:"permissions"`
+	// Stage defaults to GA
+	Stage CustomRoleStage `json:"stage,omitempty"`
+}
+
+const (
+	// ConditionRoleCreated is true if the custom role exists in gcp and matches the spec
+	ConditionRoleCreated = "RoleCreated"
+)
+
+// GcpCustomRoleStatus defines the observed state of GcpCustomRole
+type GcpCustomRoleStatus struct {
+	Project string `json:"project,omitempty"`
+	// RoleName is the name of the role in gcp which is used in role bindings, e.g. projects/my-project/roles/myRole
+	RoleName           string      `json:"roleName,omitempty"`
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Role",type="string",JSONPath=".status.roleName"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// GcpCustomRole is the Schema for the gcpcustomroles API
+// +k8s:openapi-gen=true
+type GcpCustomRole struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GcpCustomRoleSpec   `json:"spec,omitempty"`
+	Status GcpCustomRoleStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// GcpCustomRoleList contains a list of GcpCustomRole
+type GcpCustomRoleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GcpCustomRole `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GcpCustomRole{}, &GcpCustomRoleList{})
+}
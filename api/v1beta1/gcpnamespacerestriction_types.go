@@ -9,25 +9,134 @@ import (
 
 // GcpNamespaceRestrictionSpec defines the desired state of GcpNamespaceRestriction
 type GcpNamespaceRestrictionSpec struct {
-	Namespace      string                      `json:"namespace"`
-	Regex          bool                        `json:"regex"`
-	GcpRestriction []GcpRestrictionRoleBinding `json:"restrictions,omitempty"`
+	// Namespace is the name of a namespace the restriction applies to
+	Namespace string `json:"namespace,omitempty"`
+	// NamespacePattern is a regular expression for the names of the namespaces the restriction applies to
+	NamespacePattern string `json:"namespacePattern,omitempty"`
+	// NamespaceSelector selects the namespaces the restriction applies to by their labels
+	NamespaceSelector *metav1.LabelSelector       `json:"namespaceSelector,omitempty"`
+	Regex             bool                        `json:"regex"`
+	GcpRestriction    []GcpRestrictionRoleBinding `json:"restrictions,omitempty"`
+	// Deny entries take precedence over the restrictions of all GcpNamespaceRestrictions of the namespace
+	Deny []GcpRestrictionDeny `json:"deny,omitempty"`
+	// DefaultProject is used for service accounts of the namespace without a project
+	DefaultProject string `json:"defaultProject,omitempty"`
+	// Projects the namespace may create service accounts in besides the default project
+	Projects []string `json:"projects,omitempty"`
+	// Quota limits the gcp resources of the namespace, the lowest limit of all restrictions of a namespace applies
+	Quota *GcpRestrictionQuota `json:"quota,omitempty"`
+	// EnforcementAction defaults to the enforcement action of the controller, bindings are revoked if any
+	// restriction of the namespace revokes them
+	EnforcementAction EnforcementAction `json:"enforcementAction,omitempty"`
 }
 
+// EnforcementAction defines what happens to applied role bindings which are no longer allowed
+// +kubebuilder:validation:Enum=Revoke;ReportOnly
+type EnforcementAction string
+
+const (
+	// EnforcementRevoke revokes the applied role bindings which are no longer allowed
+	EnforcementRevoke EnforcementAction = "Revoke"
+	// EnforcementReportOnly keeps the applied role bindings and only reports the denial
+	EnforcementReportOnly EnforcementAction = "ReportOnly"
+)
+
+// GcpRestrictionQuota limits the gcp resources of a namespace, a missing limit is unlimited
+type GcpRestrictionQuota struct {
+	// MaxServiceAccounts is the maximum number of gcp service accounts of the namespace
+	// +kubebuilder:validation:Minimum=0
+	MaxServiceAccounts *int32 `json:"maxServiceAccounts,omitempty"`
+	// MaxBindingsPerAccount is the maximum number of roles bound to a single service account, every role
+	// on every resource counts
+	// +kubebuilder:validation:Minimum=0
+	MaxBindingsPerAccount *int32 `json:"maxBindingsPerAccount,omitempty"`
+	// MaxKeys is the maximum number of service account keys of the namespace, a rotated key counts
+	// until it is deleted after the overlap
+	// +kubebuilder:validation:Minimum=0
+	MaxKeys *int32 `json:"maxKeys,omitempty"`
+}
+
+// QuotaUsage is the usage of the gcp resources limited by a GcpRestrictionQuota
+type QuotaUsage struct {
+	ServiceAccounts int32 `json:"serviceAccounts"`
+	// BindingsPerAccount is the largest number of roles bound to a single service account
+	BindingsPerAccount int32 `json:"bindingsPerAccount"`
+	Keys               int32 `json:"keys"`
+}
+
+// ConditionRequirement defines if the role bindings of a restriction need an iam condition
+// +kubebuilder:validation:Enum=Optional;Required;Forbidden
+type ConditionRequirement string
+
+const (
+	// ConditionOptional allows role bindings with and without condition
+	ConditionOptional ConditionRequirement = "Optional"
+	// ConditionRequired allows only role bindings with a condition or an expiry
+	ConditionRequired ConditionRequirement = "Required"
+	// ConditionForbidden allows only role bindings without condition and expiry
+	ConditionForbidden ConditionRequirement = "Forbidden"
+)
+
 // GcpRestrictionRoleBinding defines a restriction
 // all string files can be regex
 type GcpRestrictionRoleBinding struct {
 	Resource string   `json:"resource"`
 	Roles    []string `json:"roles"`
+	// Condition defines if the role bindings need an iam condition, defaults to Optional
+	Condition ConditionRequirement `json:"condition,omitempty"`
+}
+
+// RestrictedNamespace is a namespace a GcpNamespaceRestriction applies to
+type RestrictedNamespace struct {
+	Namespace string `json:"namespace"`
+	// Restrictions are the names of all GcpNamespaceRestrictions of the namespace in the order they are merged,
+	// a role is allowed if any of them allows it
+	Restrictions []string `json:"restrictions"`
+	// DefaultProject is the effective default project of the namespace
+	DefaultProject string `json:"defaultProject,omitempty"`
+	// Quota is the effective quota of the namespace
+	Quota *GcpRestrictionQuota `json:"quota,omitempty"`
+	Usage QuotaUsage           `json:"usage"`
+}
+
+// GcpRestrictionDeny denies roles even if a restriction allows them,
+// all string fields can be regex
+type GcpRestrictionDeny struct {
+	// Resource the roles are denied on, the roles are denied on all resources if it is empty
+	Resource string `json:"resource,omitempty"`
+	// +kubebuilder:validation:MinItems=1
+	Roles []string `json:"roles"`
+}
+
+// RestrictionViolation is a GcpServiceAccount which is not allowed by the restrictions of its namespace
+type RestrictionViolation struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Reasons   []string `json:"reasons"`
 }
 
 // GcpNamespaceRestrictionStatus defines the observed state of GcpNamespaceRestriction
 type GcpNamespaceRestrictionStatus struct {
+	// Namespaces are the namespaces the restriction applies to
+	Namespaces []RestrictedNamespace `json:"namespaces,omitempty"`
+	// GovernedAccounts is the number of GcpServiceAccounts in the namespaces
+	GovernedAccounts int32 `json:"governedAccounts"`
+	// Violations are the GcpServiceAccounts whose applied bindings or project are not allowed by the
+	// restrictions of their namespace
+	Violations []RestrictionViolation `json:"violations,omitempty"`
+	// LastEvaluationTime is the time the compliance of the GcpServiceAccounts was evaluated
+	LastEvaluationTime *metav1.Time `json:"lastEvaluationTime,omitempty"`
+	ObservedGeneration int64        `json:"observedGeneration,omitempty"`
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Governed",type="integer",JSONPath=".status.governedAccounts"
+// +kubebuilder:printcolumn:name="Evaluated",type="date",JSONPath=".status.lastEvaluationTime"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // GcpNamespaceRestriction is the Schema for the gcpnamespacerestrictions API
 type GcpNamespaceRestriction struct {
 	metav1.TypeMeta   `json:",inline"`
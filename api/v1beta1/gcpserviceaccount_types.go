@@ -7,13 +7,52 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// GcpServiceAccountMode defines how workloads authenticate as the gcp service account
+// +kubebuilder:validation:Enum=Key;WorkloadIdentity
+type GcpServiceAccountMode string
+
+const (
+	// ModeKey exports a service account key into the secret
+	ModeKey GcpServiceAccountMode = "Key"
+	// ModeWorkloadIdentity allows a kubernetes service account to impersonate the gcp service account
+	// via GKE Workload Identity, no key is exported
+	ModeWorkloadIdentity GcpServiceAccountMode = "WorkloadIdentity"
+)
+
+// DeletionPolicy defines what happens to the gcp service account when the GcpServiceAccount is deleted
+// +kubebuilder:validation:Enum=Delete;Retain;Abandon
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete removes the role bindings and deletes the service account
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain removes the role bindings and keys but keeps the service account
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicyAbandon leaves the service account, its keys and role bindings untouched
+	DeletionPolicyAbandon DeletionPolicy = "Abandon"
+)
+
 // GcpServiceAccountSpec defines the desired state of GcpServiceAccount
 type GcpServiceAccountSpec struct {
-	GcpRoleBindings           []GcpRoleBindings `json:"bindings"`
-	ServiceAccountIdentifier  string            `json:"serviceAccountIdentifier"`
-	ServiceAccountDescription string            `json:"serviceAccountDescription,omitempty"`
-	SecretName                string            `json:"secretName"`
-	SecretKey                 string            `json:"secretKey,omitempty"`
+	GcpRoleBindings           []GcpRoleBindings     `json:"bindings"`
+	ServiceAccountIdentifier  string                `json:"serviceAccountIdentifier"`
+	ServiceAccountDescription string                `json:"serviceAccountDescription,omitempty"`
+	Mode                      GcpServiceAccountMode `json:"mode,omitempty"`
+	SecretName                string                `json:"secretName,omitempty"`
+	SecretKey                 string                `json:"secretKey,omitempty"`
+	KeyRotation               *GcpKeyRotation       `json:"keyRotation,omitempty"`
+	// KubernetesServiceAccountName is the kubernetes service account in the same namespace
+	// which is bound to the gcp service account in WorkloadIdentity mode
+	KubernetesServiceAccountName string `json:"kubernetesServiceAccountName,omitempty"`
+	// Project the service account is created in, defaults to the default project of the namespace
+	// restriction or the project of the controller credentials
+	Project string `json:"project,omitempty"`
+	// ExistingServiceAccountEmail adopts an existing service account instead of creating a new one.
+	// The account is released instead of deleted when the GcpServiceAccount is deleted.
+	ExistingServiceAccountEmail string `json:"existingServiceAccountEmail,omitempty"`
+	// DeletionPolicy defaults to the deletion policy of the controller, adopted service accounts are
+	// released instead of deleted
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 }
@@ -21,20 +60,126 @@ type GcpServiceAccountSpec struct {
 // GcpRoleBindings defines the desired role bindings of GcpServiceAccount
 type GcpRoleBindings struct {
 	Resource string   `json:"resource"`
-	Roles    []string `json:"roles"`
+	Roles    []string `json:"roles,omitempty"`
+	// CustomRoles are names of GcpCustomRoles in the namespace of the GcpServiceAccount, the roles are
+	// bound once they are created
+	CustomRoles []string `json:"customRoles,omitempty"`
+	// Condition restricts the roles with an iam condition
+	Condition *GcpRoleBindingCondition `json:"condition,omitempty"`
+	// ExpiresAt grants the roles only until the given time, it is combined with the condition.
+	// Expired bindings are removed from the iam policy.
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+// GcpRoleBindingCondition is an iam condition of a role binding
+type GcpRoleBindingCondition struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	// Expression is the condition in the common expression language (CEL)
+	Expression string `json:"expression"`
+}
+
+const (
+	// ConditionReady is true if all other conditions are satisfied for the current generation
+	ConditionReady = "Ready"
+	// ConditionAccountCreated is true if the gcp service account exists
+	ConditionAccountCreated = "AccountCreated"
+	// ConditionBindingsApplied is true if the iam role bindings are applied to all resources
+	ConditionBindingsApplied = "BindingsApplied"
+	// ConditionKeyIssued is true if a service account key was issued and written to the secret
+	ConditionKeyIssued = "KeyIssued"
+	// ConditionWorkloadIdentityBound is true if the kubernetes service account is bound to the gcp service account
+	ConditionWorkloadIdentityBound = "WorkloadIdentityBound"
+	// ConditionRestrictionSatisfied is true if the namespace is allowed to use the requested bindings
+	ConditionRestrictionSatisfied = "RestrictionSatisfied"
+)
+
+// GcpKeyRotation defines when the service account key is rotated
+type GcpKeyRotation struct {
+	// MaxAge is the maximum age of a key, the previous key is deleted once it reaches this age
+	MaxAge metav1.Duration `json:"maxAge"`
+	// Overlap is the period the previous key stays valid after a new key was issued
+	Overlap metav1.Duration `json:"overlap,omitempty"`
+}
+
+// DriftType describes how gcp deviated from the state applied by the controller
+type DriftType string
+
+const (
+	// DriftMissingBinding is an applied role the service account lost on the resource
+	DriftMissingBinding DriftType = "MissingBinding"
+	// DriftUnexpectedBinding is a role the service account got on the resource outside of the controller
+	DriftUnexpectedBinding DriftType = "UnexpectedBinding"
+	// DriftMissingKey is a key of the secret which was deleted outside of the controller
+	DriftMissingKey DriftType = "MissingKey"
+)
+
+// DriftFinding is a deviation from the applied state which was repaired
+type DriftFinding struct {
+	Type DriftType `json:"type"`
+	// Resource is the resource of the binding or the name of the key
+	Resource string `json:"resource"`
+	Role     string `json:"role,omitempty"`
+	// Condition is the title of the condition of the binding
+	Condition     string      `json:"condition,omitempty"`
+	DetectionTime metav1.Time `json:"detectionTime"`
+}
+
+// RestrictionDecision is the decision of the namespace restriction about a role of a binding
+type RestrictionDecision struct {
+	// Restriction is the name of the GcpNamespaceRestriction which allowed the role, denials list all
+	// restrictions of the namespace
+	Restriction string `json:"restriction,omitempty"`
+	Resource    string `json:"resource"`
+	Role        string `json:"role,omitempty"`
+	Allowed     bool   `json:"allowed"`
+	// MatchedResource and MatchedRole are the patterns of the restriction entry which allowed the role
+	MatchedResource string `json:"matchedResource,omitempty"`
+	MatchedRole     string `json:"matchedRole,omitempty"`
+	// Reason explains why the role was denied
+	Reason string `json:"reason,omitempty"`
 }
 
 // GcpServiceAccountStatus defines the observed state of GcpServiceAccount
 type GcpServiceAccountStatus struct {
+	Project                string            `json:"project,omitempty"`
 	ServiceAccountPath     string            `json:"serviceAccountPath,omitempty"`
 	ServiceAccountMail     string            `json:"serviceAccountMail,omitempty"`
 	CredentialKey          string            `json:"credentialKey,omitempty"`
 	AppliedGcpRoleBindings []GcpRoleBindings `json:"appliedBindings,omitempty"`
+	ObservedGeneration     int64             `json:"observedGeneration,omitempty"`
+	Conditions             []Condition       `json:"conditions,omitempty"`
+
+	CredentialKeyCreationTime     *metav1.Time `json:"credentialKeyCreationTime,omitempty"`
+	NextKeyRotation               *metav1.Time `json:"nextKeyRotation,omitempty"`
+	PreviousCredentialKey         string       `json:"previousCredentialKey,omitempty"`
+	PreviousCredentialKeyDeletion *metav1.Time `json:"previousCredentialKeyDeletion,omitempty"`
+
+	WorkloadIdentityMember   string `json:"workloadIdentityMember,omitempty"`
+	KubernetesServiceAccount string `json:"kubernetesServiceAccount,omitempty"`
+
+	// Adopted is true if the service account existed before and is not deleted by the controller
+	Adopted bool `json:"adopted,omitempty"`
+	// PreexistingGcpRoleBindings are the bindings of the spec the adopted service account already had,
+	// they are kept when the service account is released
+	PreexistingGcpRoleBindings []GcpRoleBindings `json:"preexistingBindings,omitempty"`
+
+	// RestrictionDecisions are the decisions of the namespace restriction about every role of the bindings
+	RestrictionDecisions []RestrictionDecision `json:"restrictionDecisions,omitempty"`
+
+	// LastResync is the time of the last periodic comparison of the applied state with gcp
+	LastResync *metav1.Time `json:"lastResync,omitempty"`
+	// DriftFindings are the most recent deviations from the applied state which were repaired, oldest first
+	DriftFindings []DriftFinding `json:"driftFindings,omitempty"`
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Email",type="string",JSONPath=".status.serviceAccountMail"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // GcpServiceAccount is the Schema for the gcpserviceaccounts API
 // +k8s:openapi-gen=true
 type GcpServiceAccount struct {
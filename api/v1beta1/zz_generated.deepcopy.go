@@ -21,16 +21,167 @@ limitations under the License.
 package v1beta1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftFinding) DeepCopyInto(out *DriftFinding) {
+	*out = *in
+	in.DetectionTime.DeepCopyInto(&out.DetectionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftFinding.
+func (in *DriftFinding) DeepCopy() *DriftFinding {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftFinding)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpCustomRole) DeepCopyInto(out *GcpCustomRole) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpCustomRole.
+func (in *GcpCustomRole) DeepCopy() *GcpCustomRole {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpCustomRole)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *GcpCustomRole) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpCustomRoleList) DeepCopyInto(out *GcpCustomRoleList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]GcpCustomRole, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpCustomRoleList.
+func (in *GcpCustomRoleList) DeepCopy() *GcpCustomRoleList {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpCustomRoleList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *GcpCustomRoleList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpCustomRoleSpec) DeepCopyInto(out *GcpCustomRoleSpec) {
+	*out = *in
+	if in.Permissions != nil {
+		in, out := &in.Permissions, &out.Permissions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpCustomRoleSpec.
+func (in *GcpCustomRoleSpec) DeepCopy() *GcpCustomRoleSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpCustomRoleSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpCustomRoleStatus) DeepCopyInto(out *GcpCustomRoleStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpCustomRoleStatus.
+func (in *GcpCustomRoleStatus) DeepCopy() *GcpCustomRoleStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpCustomRoleStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpKeyRotation) DeepCopyInto(out *GcpKeyRotation) {
+	*out = *in
+	out.MaxAge = in.MaxAge
+	out.Overlap = in.Overlap
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpKeyRotation.
+func (in *GcpKeyRotation) DeepCopy() *GcpKeyRotation {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpKeyRotation)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GcpNamespaceRestriction) DeepCopyInto(out *GcpNamespaceRestriction) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpNamespaceRestriction.
@@ -86,6 +237,11 @@ func (in *GcpNamespaceRestrictionList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GcpNamespaceRestrictionSpec) DeepCopyInto(out *GcpNamespaceRestrictionSpec) {
 	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.GcpRestriction != nil {
 		in, out := &in.GcpRestriction, &out.GcpRestriction
 		*out = make([]GcpRestrictionRoleBinding, len(*in))
@@ -93,6 +249,23 @@ func (in *GcpNamespaceRestrictionSpec) DeepCopyInto(out *GcpNamespaceRestriction
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Deny != nil {
+		in, out := &in.Deny, &out.Deny
+		*out = make([]GcpRestrictionDeny, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Projects != nil {
+		in, out := &in.Projects, &out.Projects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Quota != nil {
+		in, out := &in.Quota, &out.Quota
+		*out = new(GcpRestrictionQuota)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpNamespaceRestrictionSpec.
@@ -108,6 +281,24 @@ func (in *GcpNamespaceRestrictionSpec) DeepCopy() *GcpNamespaceRestrictionSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GcpNamespaceRestrictionStatus) DeepCopyInto(out *GcpNamespaceRestrictionStatus) {
 	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]RestrictedNamespace, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Violations != nil {
+		in, out := &in.Violations, &out.Violations
+		*out = make([]RestrictionViolation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastEvaluationTime != nil {
+		in, out := &in.LastEvaluationTime, &out.LastEvaluationTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpNamespaceRestrictionStatus.
@@ -120,6 +311,56 @@ func (in *GcpNamespaceRestrictionStatus) DeepCopy() *GcpNamespaceRestrictionStat
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpRestrictionDeny) DeepCopyInto(out *GcpRestrictionDeny) {
+	*out = *in
+	if in.Roles != nil {
+		in, out := &in.Roles, &out.Roles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpRestrictionDeny.
+func (in *GcpRestrictionDeny) DeepCopy() *GcpRestrictionDeny {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpRestrictionDeny)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpRestrictionQuota) DeepCopyInto(out *GcpRestrictionQuota) {
+	*out = *in
+	if in.MaxServiceAccounts != nil {
+		in, out := &in.MaxServiceAccounts, &out.MaxServiceAccounts
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxBindingsPerAccount != nil {
+		in, out := &in.MaxBindingsPerAccount, &out.MaxBindingsPerAccount
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxKeys != nil {
+		in, out := &in.MaxKeys, &out.MaxKeys
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpRestrictionQuota.
+func (in *GcpRestrictionQuota) DeepCopy() *GcpRestrictionQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpRestrictionQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GcpRestrictionRoleBinding) DeepCopyInto(out *GcpRestrictionRoleBinding) {
 	*out = *in
@@ -140,6 +381,21 @@ func (in *GcpRestrictionRoleBinding) DeepCopy() *GcpRestrictionRoleBinding {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GcpRoleBindingCondition) DeepCopyInto(out *GcpRoleBindingCondition) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpRoleBindingCondition.
+func (in *GcpRoleBindingCondition) DeepCopy() *GcpRoleBindingCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(GcpRoleBindingCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GcpRoleBindings) DeepCopyInto(out *GcpRoleBindings) {
 	*out = *in
@@ -148,6 +404,20 @@ func (in *GcpRoleBindings) DeepCopyInto(out *GcpRoleBindings) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.CustomRoles != nil {
+		in, out := &in.CustomRoles, &out.CustomRoles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Condition != nil {
+		in, out := &in.Condition, &out.Condition
+		*out = new(GcpRoleBindingCondition)
+		**out = **in
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpRoleBindings.
@@ -229,6 +499,11 @@ func (in *GcpServiceAccountSpec) DeepCopyInto(out *GcpServiceAccountSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.KeyRotation != nil {
+		in, out := &in.KeyRotation, &out.KeyRotation
+		*out = new(GcpKeyRotation)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpServiceAccountSpec.
@@ -251,6 +526,48 @@ func (in *GcpServiceAccountStatus) DeepCopyInto(out *GcpServiceAccountStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CredentialKeyCreationTime != nil {
+		in, out := &in.CredentialKeyCreationTime, &out.CredentialKeyCreationTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextKeyRotation != nil {
+		in, out := &in.NextKeyRotation, &out.NextKeyRotation
+		*out = (*in).DeepCopy()
+	}
+	if in.PreviousCredentialKeyDeletion != nil {
+		in, out := &in.PreviousCredentialKeyDeletion, &out.PreviousCredentialKeyDeletion
+		*out = (*in).DeepCopy()
+	}
+	if in.PreexistingGcpRoleBindings != nil {
+		in, out := &in.PreexistingGcpRoleBindings, &out.PreexistingGcpRoleBindings
+		*out = make([]GcpRoleBindings, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RestrictionDecisions != nil {
+		in, out := &in.RestrictionDecisions, &out.RestrictionDecisions
+		*out = make([]RestrictionDecision, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastResync != nil {
+		in, out := &in.LastResync, &out.LastResync
+		*out = (*in).DeepCopy()
+	}
+	if in.DriftFindings != nil {
+		in, out := &in.DriftFindings, &out.DriftFindings
+		*out = make([]DriftFinding, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GcpServiceAccountStatus.
@@ -262,3 +579,79 @@ func (in *GcpServiceAccountStatus) DeepCopy() *GcpServiceAccountStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaUsage) DeepCopyInto(out *QuotaUsage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaUsage.
+func (in *QuotaUsage) DeepCopy() *QuotaUsage {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaUsage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestrictedNamespace) DeepCopyInto(out *RestrictedNamespace) {
+	*out = *in
+	if in.Restrictions != nil {
+		in, out := &in.Restrictions, &out.Restrictions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Quota != nil {
+		in, out := &in.Quota, &out.Quota
+		*out = new(GcpRestrictionQuota)
+		(*in).DeepCopyInto(*out)
+	}
+	out.Usage = in.Usage
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestrictedNamespace.
+func (in *RestrictedNamespace) DeepCopy() *RestrictedNamespace {
+	if in == nil {
+		return nil
+	}
+	out := new(RestrictedNamespace)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestrictionDecision) DeepCopyInto(out *RestrictionDecision) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestrictionDecision.
+func (in *RestrictionDecision) DeepCopy() *RestrictionDecision {
+	if in == nil {
+		return nil
+	}
+	out := new(RestrictionDecision)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestrictionViolation) DeepCopyInto(out *RestrictionViolation) {
+	*out = *in
+	if in.Reasons != nil {
+		in, out := &in.Reasons, &out.Reasons
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestrictionViolation.
+func (in *RestrictionViolation) DeepCopy() *RestrictionViolation {
+	if in == nil {
+		return nil
+	}
+	out := new(RestrictionViolation)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -4,321 +4,300 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"regexp"
-	"time"
+	"net/url"
+	"strconv"
+	"strings"
 
-	"github.com/go-logr/logr"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-gcp-common/gcputil"
 	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
-	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/util"
 	"github.com/hashicorp/vault/sdk/helper/useragent"
-	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iam/v1"
-	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
 const (
-	serviceAccountMaxLen          = 30
-	serviceAccountDisplayNameTmpl = "Service account for Vault secrets backend role set %s"
-	defaultCloudPlatformScope     = "https://www.googleapis.com/auth/cloud-platform"
-	keyAlgorithmRSA2k             = "KEY_ALG_RSA_2048"
-	privateKeyTypeJson            = "TYPE_GOOGLE_CREDENTIALS_FILE"
+	defaultCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	privateKeyTypeJson        = "TYPE_GOOGLE_CREDENTIALS_FILE"
+	userManagedKeyType        = "USER_MANAGED"
+	roleUpdateMask            = "title,description,includedPermissions,stage"
 )
 
-type GcpService struct {
-	log      logr.Logger
-	iamAdmin *iam.Service
+// GcpService is the access to the gcp apis. Errors of the apis are returned as they are,
+// so a missing object can be detected with isGoogleApi404Error.
+type GcpService interface {
+	// DefaultProject returns the project of the controller credentials
+	DefaultProject() (string, error)
+	GetServiceAccount(path string) (*iam.ServiceAccount, error)
+	// CreateServiceAccount creates the account in the project, "" selects the default project
+	CreateServiceAccount(project string, accountId string, displayName string, description string) (*iam.ServiceAccount, error)
+	DeleteServiceAccount(path string) error
+	GetServiceAccountKey(name string) (*iam.ServiceAccountKey, error)
+	// ListServiceAccountKeys lists the user managed keys of the service account
+	ListServiceAccountKeys(path string) ([]*iam.ServiceAccountKey, error)
+	CreateServiceAccountKey(path string) (*iam.ServiceAccountKey, error)
+	DeleteServiceAccountKey(name string) error
+	// GetIamPolicy returns the policy of a resource name supported by iamutil
+	GetIamPolicy(resource string) (*iamutil.Policy, error)
+	SetIamPolicy(resource string, policy *iamutil.Policy) (*iamutil.Policy, error)
+	// GetRole returns the custom role, a deleted role is returned with Deleted set until it is purged
+	GetRole(name string) (*iam.Role, error)
+	// CreateRole creates the custom role in the project, "" selects the default project
+	CreateRole(project string, roleId string, role *iam.Role) (*iam.Role, error)
+	// UpdateRole replaces title, description, permissions and stage of the custom role
+	UpdateRole(name string, role *iam.Role) (*iam.Role, error)
+	// DeleteRole marks the custom role deleted, it can be undeleted within 7 days
+	DeleteRole(name string) error
+	UndeleteRole(name string) (*iam.Role, error)
 }
 
-func NewGcpService() *GcpService {
-	service, err := newIamAdmin(context.TODO())
-	if err == nil {
-		return &GcpService{log: logf.Log.WithName("gcpservice"), iamAdmin: service}
-	}
-	return nil
+type GcpServiceImpl struct {
+	iamAdmin       *iam.Service
+	iamHandle      *iamutil.ApiHandle
+	defaultProject string
 }
 
-func (s *GcpService) CheckServiceAccountExists(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) (bool, error) {
-	if project == "" {
-		gcpCred, _, err := gcputil.FindCredentials("", context.TODO(), defaultCloudPlatformScope)
-		if err != nil {
-			return false, err
-		}
-		if gcpCred == nil {
-			return false, fmt.Errorf("error finding gcp credentials file")
-		}
-		project = gcpCred.ProjectId
-	}
+// GcpServiceOption configures the access to the gcp apis
+type GcpServiceOption func(*gcpServiceOptions)
 
-	_, err := s.iamAdmin.Projects.ServiceAccounts.Get(gcpServiceAccount.Status.ServiceAccountPath).Do()
-	if err != nil {
-		e, ok := err.(*googleapi.Error)
-		if !ok {
-			return false, err
-		}
-		if e.Code == 404 {
-			return false, nil
-		}
+type gcpServiceOptions struct {
+	endpoint       string
+	tokenSource    oauth2.TokenSource
+	defaultProject string
+}
+
+// WithEndpoint sends all requests to the endpoint instead of *.googleapis.com, e.g. to an emulator.
+// The host of the api is kept in the Host header of the request.
+func WithEndpoint(endpoint string) GcpServiceOption {
+	return func(o *gcpServiceOptions) {
+		o.endpoint = endpoint
 	}
-	return true, nil
 }
-func (s *GcpService) CheckServiceAccountKeyExists(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) (bool, error) {
-	if project == "" {
-		gcpCred, _, _ := gcputil.FindCredentials("", context.TODO(), defaultCloudPlatformScope)
-		project = gcpCred.ProjectId
+
+// WithTokenSource authenticates with the token source instead of the default credentials
+func WithTokenSource(tokenSource oauth2.TokenSource) GcpServiceOption {
+	return func(o *gcpServiceOptions) {
+		o.tokenSource = tokenSource
 	}
-	_, err := s.iamAdmin.Projects.ServiceAccounts.Keys.Get(gcpServiceAccount.Status.CredentialKey).Do()
+}
 
-	if err != nil {
-		e, ok := err.(*googleapi.Error)
-		if !ok {
-			return false, err
-		}
-		if e.Code == 404 {
-			return false, nil
-		}
+// WithDefaultProject sets the project used if no project is selected instead of the project of the default credentials
+func WithDefaultProject(project string) GcpServiceOption {
+	return func(o *gcpServiceOptions) {
+		o.defaultProject = project
 	}
-	return true, nil
 }
 
-func (s *GcpService) CreateServiceAccountKey(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) (*iam.ServiceAccountKey, error) {
-	response, err := s.iamAdmin.Projects.ServiceAccounts.Keys.List(gcpServiceAccount.Status.ServiceAccountPath).KeyTypes("USER_MANAGED").Do()
-	if err != nil && !isGoogleApi404Error(err) {
-		return nil, errwrap.Wrapf(fmt.Sprintf("unable to listservice account key for service account '%s': {{err}}", gcpServiceAccount.Status.ServiceAccountPath), err)
+func NewGcpService(opts ...GcpServiceOption) (*GcpServiceImpl, error) {
+	options := &gcpServiceOptions{}
+	for _, opt := range opts {
+		opt(options)
 	}
-	if response.Keys != nil && len(response.Keys) > 0 {
-		for _, k := range response.Keys {
-			_, err = s.iamAdmin.Projects.ServiceAccounts.Keys.Delete(k.Name).Do()
-			if err != nil {
-				return nil, errwrap.Wrapf(fmt.Sprintf("unable to delete service account key %s for service account '%s': {{err}}", k.Name, gcpServiceAccount.Status.ServiceAccountPath), err)
-			}
-		}
+	httpC, err := newHttpClient(context.TODO(), options, defaultCloudPlatformScope)
+	if err != nil {
+		return nil, err
 	}
-
-	key, err := s.iamAdmin.Projects.ServiceAccounts.Keys.Create(gcpServiceAccount.Status.ServiceAccountPath,
-		&iam.CreateServiceAccountKeyRequest{
-			PrivateKeyType: privateKeyTypeJson,
-		}).Do()
+	iamAdmin, err := iam.New(httpC)
 	if err != nil {
-		return nil, errwrap.Wrapf(fmt.Sprintf("unable to create new service account key for service account '%s': {{err}}", gcpServiceAccount.Status.ServiceAccountPath), err)
+		return nil, err
 	}
-	return key, nil
+	policyC := &http.Client{Transport: &policyVersionTransport{base: httpC.Transport}}
+	return &GcpServiceImpl{
+		iamAdmin:       iamAdmin,
+		iamHandle:      iamutil.GetApiHandle(policyC, useragent.String()),
+		defaultProject: options.defaultProject,
+	}, nil
 }
 
-func (s *GcpService) HandleAimRoles(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) error {
-
-	if project == "" {
-		gcpCred, _, _ := gcputil.FindCredentials("", context.TODO(), defaultCloudPlatformScope)
-		project = gcpCred.ProjectId
+func (s *GcpServiceImpl) DefaultProject() (string, error) {
+	if s.defaultProject != "" {
+		return s.defaultProject, nil
 	}
-
-	iamResources := iamutil.GetEnabledResources()
-	httpC, err := newHttpClient(context.TODO(), defaultCloudPlatformScope)
+	gcpCred, _, err := gcputil.FindCredentials("", context.TODO(), defaultCloudPlatformScope)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	iamHandle := iamutil.GetApiHandle(httpC, useragent.String())
-
-	for _, bindings := range gcpServiceAccount.Status.AppliedGcpRoleBindings {
-
-		resource, err := iamResources.Parse(bindings.Resource)
-		if err != nil {
-			return err
-		}
-
-		p, err := resource.GetIamPolicy(context.TODO(), iamHandle)
-		if err != nil {
-			return err
-		}
-
-		roles := util.StringSet{}
-		for _, role := range bindings.Roles {
-			roles.Add(role)
-		}
-
-		changed, newP := p.RemoveBindings(&iamutil.PolicyDelta{
-			Roles: roles,
-			Email: gcpServiceAccount.Status.ServiceAccountMail,
-		})
-		if !changed || newP == nil {
-			s.log.Info("role binding not changed skip", "resource", bindings.Resource)
-			continue
-		}
-		if _, err := resource.SetIamPolicy(context.TODO(), iamHandle, newP); err != nil {
-			return err
-		}
-
+	if gcpCred == nil {
+		return "", fmt.Errorf("error finding gcp credentials file")
 	}
+	return gcpCred.ProjectId, nil
+}
 
-	for _, bindings := range gcpServiceAccount.Spec.GcpRoleBindings {
-
-		resource, err := iamResources.Parse(bindings.Resource)
-		if err != nil {
-			return err
-		}
+func (s *GcpServiceImpl) GetServiceAccount(path string) (*iam.ServiceAccount, error) {
+	return s.iamAdmin.Projects.ServiceAccounts.Get(path).Do()
+}
 
-		p, err := resource.GetIamPolicy(context.TODO(), iamHandle)
+func (s *GcpServiceImpl) CreateServiceAccount(project string, accountId string, displayName string, description string) (*iam.ServiceAccount, error) {
+	if project == "" {
+		defaultProject, err := s.DefaultProject()
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		roles := util.StringSet{}
-		for _, role := range bindings.Roles {
-			roles.Add(role)
-		}
-
-		changed, newP := p.AddBindings(&iamutil.PolicyDelta{
-			Roles: roles,
-			Email: gcpServiceAccount.Status.ServiceAccountMail,
-		})
-		if !changed || newP == nil {
-			s.log.Info("role binding not changed skip", "resource", bindings.Resource)
-			continue
-		}
-
-		if _, err := resource.SetIamPolicy(context.TODO(), iamHandle, newP); err != nil {
-			return err
-		}
-
+		project = defaultProject
 	}
-	return nil
+	return s.iamAdmin.Projects.ServiceAccounts.Create(
+		fmt.Sprintf("projects/%s", project), &iam.CreateServiceAccountRequest{
+			AccountId:      accountId,
+			ServiceAccount: &iam.ServiceAccount{DisplayName: displayName, Description: description},
+		}).Do()
 }
 
-func (s *GcpService) NewServiceAccount(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) (*iam.ServiceAccount, error) {
-	if project == "" {
-		gcpCred, _, _ := gcputil.FindCredentials("", context.TODO(), defaultCloudPlatformScope)
-		project = gcpCred.ProjectId
-	}
-
-	saEmailPrefix := roleSetServiceAccountName(gcpServiceAccount.Spec.ServiceAccountIdentifier)
-	projectName := fmt.Sprintf("projects/%s", project)
-	displayName := gcpServiceAccount.Spec.ServiceAccountDescription
+func (s *GcpServiceImpl) DeleteServiceAccount(path string) error {
+	_, err := s.iamAdmin.Projects.ServiceAccounts.Delete(path).Do()
+	return err
+}
 
-	sa, err := s.iamAdmin.Projects.ServiceAccounts.Create(
-		projectName, &iam.CreateServiceAccountRequest{
-			AccountId:      saEmailPrefix,
-			ServiceAccount: &iam.ServiceAccount{DisplayName: displayName},
-		}).Do()
+func (s *GcpServiceImpl) GetServiceAccountKey(name string) (*iam.ServiceAccountKey, error) {
+	return s.iamAdmin.Projects.ServiceAccounts.Keys.Get(name).Do()
+}
 
+func (s *GcpServiceImpl) ListServiceAccountKeys(path string) ([]*iam.ServiceAccountKey, error) {
+	response, err := s.iamAdmin.Projects.ServiceAccounts.Keys.List(path).KeyTypes(userManagedKeyType).Do()
 	if err != nil {
-		return nil, errwrap.Wrapf(fmt.Sprintf("unable to create new service account under project '%s': {{err}}", projectName), err)
+		return nil, err
 	}
-
-	return sa, nil
+	return response.Keys, nil
 }
 
-func (s *GcpService) DeleteServiceAccount(account *gcpv1beta1.GcpServiceAccount) error {
-	err := s.removeAimRoleBindings(account, "")
-	if err != nil {
-		return err
-	}
-	_, err = s.iamAdmin.Projects.ServiceAccounts.Delete(account.Status.ServiceAccountPath).Do()
-	if err != nil && !isGoogleApi404Error(err) {
-		return err
-	}
-	return nil
+func (s *GcpServiceImpl) CreateServiceAccountKey(path string) (*iam.ServiceAccountKey, error) {
+	return s.iamAdmin.Projects.ServiceAccounts.Keys.Create(path,
+		&iam.CreateServiceAccountKeyRequest{
+			PrivateKeyType: privateKeyTypeJson,
+		}).Do()
 }
 
-func (s *GcpService) removeAimRoleBindings(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) error {
+func (s *GcpServiceImpl) DeleteServiceAccountKey(name string) error {
+	_, err := s.iamAdmin.Projects.ServiceAccounts.Keys.Delete(name).Do()
+	return err
+}
 
-	if project == "" {
-		gcpCred, _, _ := gcputil.FindCredentials("", context.TODO(), defaultCloudPlatformScope)
-		project = gcpCred.ProjectId
+func (s *GcpServiceImpl) GetIamPolicy(resource string) (*iamutil.Policy, error) {
+	r, err := iamutil.GetEnabledResources().Parse(resource)
+	if err != nil {
+		return nil, err
 	}
+	return r.GetIamPolicy(context.TODO(), s.iamHandle)
+}
 
-	iamResources := iamutil.GetEnabledResources()
-	httpC, err := newHttpClient(context.TODO(), defaultCloudPlatformScope)
+func (s *GcpServiceImpl) SetIamPolicy(resource string, policy *iamutil.Policy) (*iamutil.Policy, error) {
+	r, err := iamutil.GetEnabledResources().Parse(resource)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return r.SetIamPolicy(context.TODO(), s.iamHandle, policy)
+}
 
-	iamHandle := iamutil.GetApiHandle(httpC, useragent.String())
-
-	for _, bindings := range gcpServiceAccount.Status.AppliedGcpRoleBindings {
-
-		resource, err := iamResources.Parse(bindings.Resource)
-		if err != nil {
-			return err
-		}
+func (s *GcpServiceImpl) GetRole(name string) (*iam.Role, error) {
+	return s.iamAdmin.Projects.Roles.Get(name).Do()
+}
 
-		p, err := resource.GetIamPolicy(context.TODO(), iamHandle)
+func (s *GcpServiceImpl) CreateRole(project string, roleId string, role *iam.Role) (*iam.Role, error) {
+	if project == "" {
+		defaultProject, err := s.DefaultProject()
 		if err != nil {
-			return err
-		}
-
-		roles := util.StringSet{}
-		for _, role := range bindings.Roles {
-			roles.Add(role)
+			return nil, err
 		}
+		project = defaultProject
+	}
+	return s.iamAdmin.Projects.Roles.Create(
+		fmt.Sprintf("projects/%s", project), &iam.CreateRoleRequest{
+			RoleId: roleId,
+			Role:   role,
+		}).Do()
+}
 
-		changed, newP := p.RemoveBindings(&iamutil.PolicyDelta{
-			Roles: roles,
-			Email: gcpServiceAccount.Status.ServiceAccountMail,
-		})
-		if !changed || newP == nil {
-			continue
-		}
+func (s *GcpServiceImpl) UpdateRole(name string, role *iam.Role) (*iam.Role, error) {
+	return s.iamAdmin.Projects.Roles.Patch(name, role).UpdateMask(roleUpdateMask).Do()
+}
 
-		if _, err := resource.SetIamPolicy(context.TODO(), iamHandle, newP); err != nil {
-			return err
-		}
+func (s *GcpServiceImpl) DeleteRole(name string) error {
+	_, err := s.iamAdmin.Projects.Roles.Delete(name).Do()
+	return err
+}
 
-	}
-	return nil
+func (s *GcpServiceImpl) UndeleteRole(name string) (*iam.Role, error) {
+	return s.iamAdmin.Projects.Roles.Undelete(name, &iam.UndeleteRoleRequest{}).Do()
 }
 
-func newHttpClient(ctx context.Context, scopes ...string) (*http.Client, error) {
+func newHttpClient(ctx context.Context, options *gcpServiceOptions, scopes ...string) (*http.Client, error) {
 	if len(scopes) == 0 {
 		scopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
 	}
 
-	_, tokenSource, err := gcputil.FindCredentials("", ctx, scopes...)
-	if err != nil {
-		return nil, err
+	tokenSource := options.tokenSource
+	if tokenSource == nil {
+		var err error
+		_, tokenSource, err = gcputil.FindCredentials("", ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	tc := cleanhttp.DefaultClient()
+	if options.endpoint != "" {
+		endpoint, err := url.Parse(options.endpoint)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("invalid gcp endpoint '%s': {{err}}", options.endpoint), err)
+		}
+		tc.Transport = &endpointTransport{endpoint: endpoint, base: tc.Transport}
+	}
 	return oauth2.NewClient(
 		context.WithValue(ctx, oauth2.HTTPClient, tc),
 		tokenSource), nil
 }
 
-func newIamAdmin(ctx context.Context) (*iam.Service, error) {
-	c, err := newHttpClient(ctx, iam.CloudPlatformScope)
-	if err != nil {
-		return nil, err
-	}
+// endpointTransport sends the requests to another endpoint and keeps the original host in the Host header
+type endpointTransport struct {
+	endpoint *url.URL
+	base     http.RoundTripper
+}
 
-	return iam.New(c)
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redirected := req.Clone(req.Context())
+	redirected.Host = req.URL.Host
+	redirected.URL.Scheme = t.endpoint.Scheme
+	redirected.URL.Host = t.endpoint.Host
+	return t.base.RoundTrip(redirected)
 }
 
-func roleSetServiceAccountName(rsName string) (name string) {
-	// Sanitize role name
-	reg := regexp.MustCompile("[^a-zA-Z0-9-]+")
-	rsName = reg.ReplaceAllString(rsName, "-")
-
-	intSuffix := fmt.Sprintf("%d", time.Now().Unix())
-	fullName := fmt.Sprintf("kube%s-%s", rsName, intSuffix)
-	name = fullName
-	if len(fullName) > serviceAccountMaxLen {
-		toTrunc := len(fullName) - serviceAccountMaxLen
-		name = fmt.Sprintf("kube%s-%s", rsName[:len(rsName)-toTrunc], intSuffix)
+// policyVersionTransport requests iam policies in the version which supports conditions. iamutil only does this
+// for the cloud resource manager which takes the version in the request body, all other apis take a query parameter.
+type policyVersionTransport struct {
+	base http.RoundTripper
+}
+
+func (t *policyVersionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var parameter string
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/iam"):
+		// storage
+		parameter = "optionsRequestedPolicyVersion"
+	case strings.HasSuffix(req.URL.Path, ":getIamPolicy") && (req.Body == nil || req.Body == http.NoBody):
+		parameter = "options.requestedPolicyVersion"
+	default:
+		return t.base.RoundTrip(req)
 	}
-	return name
+	versioned := req.Clone(req.Context())
+	query := versioned.URL.Query()
+	query.Set(parameter, strconv.Itoa(conditionalPolicyVersion))
+	versioned.URL.RawQuery = query.Encode()
+	return t.base.RoundTrip(versioned)
 }
 
-func isGoogleApi404Error(err error) bool {
+// googleApiErrorCode returns the http status code of the gcp api error the error is or wraps, 0 otherwise
+func googleApiErrorCode(err error) int {
 	if err == nil {
-		return false
+		return 0
 	}
-	gErr, ok := err.(*googleapi.Error)
-	if ok && gErr.Code == 404 {
-		return true
+	gErr, ok := errwrap.GetType(err, &googleapi.Error{}).(*googleapi.Error)
+	if !ok {
+		return 0
 	}
-	return false
+	return gErr.Code
+}
+
+func isGoogleApi404Error(err error) bool {
+	return googleApiErrorCode(err) == http.StatusNotFound
 }
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/util"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/iam/v1"
+
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpemulator"
+)
+
+func newEmulatedGcpService(t *testing.T) (*GcpServiceImpl, *gcpemulator.Emulator, func()) {
+	server, emulator := gcpemulator.NewServer()
+	service, err := NewGcpService(
+		WithEndpoint(server.URL),
+		WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "emulator"})),
+		WithDefaultProject("emulated-project"))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return service, emulator, server.Close
+}
+
+func TestGcpServiceAccountsAndKeys(t *testing.T) {
+	service, emulator, closeEmulator := newEmulatedGcpService(t)
+	defer closeEmulator()
+
+	account, err := service.CreateServiceAccount("", "kube-test-1", "default/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Name != "projects/emulated-project/serviceAccounts/kube-test-1@emulated-project.iam.gserviceaccount.com" {
+		t.Errorf("unexpected service account name %s", account.Name)
+	}
+	if _, err := service.CreateServiceAccount("emulated-project", "kube-test-1", "default/test", ""); err == nil {
+		t.Error("expected a conflict for an existing service account")
+	}
+	if _, err := service.GetServiceAccount(account.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := service.CreateServiceAccountKey(account.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.PrivateKeyData == "" {
+		t.Error("expected private key data of a created key")
+	}
+	fetched, err := service.GetServiceAccountKey(key.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.PrivateKeyData != "" {
+		t.Error("expected no private key data of a fetched key")
+	}
+	keys, err := service.ListServiceAccountKeys(account.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Name != key.Name {
+		t.Errorf("expected key %s, got %v", key.Name, keys)
+	}
+
+	if err := service.DeleteServiceAccountKey(key.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.GetServiceAccountKey(key.Name); !isGoogleApi404Error(err) {
+		t.Errorf("expected not found for a deleted key, got %v", err)
+	}
+	if err := service.DeleteServiceAccount(account.Name); err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.GetServiceAccount(account.Name)
+	if !isGoogleApi404Error(err) {
+		t.Errorf("expected not found for a deleted service account, got %v", err)
+	}
+	if !isGoogleApi404Error(errwrap.Wrapf("wrapped: {{err}}", err)) {
+		t.Error("expected a wrapped not found error to be detected")
+	}
+	if emulator.ServiceAccount(account.Email) != nil {
+		t.Error("expected the service account to be deleted in the emulator")
+	}
+}
+
+func TestGcpServicePolicies(t *testing.T) {
+	service, emulator, closeEmulator := newEmulatedGcpService(t)
+	defer closeEmulator()
+	account, err := service.CreateServiceAccount("", "kube-policy-1", "default/policy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		resource string
+		emulated string
+	}{
+		{"projects/emulated-project", "cloudresourcemanager/projects/emulated-project"},
+		{"buckets/emulated-bucket", "storage/b/emulated-bucket"},
+		{"projects/emulated-project/topics/emulated-topic", "pubsub/projects/emulated-project/topics/emulated-topic"},
+		{"projects/emulated-project/subscriptions/emulated-subscription", "pubsub/projects/emulated-project/subscriptions/emulated-subscription"},
+		{account.Name, "iam/" + account.Name},
+	}
+	for _, test := range tests {
+		t.Run(test.resource, func(t *testing.T) {
+			policy, err := service.GetIamPolicy(test.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, updated := policy.AddBindings(&iamutil.PolicyDelta{Roles: util.ToSet([]string{"roles/viewer"}), Email: account.Email})
+			if !changed {
+				t.Fatal("expected the policy to change")
+			}
+			if _, err := service.SetIamPolicy(test.resource, updated); err != nil {
+				t.Fatal(err)
+			}
+			member := fmt.Sprintf("serviceAccount:%s", account.Email)
+			if members := emulator.Members(test.emulated, "roles/viewer"); len(members) != 1 || members[0] != member {
+				t.Errorf("expected %s as member of roles/viewer, got %v", member, members)
+			}
+
+			// the etag of the first read is outdated after the update
+			_, err = service.SetIamPolicy(test.resource, updated)
+			if googleApiErrorCode(err) != http.StatusConflict {
+				t.Errorf("expected a conflict for an outdated etag, got %v", err)
+			}
+
+			// conditions need policy version 3 in both directions
+			grant := roleGrant{Role: "roles/editor", Condition: &iamutil.Condition{Title: "office hours", Expression: "request.time.getHours() < 18"}}
+			policy, err = service.GetIamPolicy(test.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := service.SetIamPolicy(test.resource, changePolicyGrants(policy, member, []roleGrant{grant}, nil)); err != nil {
+				t.Fatal(err)
+			}
+			policy, err = service.GetIamPolicy(test.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if grants := memberGrants(policy, member); !containsGrant(grants, grant) {
+				t.Errorf("expected the conditional grant %s to be read back, got %v", grant, grants)
+			}
+		})
+	}
+}
+
+func TestGcpServiceRoles(t *testing.T) {
+	service, emulator, closeEmulator := newEmulatedGcpService(t)
+	defer closeEmulator()
+
+	role, err := service.CreateRole("", "bucketReader", &iam.Role{Title: "Bucket reader", IncludedPermissions: []string{"storage.objects.get"}, Stage: "GA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role.Name != "projects/emulated-project/roles/bucketReader" {
+		t.Errorf("unexpected role name %s", role.Name)
+	}
+	if _, err := service.UpdateRole(role.Name, &iam.Role{Title: "Bucket reader", IncludedPermissions: []string{"storage.objects.list"}, Stage: "BETA"}); err != nil {
+		t.Fatal(err)
+	}
+	if updated := emulator.Role(role.Name); updated.Stage != "BETA" || len(updated.IncludedPermissions) != 1 || updated.IncludedPermissions[0] != "storage.objects.list" {
+		t.Errorf("expected permissions and stage to be updated, got %+v", updated)
+	}
+
+	if err := service.DeleteRole(role.Name); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := service.GetRole(role.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.Deleted {
+		t.Error("expected a deleted role to be returned as deleted")
+	}
+	if _, err := service.CreateRole("", "bucketReader", &iam.Role{Title: "Bucket reader"}); googleApiErrorCode(err) != http.StatusConflict {
+		t.Errorf("expected a conflict for the id of a deleted role, got %v", err)
+	}
+	if _, err := service.UndeleteRole(role.Name); err != nil {
+		t.Fatal(err)
+	}
+	if emulator.Role(role.Name).Deleted {
+		t.Error("expected the role to be undeleted")
+	}
+}
+
+func TestGcpServiceFaults(t *testing.T) {
+	service, emulator, closeEmulator := newEmulatedGcpService(t)
+	defer closeEmulator()
+	err := emulator.InjectFault(gcpemulator.Fault{Service: gcpemulator.ServiceIam, Method: http.MethodPost, Path: "/serviceAccounts$", Code: http.StatusServiceUnavailable, Times: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = service.CreateServiceAccount("", "kube-fault-1", "default/fault", "")
+	if googleApiErrorCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("expected the injected fault, got %v", err)
+	}
+	if _, err := service.CreateServiceAccount("", "kube-fault-1", "default/fault", ""); err != nil {
+		t.Fatalf("expected the fault to be used up, got %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/errwrap"
+	"google.golang.org/api/iam/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+const (
+	customRoleIdMaxLen  = 64
+	customRoleIdHashLen = 8
+	// customRoleInUseRequeue is the interval the deletion of a custom role which is still bound is retried
+	customRoleInUseRequeue = 10 * time.Second
+	// customRoleOwnerPrefix starts the line of the description which marks a role as created by the controller
+	customRoleOwnerPrefix       = "managed by gcp-serviceaccount-controller for "
+	customRoleDescriptionMaxLen = 256
+)
+
+// reasons of the events recorded on GcpCustomRole objects
+const (
+	eventReasonRoleCreated   = "RoleCreated"
+	eventReasonRoleUpdated   = "RoleUpdated"
+	eventReasonRoleUndeleted = "RoleUndeleted"
+	eventReasonRoleDeleted   = "RoleDeleted"
+)
+
+var invalidRoleIdChars = regexp.MustCompile(`[^a-zA-Z0-9_\.]`)
+
+// GcpCustomRoleReconciler reconciles a GcpCustomRole object
+type GcpCustomRoleReconciler struct {
+	client.Client
+	Log                 logr.Logger
+	Scheme              *runtime.Scheme
+	Recorder            record.EventRecorder
+	GcpService          GcpService
+	RestrictionService  RestrictionService
+	DisableRestrictions bool
+}
+
+// +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpcustomroles,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpcustomroles/status,verbs=get;update;patch
+
+func (r *GcpCustomRoleReconciler) Reconcile(request ctrl.Request) (ctrl.Result, error) {
+	instance := &gcpv1beta1.GcpCustomRole{}
+	err := r.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			r.Log.Info("gcp custom role deleted", "name", request.NamespacedName)
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	if !instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !containsString(instance.ObjectMeta.Finalizers, iamKiwigridFinalizerName) {
+			return reconcile.Result{}, nil
+		}
+		users, err := r.customRoleUsers(instance)
+		if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionReady, "DeletionFailed", err)
+		}
+		if len(users) > 0 {
+			// the bindings of the role are removed when the GcpServiceAccounts are changed or deleted
+			r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionFalse, "InUse",
+				fmt.Sprintf("role is still bound by %s", strings.Join(users, ", ")))
+			if err := r.updateStatus(instance); err != nil {
+				return reconcile.Result{}, err
+			}
+			return reconcile.Result{RequeueAfter: customRoleInUseRequeue}, nil
+		}
+		if reason, err := r.deleteCustomRole(instance); err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionReady, reason, err)
+		}
+		instance.ObjectMeta.Finalizers = removeString(instance.ObjectMeta.Finalizers, iamKiwigridFinalizerName)
+		if err := r.Update(context.Background(), instance); err != nil {
+			return reconcile.Result{Requeue: true}, nil
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !containsString(instance.ObjectMeta.Finalizers, iamKiwigridFinalizerName) {
+		instance.ObjectMeta.Finalizers = append(instance.ObjectMeta.Finalizers, iamKiwigridFinalizerName)
+		if err := r.Update(context.Background(), instance); err != nil {
+			return reconcile.Result{Requeue: true}, nil
+		}
+	}
+
+	project, err := r.resolveProject(instance)
+	if err != nil {
+		return r.failed(instance, gcpv1beta1.ConditionRoleCreated, "ProjectResolutionFailed", err)
+	}
+	if !r.DisableRestrictions {
+		allowed, err := r.RestrictionService.CheckProjectAllowed(instance.Namespace, project)
+		if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionCheckFailed", err)
+		}
+		if !allowed {
+			restrictionDenials.WithLabelValues(instance.Namespace).Inc()
+			return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionDenied",
+				fmt.Errorf("namespace %s is not allowed to create roles in project %s", instance.Namespace, project))
+		}
+		r.setCondition(instance, gcpv1beta1.ConditionRestrictionSatisfied, corev1.ConditionTrue, "Allowed", "")
+	} else {
+		r.setCondition(instance, gcpv1beta1.ConditionRestrictionSatisfied, corev1.ConditionTrue, "RestrictionCheckDisabled", "")
+	}
+
+	roleId := customRoleId(instance)
+	name := fmt.Sprintf("projects/%s/roles/%s", project, roleId)
+	if instance.Status.RoleName != "" && instance.Status.RoleName != name {
+		return r.failed(instance, gcpv1beta1.ConditionRoleCreated, "RoleIdChanged",
+			fmt.Errorf("role %s can not be moved to %s", instance.Status.RoleName, name))
+	}
+	reason, err := r.ensureCustomRole(instance, project, roleId, name)
+	if err != nil {
+		return r.failed(instance, gcpv1beta1.ConditionRoleCreated, reason, err)
+	}
+
+	instance.Status.Project = project
+	instance.Status.RoleName = name
+	r.setCondition(instance, gcpv1beta1.ConditionRoleCreated, corev1.ConditionTrue, reason, fmt.Sprintf("role %s is up to date", name))
+	r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionTrue, "Reconciled", "")
+	if err := r.updateStatus(instance); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+// ensureCustomRole creates the role, undeletes it if it was deleted and updates it if it differs from the spec.
+// It returns the reason of the condition.
+func (r *GcpCustomRoleReconciler) ensureCustomRole(instance *gcpv1beta1.GcpCustomRole, project string, roleId string, name string) (string, error) {
+	desired := desiredCustomRole(instance)
+	role, err := r.GcpService.GetRole(name)
+	if isGoogleApi404Error(err) {
+		if _, err := r.GcpService.CreateRole(project, roleId, desired); err != nil {
+			return "RoleCreationFailed", errwrap.Wrapf(fmt.Sprintf("unable to create role %s: {{err}}", name), err)
+		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRoleCreated, "created role %s", name)
+		return "Created", nil
+	}
+	if err != nil {
+		return "RoleLookupFailed", errwrap.Wrapf(fmt.Sprintf("unable to get role %s: {{err}}", name), err)
+	}
+
+	// a role of someone else with the same id is neither changed nor deleted. Roles recorded in the status were
+	// created before the marker was introduced and get it with the next update.
+	if !ownsCustomRole(instance, role) && instance.Status.RoleName != name {
+		return "RoleNotOwned", fmt.Errorf("role %s exists and is not managed by %s/%s", name, instance.Namespace, instance.Name)
+	}
+
+	reason := "Exists"
+	if role.Deleted {
+		// a deleted role blocks its id until it is purged, so it is brought back instead of created
+		role, err = r.GcpService.UndeleteRole(name)
+		if err != nil {
+			return "RoleUndeletionFailed", errwrap.Wrapf(fmt.Sprintf("unable to undelete role %s: {{err}}", name), err)
+		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRoleUndeleted, "undeleted role %s", name)
+		reason = "Undeleted"
+	}
+	if !sameCustomRole(role, desired) {
+		if _, err := r.GcpService.UpdateRole(name, desired); err != nil {
+			return "RoleUpdateFailed", errwrap.Wrapf(fmt.Sprintf("unable to update role %s: {{err}}", name), err)
+		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRoleUpdated, "updated role %s", name)
+		if reason == "Exists" {
+			reason = "Updated"
+		}
+	}
+	return reason, nil
+}
+
+// deleteCustomRole deletes the role in gcp, a missing or already deleted role is ignored. It returns the reason
+// of a failure.
+func (r *GcpCustomRoleReconciler) deleteCustomRole(instance *gcpv1beta1.GcpCustomRole) (string, error) {
+	name := instance.Status.RoleName
+	if name == "" {
+		return "", nil
+	}
+	role, err := r.GcpService.GetRole(name)
+	if isGoogleApi404Error(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "DeletionFailed", errwrap.Wrapf(fmt.Sprintf("unable to get role %s: {{err}}", name), err)
+	}
+	if role.Deleted {
+		return "", nil
+	}
+	if !ownsCustomRole(instance, role) {
+		return "RoleNotOwned", fmt.Errorf("role %s is not managed by %s/%s and is not deleted", name, instance.Namespace, instance.Name)
+	}
+	if err := r.GcpService.DeleteRole(name); err != nil && !isGoogleApi404Error(err) {
+		return "DeletionFailed", errwrap.Wrapf(fmt.Sprintf("unable to delete role %s: {{err}}", name), err)
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRoleDeleted, "deleted role %s", name)
+	return "", nil
+}
+
+// customRoleUsers returns the GcpServiceAccounts of the namespace which still bind the role
+func (r *GcpCustomRoleReconciler) customRoleUsers(instance *gcpv1beta1.GcpCustomRole) ([]string, error) {
+	list := &gcpv1beta1.GcpServiceAccountList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(instance.Namespace)); err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, account := range list.Items {
+		if !account.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if containsString(referencedCustomRoles(account.Spec.GcpRoleBindings), instance.Name) {
+			users = append(users, account.Name)
+		}
+	}
+	return users, nil
+}
+
+// resolveProject returns the project the role was created in, the project of the spec, the default project
+// of the namespace or the project of the controller credentials
+func (r *GcpCustomRoleReconciler) resolveProject(instance *gcpv1beta1.GcpCustomRole) (string, error) {
+	if instance.Status.Project != "" {
+		return instance.Status.Project, nil
+	}
+	if instance.Spec.Project != "" {
+		return instance.Spec.Project, nil
+	}
+	project, err := r.RestrictionService.DefaultProject(instance.Namespace)
+	if err != nil || project != "" {
+		return project, err
+	}
+	return r.GcpService.DefaultProject()
+}
+
+// customRoleId returns the role id of the spec or an id derived from namespace and name. The derived id does not
+// depend on the uid, so a recreated GcpCustomRole finds its deleted role again.
+func customRoleId(instance *gcpv1beta1.GcpCustomRole) string {
+	if instance.Spec.RoleId != "" {
+		return instance.Spec.RoleId
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", instance.Namespace, instance.Name)))
+	suffix := hex.EncodeToString(sum[:])[:customRoleIdHashLen]
+	prefix := invalidRoleIdChars.ReplaceAllString(fmt.Sprintf("kube_%s_%s", instance.Namespace, instance.Name), "_")
+	if maxLen := customRoleIdMaxLen - customRoleIdHashLen - 1; len(prefix) > maxLen {
+		prefix = prefix[:maxLen]
+	}
+	return fmt.Sprintf("%s_%s", prefix, suffix)
+}
+
+func desiredCustomRole(instance *gcpv1beta1.GcpCustomRole) *iam.Role {
+	stage := instance.Spec.Stage
+	if stage == "" {
+		stage = gcpv1beta1.CustomRoleStageGA
+	}
+	return &iam.Role{
+		Title:               instance.Spec.Title,
+		Description:         customRoleDescription(instance),
+		IncludedPermissions: instance.Spec.Permissions,
+		Stage:               string(stage),
+	}
+}
+
+// customRoleOwner returns the line of the description which marks a role as created for the instance. It does not
+// depend on the uid like the derived role id, so a recreated GcpCustomRole owns its deleted role again.
+func customRoleOwner(instance *gcpv1beta1.GcpCustomRole) string {
+	return fmt.Sprintf("%s%s/%s", customRoleOwnerPrefix, instance.Namespace, instance.Name)
+}
+
+// customRoleDescription returns the description of the spec followed by the owner, the description of the spec
+// is shortened to fit into the description of the role
+func customRoleDescription(instance *gcpv1beta1.GcpCustomRole) string {
+	owner := customRoleOwner(instance)
+	description := instance.Spec.Description
+	if description == "" {
+		return owner
+	}
+	if maxLen := customRoleDescriptionMaxLen - len(owner) - 1; len(description) > maxLen {
+		description = description[:maxLen]
+	}
+	return description + "\n" + owner
+}
+
+// ownsCustomRole returns if the role was created for the instance
+func ownsCustomRole(instance *gcpv1beta1.GcpCustomRole, role *iam.Role) bool {
+	return strings.HasSuffix(role.Description, customRoleOwner(instance))
+}
+
+// sameCustomRole compares the fields the controller manages, the order of the permissions is ignored
+func sameCustomRole(role *iam.Role, desired *iam.Role) bool {
+	permissions := append([]string(nil), role.IncludedPermissions...)
+	desiredPermissions := append([]string(nil), desired.IncludedPermissions...)
+	sort.Strings(permissions)
+	sort.Strings(desiredPermissions)
+	return role.Title == desired.Title && role.Description == desired.Description && role.Stage == desired.Stage &&
+		reflect.DeepEqual(permissions, desiredPermissions)
+}
+
+// setCondition sets a condition for the current generation of the instance
+func (r *GcpCustomRoleReconciler) setCondition(instance *gcpv1beta1.GcpCustomRole, conditionType string, status corev1.ConditionStatus, reason string, message string) {
+	gcpv1beta1.SetCondition(&instance.Status.Conditions, gcpv1beta1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: instance.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// failed marks the given condition and Ready as false, records a warning event, persists the status
+// and returns the cause so the request is retried
+func (r *GcpCustomRoleReconciler) failed(instance *gcpv1beta1.GcpCustomRole, conditionType string, reason string, cause error) (ctrl.Result, error) {
+	r.Recorder.Event(instance, corev1.EventTypeWarning, reason, cause.Error())
+	if conditionType != gcpv1beta1.ConditionReady {
+		r.setCondition(instance, conditionType, corev1.ConditionFalse, reason, cause.Error())
+	}
+	r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionFalse, reason, cause.Error())
+	if err := r.updateStatus(instance); err != nil {
+		r.Log.Error(err, "unable to update status", "resourceName", instance.Name)
+	}
+	return reconcile.Result{}, cause
+}
+
+func (r *GcpCustomRoleReconciler) updateStatus(instance *gcpv1beta1.GcpCustomRole) error {
+	instance.Status.ObservedGeneration = instance.Generation
+	return r.Status().Update(context.TODO(), instance)
+}
+
+func (r *GcpCustomRoleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&gcpv1beta1.GcpCustomRole{}).
+		Complete(r)
+}
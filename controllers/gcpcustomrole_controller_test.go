@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/iam/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpfake"
+)
+
+var _ = Describe("GcpCustomRole controller", func() {
+	const (
+		timeout  = time.Second * 30
+		interval = time.Millisecond * 250
+		resource = "projects/" + testProject
+	)
+
+	fetchRole := func(name string) *gcpv1beta1.GcpCustomRole {
+		instance := &gcpv1beta1.GcpCustomRole{}
+		Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "default"}, instance)).To(Succeed())
+		return instance
+	}
+
+	newGcpCustomRole := func(name string, permissions ...string) *gcpv1beta1.GcpCustomRole {
+		return &gcpv1beta1.GcpCustomRole{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       gcpv1beta1.GcpCustomRoleSpec{Title: name, Permissions: permissions},
+		}
+	}
+
+	roleName := func(name string) func() string {
+		return func() string {
+			return fetchRole(name).Status.RoleName
+		}
+	}
+
+	It("binds a custom role once it is created and undeletes it when it is created again", func() {
+		account := &gcpv1beta1.GcpServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "custom-role-user", Namespace: "default"},
+			Spec: gcpv1beta1.GcpServiceAccountSpec{
+				ServiceAccountIdentifier: "custom-role-user",
+				Mode:                     gcpv1beta1.ModeKey,
+				SecretName:               "custom-role-user-credentials",
+				GcpRoleBindings:          []gcpv1beta1.GcpRoleBindings{{Resource: resource, CustomRoles: []string{"bucket-reader"}}},
+			},
+		}
+		Expect(k8sClient.Create(context.TODO(), account)).To(Succeed())
+
+		// the service account waits for the role
+		Eventually(func() string {
+			current := &gcpv1beta1.GcpServiceAccount{}
+			Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: account.Name, Namespace: "default"}, current)).To(Succeed())
+			if condition := gcpv1beta1.FindCondition(current.Status.Conditions, gcpv1beta1.ConditionBindingsApplied); condition != nil {
+				return condition.Reason
+			}
+			return ""
+		}, timeout, interval).Should(Equal("CustomRoleNotReady"))
+
+		Expect(k8sClient.Create(context.TODO(), newGcpCustomRole("bucket-reader", "storage.objects.get"))).To(Succeed())
+		Eventually(roleName("bucket-reader"), timeout, interval).ShouldNot(BeEmpty())
+		name := fetchRole("bucket-reader").Status.RoleName
+		Expect(gcpService.Role(name).IncludedPermissions).To(ConsistOf("storage.objects.get"))
+
+		Eventually(func() []string {
+			current := &gcpv1beta1.GcpServiceAccount{}
+			Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: account.Name, Namespace: "default"}, current)).To(Succeed())
+			if current.Status.ServiceAccountMail == "" {
+				return nil
+			}
+			return gcpService.Members(resource, name)
+		}, timeout, interval).Should(HaveLen(1))
+
+		// the role is kept while it is bound
+		Expect(k8sClient.Delete(context.TODO(), fetchRole("bucket-reader"))).To(Succeed())
+		Consistently(func() bool {
+			return gcpService.Role(name).Deleted
+		}, 2*time.Second, interval).Should(BeFalse())
+
+		Expect(k8sClient.Delete(context.TODO(), account)).To(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), types.NamespacedName{Name: "bucket-reader", Namespace: "default"}, &gcpv1beta1.GcpCustomRole{})
+			return errors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(gcpService.Role(name).Deleted).To(BeTrue())
+
+		Expect(k8sClient.Create(context.TODO(), newGcpCustomRole("bucket-reader", "storage.objects.list"))).To(Succeed())
+		Eventually(roleName("bucket-reader"), timeout, interval).Should(Equal(name))
+		Expect(gcpService.Role(name).Deleted).To(BeFalse())
+		Expect(gcpService.Role(name).IncludedPermissions).To(ConsistOf("storage.objects.list"))
+	})
+})
+
+func TestCustomRoleId(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-zA-Z0-9_\.]{3,64}$`)
+	tests := []struct {
+		namespace string
+		name      string
+		roleId    string
+		expected  string
+	}{
+		{"default", "bucket-reader", "", "kube_default_bucket_reader_"},
+		{"a-very-long-namespace-name-of-a-team", "a-very-long-name-of-a-custom-role", "", "kube_a_very_long_namespace_name_of_a_team_a_very_long_n_"},
+		{"default", "bucket-reader", "bucketReader", "bucketReader"},
+	}
+	for _, test := range tests {
+		instance := &gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: test.name, Namespace: test.namespace}}
+		instance.Spec.RoleId = test.roleId
+		id := customRoleId(instance)
+		if len(id) < len(test.expected) || id[:len(test.expected)] != test.expected {
+			t.Errorf("expected role id of %s/%s to start with %s, got %s", test.namespace, test.name, test.expected, id)
+		}
+		if !valid.MatchString(id) {
+			t.Errorf("role id %s is not valid", id)
+		}
+	}
+	first := customRoleId(&gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "a-b", Namespace: "default"}})
+	second := customRoleId(&gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "a_b", Namespace: "default"}})
+	if first == second {
+		t.Errorf("expected different role ids for names which normalize to the same id, got %s", first)
+	}
+}
+
+func TestEnsureCustomRole(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := &GcpCustomRoleReconciler{Log: logf.Log, Recorder: record.NewFakeRecorder(100), GcpService: fake}
+	instance := &gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "reader", Namespace: "default"}}
+	instance.Spec = gcpv1beta1.GcpCustomRoleSpec{Title: "Reader", Permissions: []string{"storage.objects.get"}}
+	name := fmt.Sprintf("projects/test-project/roles/%s", customRoleId(instance))
+
+	steps := []struct {
+		name     string
+		prepare  func()
+		expected string
+	}{
+		{"create", func() {}, "Created"},
+		{"unchanged", func() {}, "Exists"},
+		{"update", func() { instance.Spec.Permissions = []string{"storage.objects.get", "storage.objects.list"} }, "Updated"},
+		{"undelete", func() {
+			if err := fake.DeleteRole(name); err != nil {
+				t.Fatal(err)
+			}
+		}, "Undeleted"},
+	}
+	for _, step := range steps {
+		step.prepare()
+		reason, err := r.ensureCustomRole(instance, "test-project", customRoleId(instance), name)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if reason != step.expected {
+			t.Errorf("%s: expected reason %s, got %s", step.name, step.expected, reason)
+		}
+	}
+	role := fake.Role(name)
+	if role.Deleted || role.Stage != string(gcpv1beta1.CustomRoleStageGA) || len(role.IncludedPermissions) != 2 {
+		t.Errorf("expected an active GA role with two permissions, got %+v", role)
+	}
+	if fake.CallCount(gcpfake.MethodCreateRole) != 1 {
+		t.Errorf("expected the role to be created once, got %d", fake.CallCount(gcpfake.MethodCreateRole))
+	}
+}
+
+func TestCustomRoleOwnership(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := &GcpCustomRoleReconciler{Log: logf.Log, Recorder: record.NewFakeRecorder(100), GcpService: fake}
+	newInstance := func(namespace string, roleId string) *gcpv1beta1.GcpCustomRole {
+		instance := &gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "reader", Namespace: namespace}}
+		instance.Spec = gcpv1beta1.GcpCustomRoleSpec{Title: "Reader", RoleId: roleId, Permissions: []string{"storage.objects.get"}}
+		return instance
+	}
+	ensure := func(instance *gcpv1beta1.GcpCustomRole) (string, error) {
+		name := fmt.Sprintf("projects/test-project/roles/%s", customRoleId(instance))
+		reason, err := r.ensureCustomRole(instance, "test-project", customRoleId(instance), name)
+		if err == nil {
+			instance.Status.RoleName = name
+		}
+		return reason, err
+	}
+	handMade := &iam.Role{Title: "Hand made", Description: "maintained by the platform team", IncludedPermissions: []string{"storage.buckets.get"}, Stage: "GA"}
+	if _, err := fake.CreateRole("test-project", "handMade", handMade); err != nil {
+		t.Fatal(err)
+	}
+
+	// a role which was not created by the controller is taken over neither when it exists nor when it is deleted
+	takeover := newInstance("default", "handMade")
+	for _, deleted := range []bool{false, true} {
+		if deleted {
+			if err := fake.DeleteRole("projects/test-project/roles/handMade"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reason, err := ensure(takeover); err == nil || reason != "RoleNotOwned" {
+			t.Errorf("expected the hand made role to be refused, got %s: %v", reason, err)
+		}
+		if role := fake.Role("projects/test-project/roles/handMade"); role.Deleted != deleted || !sameCustomRole(role, handMade) {
+			t.Errorf("expected the hand made role to be unchanged, got %+v", role)
+		}
+	}
+	takeover.Status.RoleName = "projects/test-project/roles/handMade"
+	if reason, err := r.deleteCustomRole(takeover); err != nil {
+		t.Errorf("expected the deleted role to be ignored, got %s: %v", reason, err)
+	}
+
+	// two namespaces with the same role id
+	first := newInstance("team-a", "sharedReader")
+	second := newInstance("team-b", "sharedReader")
+	second.Spec.Permissions = []string{"storage.objects.list"}
+	if reason, err := ensure(first); err != nil || reason != "Created" {
+		t.Fatalf("expected the role to be created, got %s: %v", reason, err)
+	}
+	if reason, err := ensure(second); err == nil || reason != "RoleNotOwned" {
+		t.Errorf("expected the role of the other namespace to be refused, got %s: %v", reason, err)
+	}
+	second.Status.RoleName = first.Status.RoleName
+	if reason, err := r.deleteCustomRole(second); err == nil || reason != "RoleNotOwned" {
+		t.Errorf("expected the deletion of the role of the other namespace to be refused, got %s: %v", reason, err)
+	}
+	if role := fake.Role(first.Status.RoleName); role.Deleted || !sameCustomRole(role, desiredCustomRole(first)) {
+		t.Errorf("expected the role of the first namespace to be unchanged, got %+v", role)
+	}
+	if reason, err := r.deleteCustomRole(first); err != nil {
+		t.Fatalf("%s: %v", reason, err)
+	}
+	if !fake.Role(first.Status.RoleName).Deleted {
+		t.Error("expected the owned role to be deleted")
+	}
+
+	// a role created before the marker was introduced is recorded in the status
+	legacy := newInstance("default", "legacyReader")
+	legacy.Spec.Description = "reads objects"
+	if _, err := fake.CreateRole("test-project", "legacyReader", &iam.Role{Title: "Reader", Description: "reads objects", IncludedPermissions: []string{"storage.objects.get"}}); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Status.RoleName = "projects/test-project/roles/legacyReader"
+	if reason, err := ensure(legacy); err != nil || reason != "Updated" {
+		t.Fatalf("expected the legacy role to get the marker, got %s: %v", reason, err)
+	}
+	if description := fake.Role(legacy.Status.RoleName).Description; description != "reads objects\nmanaged by gcp-serviceaccount-controller for default/reader" {
+		t.Errorf("expected the description with the marker, got %q", description)
+	}
+}
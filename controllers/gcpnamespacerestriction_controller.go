@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+// GcpNamespaceRestrictionReconciler reports the namespaces a GcpNamespaceRestriction applies to,
+// how it is merged with the other restrictions of these namespaces, their quota usage and which
+// GcpServiceAccounts of the namespaces violate their restrictions
+type GcpNamespaceRestrictionReconciler struct {
+	client.Client
+	Log                logr.Logger
+	Scheme             *runtime.Scheme
+	RestrictionService RestrictionService
+	// ResyncInterval is the interval the compliance is evaluated again without any change, 0 disables it
+	ResyncInterval time.Duration
+}
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (r *GcpNamespaceRestrictionReconciler) Reconcile(request ctrl.Request) (ctrl.Result, error) {
+	instance := &gcpv1beta1.GcpNamespaceRestriction{}
+	err := r.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	restrictions := &gcpv1beta1.GcpNamespaceRestrictionList{}
+	if err := r.List(context.TODO(), restrictions); err != nil {
+		return reconcile.Result{}, err
+	}
+	namespaces := &corev1.NamespaceList{}
+	if err := r.List(context.TODO(), namespaces); err != nil {
+		return reconcile.Result{}, err
+	}
+	accounts := &gcpv1beta1.GcpServiceAccountList{}
+	if err := r.List(context.TODO(), accounts); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	now := time.Now()
+	status := r.evaluate(instance, restrictions.Items, namespaces.Items, accounts.Items)
+	last := instance.Status.LastEvaluationTime
+	due := last == nil || (r.ResyncInterval > 0 && !now.Before(last.Add(r.ResyncInterval)))
+	status.LastEvaluationTime = last
+	status.ObservedGeneration = instance.Generation
+	if due || !reflect.DeepEqual(status, instance.Status) {
+		evaluated := metav1.NewTime(now)
+		status.LastEvaluationTime = &evaluated
+		instance.Status = status
+		if err := r.Status().Update(context.TODO(), instance); err != nil {
+			return reconcile.Result{}, err
+		}
+		r.Log.Info("evaluated gcp namespace restriction", "name", instance.Name, "namespaces", len(status.Namespaces),
+			"governedAccounts", status.GovernedAccounts, "violations", len(status.Violations))
+	}
+	if r.ResyncInterval > 0 {
+		return reconcile.Result{RequeueAfter: instance.Status.LastEvaluationTime.Add(r.ResyncInterval).Sub(now)}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// evaluate returns the namespaces the restriction applies to ordered by name, together with all restrictions
+// the namespace merges and the quota usage, and the GcpServiceAccounts of these namespaces which violate the
+// merged restrictions. The evaluation time is not set.
+func (r *GcpNamespaceRestrictionReconciler) evaluate(instance *gcpv1beta1.GcpNamespaceRestriction, restrictions []gcpv1beta1.GcpNamespaceRestriction,
+	namespaces []corev1.Namespace, accounts []gcpv1beta1.GcpServiceAccount) gcpv1beta1.GcpNamespaceRestrictionStatus {
+	accountsByNamespace := map[string][]gcpv1beta1.GcpServiceAccount{}
+	for _, account := range accounts {
+		accountsByNamespace[account.Namespace] = append(accountsByNamespace[account.Namespace], account)
+	}
+	status := gcpv1beta1.GcpNamespaceRestrictionStatus{}
+	for i := range namespaces {
+		namespace := &namespaces[i]
+		if !appliesToNamespace(instance, namespace) {
+			continue
+		}
+		merged := restrictionsForNamespace(restrictions, namespace)
+		names := make([]string, 0, len(merged))
+		for _, restriction := range merged {
+			names = append(names, restriction.Name)
+		}
+		status.Namespaces = append(status.Namespaces, gcpv1beta1.RestrictedNamespace{
+			Namespace:      namespace.Name,
+			Restrictions:   names,
+			DefaultProject: defaultProject(merged),
+			Quota:          mergedQuota(merged),
+			Usage:          quotaUsage(accountsByNamespace[namespace.Name]),
+		})
+		for j := range accountsByNamespace[namespace.Name] {
+			account := &accountsByNamespace[namespace.Name][j]
+			if !account.DeletionTimestamp.IsZero() {
+				continue
+			}
+			status.GovernedAccounts++
+			if reasons := r.accountViolations(merged, account); len(reasons) > 0 {
+				status.Violations = append(status.Violations, gcpv1beta1.RestrictionViolation{
+					Namespace: account.Namespace,
+					Name:      account.Name,
+					Reasons:   reasons,
+				})
+			}
+		}
+	}
+	sort.Slice(status.Namespaces, func(i, j int) bool {
+		return status.Namespaces[i].Namespace < status.Namespaces[j].Namespace
+	})
+	sort.Slice(status.Violations, func(i, j int) bool {
+		if status.Violations[i].Namespace != status.Violations[j].Namespace {
+			return status.Violations[i].Namespace < status.Violations[j].Namespace
+		}
+		return status.Violations[i].Name < status.Violations[j].Name
+	})
+	return status
+}
+
+// accountViolations returns why the applied bindings or the requested project of the service account are not
+// allowed by the restrictions. Bindings which were denied are not applied and are no violation.
+func (r *GcpNamespaceRestrictionReconciler) accountViolations(restrictions []gcpv1beta1.GcpNamespaceRestriction, account *gcpv1beta1.GcpServiceAccount) []string {
+	var reasons []string
+	if len(account.Status.AppliedGcpRoleBindings) > 0 {
+		reasons = deniedReasons(r.RestrictionService.evaluate(restrictions, account.Status.AppliedGcpRoleBindings))
+	}
+	if project := requestedProject(&account.Spec); project != "" && !r.RestrictionService.projectAllowed(restrictions, project) {
+		reasons = append(reasons, fmt.Sprintf("project %s is not allowed", project))
+	}
+	return reasons
+}
+
+// allRestrictionRequests returns every GcpNamespaceRestriction, a changed namespace or restriction can
+// change the merged restrictions of all of them
+func (r *GcpNamespaceRestrictionReconciler) allRestrictionRequests(object handler.MapObject) []reconcile.Request {
+	list := &gcpv1beta1.GcpNamespaceRestrictionList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		r.Log.Error(err, "unable to list gcp namespace restrictions")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, restriction := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: restriction.Name}})
+	}
+	return requests
+}
+
+// namespaceRestrictionRequests returns the GcpNamespaceRestrictions which report the namespace of the
+// service account, so their usage is updated
+func (r *GcpNamespaceRestrictionReconciler) namespaceRestrictionRequests(object handler.MapObject) []reconcile.Request {
+	list := &gcpv1beta1.GcpNamespaceRestrictionList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		r.Log.Error(err, "unable to list gcp namespace restrictions")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, restriction := range list.Items {
+		for _, restricted := range restriction.Status.Namespaces {
+			if restricted.Namespace == object.Meta.GetNamespace() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: restriction.Name}})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+func (r *GcpNamespaceRestrictionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	c, err := ctrl.NewControllerManagedBy(mgr).
+		For(&gcpv1beta1.GcpNamespaceRestriction{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.allRestrictionRequests)}).
+		Watches(&source.Kind{Type: &gcpv1beta1.GcpServiceAccount{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.namespaceRestrictionRequests)}).
+		Build(r)
+	if err != nil {
+		return err
+	}
+	// the status of every restriction is written on evaluation, only a changed spec changes the other restrictions
+	return c.Watch(&source.Kind{Type: &gcpv1beta1.GcpNamespaceRestriction{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.allRestrictionRequests)},
+		predicate.GenerationChangedPredicate{})
+}
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+var _ = Describe("GcpNamespaceRestriction controller", func() {
+	const (
+		timeout  = time.Second * 30
+		interval = time.Millisecond * 250
+	)
+
+	restrictedNamespaces := func(name string) func() []gcpv1beta1.RestrictedNamespace {
+		return func() []gcpv1beta1.RestrictedNamespace {
+			instance := &gcpv1beta1.GcpNamespaceRestriction{}
+			Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: name}, instance)).To(Succeed())
+			return instance.Status.Namespaces
+		}
+	}
+
+	It("reports the merged restrictions of the selected namespaces", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "restricted-team", Labels: map[string]string{"team": "restricted"}}}
+		Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+
+		bySelector := &gcpv1beta1.GcpNamespaceRestriction{
+			ObjectMeta: metav1.ObjectMeta{Name: "restricted-team-selector"},
+			Spec: gcpv1beta1.GcpNamespaceRestrictionSpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "restricted"}},
+				GcpRestriction:    []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "buckets/restricted", Roles: []string{"roles/storage.objectViewer"}}},
+			},
+		}
+		Expect(k8sClient.Create(context.TODO(), bySelector)).To(Succeed())
+		Eventually(restrictedNamespaces(bySelector.Name), timeout, interval).Should(Equal([]gcpv1beta1.RestrictedNamespace{
+			{Namespace: "restricted-team", Restrictions: []string{"restricted-team-selector"}},
+		}))
+
+		byName := &gcpv1beta1.GcpNamespaceRestriction{
+			ObjectMeta: metav1.ObjectMeta{Name: "restricted-team-name"},
+			Spec:       gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "restricted-team", DefaultProject: "restricted-project"},
+		}
+		Expect(k8sClient.Create(context.TODO(), byName)).To(Succeed())
+		merged := []gcpv1beta1.RestrictedNamespace{{
+			Namespace:      "restricted-team",
+			Restrictions:   []string{"restricted-team-name", "restricted-team-selector"},
+			DefaultProject: "restricted-project",
+		}}
+		Eventually(restrictedNamespaces(bySelector.Name), timeout, interval).Should(Equal(merged))
+		Eventually(restrictedNamespaces(byName.Name), timeout, interval).Should(Equal(merged))
+
+		// the selector no longer matches once the label is removed
+		Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: namespace.Name}, namespace)).To(Succeed())
+		namespace.Labels = nil
+		Expect(k8sClient.Update(context.TODO(), namespace)).To(Succeed())
+		Eventually(restrictedNamespaces(bySelector.Name), timeout, interval).Should(BeEmpty())
+		Eventually(restrictedNamespaces(byName.Name), timeout, interval).Should(Equal([]gcpv1beta1.RestrictedNamespace{
+			{Namespace: "restricted-team", Restrictions: []string{"restricted-team-name"}, DefaultProject: "restricted-project"},
+		}))
+
+		Expect(k8sClient.Delete(context.TODO(), bySelector)).To(Succeed())
+		Expect(k8sClient.Delete(context.TODO(), byName)).To(Succeed())
+	})
+})
+
+func TestEvaluateRestriction(t *testing.T) {
+	team := newNamedTestRestriction("team", false,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "projects/team", Roles: []string{"roles/viewer", "roles/pubsub.publisher"}})
+	team.Spec.Namespace = ""
+	team.Spec.NamespacePattern = "^team-"
+	team.Spec.Projects = []string{"team"}
+	platform := newNamedTestRestriction("platform", false)
+	platform.Spec.Namespace = "team-a"
+	platform.Spec.Deny = []gcpv1beta1.GcpRestrictionDeny{{Roles: []string{"roles/pubsub.publisher"}}}
+	restrictions := []gcpv1beta1.GcpNamespaceRestriction{*team, *platform}
+
+	namespaces := []corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+	}
+	account := func(namespace string, name string, project string, roles ...string) gcpv1beta1.GcpServiceAccount {
+		instance := gcpv1beta1.GcpServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		instance.Spec.Project = project
+		if len(roles) > 0 {
+			instance.Status.ServiceAccountMail = name + "@team.iam.gserviceaccount.com"
+			instance.Status.AppliedGcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: roles}}
+		}
+		return instance
+	}
+	deleted := account("team-b", "deleted", "", "roles/owner")
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	accounts := []gcpv1beta1.GcpServiceAccount{
+		account("team-a", "publisher", "", "roles/viewer", "roles/pubsub.publisher"),
+		account("team-a", "viewer", "", "roles/viewer"),
+		account("team-b", "publisher", "", "roles/pubsub.publisher"),
+		account("team-b", "pending", "foreign"),
+		account("team-b", "owner", "", "roles/owner"),
+		deleted,
+		account("other", "owner", "", "roles/owner"),
+	}
+
+	r := &GcpNamespaceRestrictionReconciler{RestrictionService: *NewRestrictionService(&staticRestrictionResolveService{})}
+	status := r.evaluate(team, restrictions, namespaces, accounts)
+
+	var names []string
+	for _, namespace := range status.Namespaces {
+		names = append(names, namespace.Namespace)
+	}
+	if !reflect.DeepEqual(names, []string{"team-a", "team-b"}) {
+		t.Errorf("expected the namespaces team-a and team-b, got %v", names)
+	}
+	if status.GovernedAccounts != 5 {
+		t.Errorf("expected 5 governed accounts, got %d", status.GovernedAccounts)
+	}
+	expected := []gcpv1beta1.RestrictionViolation{
+		{Namespace: "team-a", Name: "publisher", Reasons: []string{"role roles/pubsub.publisher is denied on resource projects/team by platform"}},
+		{Namespace: "team-b", Name: "owner", Reasons: []string{"role roles/owner is not allowed on resource projects/team"}},
+		{Namespace: "team-b", Name: "pending", Reasons: []string{"project foreign is not allowed"}},
+	}
+	if !reflect.DeepEqual(status.Violations, expected) {
+		t.Errorf("expected violations\n%+v\ngot\n%+v", expected, status.Violations)
+	}
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/validate-gcp-kiwigrid-com-v1beta1-gcpnamespacerestriction,mutating=false,failurePolicy=fail,groups=gcp.kiwigrid.com,resources=gcpnamespacerestrictions,verbs=create;update,versions=v1beta1,name=vgcpnamespacerestriction.kb.io
+
+// GcpNamespaceRestrictionValidatorPath is the path the GcpNamespaceRestrictionValidator is served at
+const GcpNamespaceRestrictionValidatorPath = "/validate-gcp-kiwigrid-com-v1beta1-gcpnamespacerestriction"
+
+// GcpNamespaceRestrictionValidator rejects GcpNamespaceRestrictions with invalid patterns, selectors or resources
+type GcpNamespaceRestrictionValidator struct {
+	log     logr.Logger
+	decoder *admission.Decoder
+}
+
+func NewGcpNamespaceRestrictionValidator() *GcpNamespaceRestrictionValidator {
+	return &GcpNamespaceRestrictionValidator{
+		log: logf.Log.WithName("gcpnamespacerestrictionvalidator")}
+}
+
+func (v *GcpNamespaceRestrictionValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	instance := &gcpv1beta1.GcpNamespaceRestriction{}
+	if err := v.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	problems := validateRestrictionSpec(&instance.Spec)
+	if len(problems) > 0 {
+		v.log.Info("rejected gcp namespace restriction", "name", instance.Name, "problems", problems)
+		return admission.Denied(fmt.Sprintf("invalid gcp namespace restriction: %s", strings.Join(problems, "; ")))
+	}
+	return admission.Allowed("")
+}
+
+func (v *GcpNamespaceRestrictionValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// validateRestrictionSpec returns all problems of the restriction which would make it never match
+func validateRestrictionSpec(spec *gcpv1beta1.GcpNamespaceRestrictionSpec) []string {
+	var problems []string
+	if spec.Namespace == "" && spec.NamespacePattern == "" && spec.NamespaceSelector == nil {
+		problems = append(problems, "one of namespace, namespacePattern or namespaceSelector must be set")
+	}
+	if spec.NamespacePattern != "" {
+		if _, err := regexp.Compile(spec.NamespacePattern); err != nil {
+			problems = append(problems, fmt.Sprintf("namespacePattern %q is not a valid regular expression: %v", spec.NamespacePattern, err))
+		}
+	}
+	if spec.NamespaceSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector); err != nil {
+			problems = append(problems, fmt.Sprintf("namespaceSelector is invalid: %v", err))
+		}
+	}
+	iamResources := iamutil.GetEnabledResources()
+	for i, restriction := range spec.GcpRestriction {
+		if spec.Regex {
+			if _, err := regexp.Compile(restriction.Resource); err != nil {
+				problems = append(problems, fmt.Sprintf("restrictions[%d].resource %q is not a valid regular expression: %v", i, restriction.Resource, err))
+			}
+		} else if _, err := iamResources.Parse(restriction.Resource); err != nil {
+			problems = append(problems, fmt.Sprintf("restrictions[%d].resource %q is not a valid resource: %v", i, restriction.Resource, err))
+		}
+		switch restriction.Condition {
+		case "", gcpv1beta1.ConditionOptional, gcpv1beta1.ConditionRequired, gcpv1beta1.ConditionForbidden:
+		default:
+			problems = append(problems, fmt.Sprintf("restrictions[%d].condition %q is not Optional, Required or Forbidden", i, restriction.Condition))
+		}
+		for j, role := range restriction.Roles {
+			if !spec.Regex {
+				continue
+			}
+			if _, err := regexp.Compile(role); err != nil {
+				problems = append(problems, fmt.Sprintf("restrictions[%d].roles[%d] %q is not a valid regular expression: %v", i, j, role, err))
+			}
+		}
+	}
+	for i, deny := range spec.Deny {
+		if deny.Resource != "" {
+			if spec.Regex {
+				if _, err := regexp.Compile(deny.Resource); err != nil {
+					problems = append(problems, fmt.Sprintf("deny[%d].resource %q is not a valid regular expression: %v", i, deny.Resource, err))
+				}
+			} else if _, err := iamResources.Parse(deny.Resource); err != nil {
+				problems = append(problems, fmt.Sprintf("deny[%d].resource %q is not a valid resource: %v", i, deny.Resource, err))
+			}
+		}
+		if len(deny.Roles) == 0 {
+			problems = append(problems, fmt.Sprintf("deny[%d].roles must not be empty", i))
+		}
+		for j, role := range deny.Roles {
+			if !spec.Regex {
+				continue
+			}
+			if _, err := regexp.Compile(role); err != nil {
+				problems = append(problems, fmt.Sprintf("deny[%d].roles[%d] %q is not a valid regular expression: %v", i, j, role, err))
+			}
+		}
+	}
+	if !ValidEnforcementAction(spec.EnforcementAction) {
+		problems = append(problems, fmt.Sprintf("unknown enforcementAction %s", spec.EnforcementAction))
+	}
+	for i, project := range spec.Projects {
+		if !spec.Regex {
+			continue
+		}
+		if _, err := regexp.Compile(project); err != nil {
+			problems = append(problems, fmt.Sprintf("projects[%d] %q is not a valid regular expression: %v", i, project, err))
+		}
+	}
+	return problems
+}
+
+// ValidEnforcementAction returns if the action is known, empty selects the default of the controller
+func ValidEnforcementAction(action gcpv1beta1.EnforcementAction) bool {
+	switch action {
+	case "", gcpv1beta1.EnforcementRevoke, gcpv1beta1.EnforcementReportOnly:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+func TestValidateRestrictionSpec(t *testing.T) {
+	viewer := []string{"roles/viewer"}
+	tests := []struct {
+		name     string
+		spec     gcpv1beta1.GcpNamespaceRestrictionSpec
+		problems []string
+	}{
+		{"valid literal", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default",
+			GcpRestriction: []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "projects/team-project", Roles: viewer}}}, nil},
+		{"valid regex", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespacePattern: "^team-", Regex: true,
+			GcpRestriction: []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "^projects/team-.*$", Roles: []string{"^roles/.*viewer$"}}}}, nil},
+		{"valid selector", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}}, nil},
+		{"no namespace", gcpv1beta1.GcpNamespaceRestrictionSpec{},
+			[]string{"one of namespace, namespacePattern or namespaceSelector must be set"}},
+		{"invalid namespacePattern", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespacePattern: "team-("},
+			[]string{`namespacePattern "team-(" is not a valid regular expression`}},
+		{"invalid namespaceSelector", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespaceSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Matches", Values: []string{"a"}}}}},
+			[]string{"namespaceSelector is invalid"}},
+		{"invalid resource regex", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default", Regex: true,
+			GcpRestriction: []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "projects/(team", Roles: viewer}}},
+			[]string{`restrictions[0].resource "projects/(team" is not a valid regular expression`}},
+		{"invalid role regex", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default", Regex: true,
+			GcpRestriction: []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: ".*", Roles: []string{"roles/viewer", "roles/[editor"}}}},
+			[]string{`restrictions[0].roles[1] "roles/[editor" is not a valid regular expression`}},
+		{"unparsable literal resource", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default",
+			GcpRestriction: []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "projects/team-project", Roles: viewer}, {Resource: "unknown/thing", Roles: viewer}}},
+			[]string{`restrictions[1].resource "unknown/thing" is not a valid resource`}},
+		// a literal role is no regular expression
+		{"literal role", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default",
+			GcpRestriction: []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "projects/team-project", Roles: []string{"roles/[editor"}}}}, nil},
+		{"invalid deny", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default", Regex: true,
+			Deny: []gcpv1beta1.GcpRestrictionDeny{{Resource: "(", Roles: []string{"roles/owner"}}, {Roles: nil}}},
+			[]string{`deny[0].resource "(" is not a valid regular expression`, "deny[1].roles must not be empty"}},
+		{"several problems", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespacePattern: "(", Regex: true,
+			GcpRestriction:    []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "[", Roles: []string{"("}, Condition: "Sometimes"}},
+			Projects:          []string{"team-("},
+			EnforcementAction: "Ignore"},
+			[]string{"namespacePattern", "restrictions[0].resource", "restrictions[0].condition", "restrictions[0].roles[0]",
+				"unknown enforcementAction Ignore", "projects[0]"}},
+	}
+	for _, test := range tests {
+		problems := validateRestrictionSpec(&test.spec)
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: expected %d problems, got %v", test.name, len(test.problems), problems)
+			continue
+		}
+		for i, expected := range test.problems {
+			if !strings.Contains(problems[i], expected) {
+				t.Errorf("%s: expected problem %q, got %q", test.name, expected, problems[i])
+			}
+		}
+	}
+}
+
+func TestValidateRestrictionReportsAllProblems(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := gcpv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	validator := NewGcpNamespaceRestrictionValidator()
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	restriction := &gcpv1beta1.GcpNamespaceRestriction{ObjectMeta: metav1.ObjectMeta{Name: "team"}}
+	restriction.Spec.Regex = true
+	restriction.Spec.GcpRestriction = []gcpv1beta1.GcpRestrictionRoleBinding{{Resource: "(", Roles: []string{"["}}}
+	raw, err := json.Marshal(restriction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Operation: admissionv1beta1.Create}}
+	request.Object.Raw = raw
+
+	response := validator.Handle(context.TODO(), request)
+	if response.Allowed {
+		t.Fatal("expected the restriction to be denied")
+	}
+	for _, expected := range []string{"one of namespace", "restrictions[0].resource", "restrictions[0].roles[0]"} {
+		if !strings.Contains(string(response.Result.Reason), expected) {
+			t.Errorf("expected %q in the response, got %s", expected, response.Result.Reason)
+		}
+	}
+}
@@ -19,17 +19,26 @@ package controllers
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"google.golang.org/api/iam/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
 
@@ -39,20 +48,62 @@ import (
 
 const (
 	iamKiwigridFinalizerName = "iam.finalizers.kiwigrid.com"
+	credentialKeyAnnotation  = "gcp.kiwigrid.com/credential-key"
+	// maxDriftFindings is the number of drift findings kept in the status
+	maxDriftFindings = 10
+)
+
+// reasons of the events recorded on GcpServiceAccount and Secret objects
+const (
+	eventReasonCreated        = "ServiceAccountCreated"
+	eventReasonRecovered      = "ServiceAccountRecovered"
+	eventReasonDeleted        = "ServiceAccountDeleted"
+	eventReasonAdopted        = "ServiceAccountAdopted"
+	eventReasonReleased       = "ServiceAccountReleased"
+	eventReasonRetained       = "ServiceAccountRetained"
+	eventReasonAbandoned      = "ServiceAccountAbandoned"
+	eventReasonKeyIssued      = "KeyIssued"
+	eventReasonKeyDeleted     = "KeyDeleted"
+	eventReasonKeyRotated     = "KeyRotated"
+	eventReasonBindingAdded   = "BindingAdded"
+	eventReasonBindingRemoved = "BindingRemoved"
+	eventReasonSecretUpdated  = "SecretUpdated"
+	eventReasonSecretRestored = "SecretRestored"
+	eventReasonDriftDetected  = "DriftDetected"
+	eventReasonDenied         = "RestrictionDenied"
+	eventReasonRevoked        = "BindingsRevoked"
+	eventReasonQuotaExceeded  = "QuotaExceeded"
 )
 
 // GcpServiceAccountReconciler reconciles a GcpServiceAccount object
 type GcpServiceAccountReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
-	*GcpService
+	Log                 logr.Logger
+	Scheme              *runtime.Scheme
+	Recorder            record.EventRecorder
+	GcpService          GcpService
 	RestrictionService  RestrictionService
 	DisableRestrictions bool
+	// DefaultDeletionPolicy applies to GcpServiceAccounts without a deletion policy, empty means Delete
+	DefaultDeletionPolicy gcpv1beta1.DeletionPolicy
+	// ResyncInterval is the interval the applied state is compared with gcp and repaired, 0 disables the resync
+	ResyncInterval time.Duration
+	// WorkloadIdentityPool is the workload identity pool of the cluster, e.g. <project>.svc.id.goog, WorkloadIdentity
+	// mode fails without it
+	WorkloadIdentityPool string
+	// DefaultEnforcementAction applies to GcpNamespaceRestrictions without an enforcement action, empty means Revoke
+	DefaultEnforcementAction gcpv1beta1.EnforcementAction
 }
 
 // +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpserviceaccounts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpserviceaccounts/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpcustomroles,verbs=get;list;watch
+// +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpnamespacerestrictions,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=gcp.kiwigrid.com,resources=gcpnamespacerestrictions/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 
 func (r *GcpServiceAccountReconciler) Reconcile(request ctrl.Request) (ctrl.Result, error) {
 	_ = context.Background()
@@ -64,7 +115,8 @@ func (r *GcpServiceAccountReconciler) Reconcile(request ctrl.Request) (ctrl.Resu
 		if errors.IsNotFound(err) {
 			// Object not found, return.  Created objects are automatically garbage collected.
 			// For additional cleanup logic use finalizers.
-			r.log.Info("gcp service account deleted", "name", request.NamespacedName)
+			r.Log.Info("gcp service account deleted", "name", request.NamespacedName)
+			serviceAccountMetrics.forget(request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
@@ -84,10 +136,21 @@ func (r *GcpServiceAccountReconciler) Reconcile(request ctrl.Request) (ctrl.Resu
 		// The object is being deleted
 		if containsString(instance.ObjectMeta.Finalizers, iamKiwigridFinalizerName) {
 			// our finalizer is present, so lets handle our external dependency
-			if err := r.deleteExternalDependency(instance); err != nil {
+			policy := r.deletionPolicyOf(instance)
+			if err := r.deleteExternalDependency(instance, policy); err != nil {
 				// if fail to delete the external dependency here, return with error
 				// so that it can be retried
-				return reconcile.Result{}, err
+				return r.failed(instance, gcpv1beta1.ConditionReady, "DeletionFailed", err)
+			}
+			switch {
+			case policy == gcpv1beta1.DeletionPolicyAbandon:
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonAbandoned, "abandoned service account %s with its keys and bindings", instance.Status.ServiceAccountMail)
+			case policy == gcpv1beta1.DeletionPolicyRetain:
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRetained, "retained service account %s without keys and bindings", instance.Status.ServiceAccountMail)
+			case instance.Status.Adopted:
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonReleased, "released adopted service account %s", instance.Status.ServiceAccountMail)
+			default:
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonDeleted, "deleted service account %s", instance.Status.ServiceAccountMail)
 			}
 
 			// remove our finalizer from the list and update it.
@@ -95,131 +158,797 @@ func (r *GcpServiceAccountReconciler) Reconcile(request ctrl.Request) (ctrl.Resu
 			if err := r.Update(context.Background(), instance); err != nil {
 				return reconcile.Result{Requeue: true}, nil
 			}
+			serviceAccountMetrics.forget(request.NamespacedName)
 		}
 
 		// Our finalizer has finished, so the reconciler can do nothing.
 		return reconcile.Result{}, nil
 	}
 
-	r.log.Info("Start Reconcile", "resourceName", instance.Name)
+	r.Log.Info("Start Reconcile", "resourceName", instance.Name)
+	// the status is updated during the reconcile, a spec change has to be noticed before
+	specChanged := instance.Status.ObservedGeneration != instance.Generation
+	bindings, err := r.resolveRoleBindings(instance)
+	if err != nil {
+		return r.failed(instance, gcpv1beta1.ConditionBindingsApplied, "CustomRoleNotReady", err)
+	}
 	if !r.DisableRestrictions {
-		hasRights, err := r.RestrictionService.CheckNamespaceHasRights(instance.Namespace, instance.Spec.GcpRoleBindings)
+		decisions, err := r.RestrictionService.Evaluate(instance.Namespace, bindings)
+		if IsRestrictionNotFound(err) {
+			restrictionDenials.WithLabelValues(instance.Namespace).Inc()
+			return r.denied(instance, err)
+		}
 		if err != nil {
-			return reconcile.Result{}, err
+			return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionCheckFailed", err)
 		}
-		if !hasRights {
-			return reconcile.Result{}, fmt.Errorf("not enough rights for namespace %s to create serviceaccount for resource %s", instance.Namespace, instance.Name)
+		instance.Status.RestrictionDecisions = decisions
+		if denied := deniedReasons(decisions); len(denied) > 0 {
+			restrictionDenials.WithLabelValues(instance.Namespace).Inc()
+			return r.denied(instance, fmt.Errorf("bindings not allowed for namespace %s: %s", instance.Namespace, strings.Join(denied, "; ")))
 		}
+		if project := requestedProject(&instance.Spec); project != "" {
+			projectAllowed, err := r.RestrictionService.CheckProjectAllowed(instance.Namespace, project)
+			if err != nil {
+				return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionCheckFailed", err)
+			}
+			if !projectAllowed {
+				restrictionDenials.WithLabelValues(instance.Namespace).Inc()
+				return r.denied(instance, fmt.Errorf("namespace %s is not allowed to use serviceaccounts in project %s", instance.Namespace, project))
+			}
+		}
+		usage := gcpv1beta1.QuotaUsage{BindingsPerAccount: countRoleBindings(bindings)}
+		if instance.Status.ServiceAccountMail == "" {
+			others, err := r.namespaceUsage(instance)
+			if err != nil {
+				return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionCheckFailed", err)
+			}
+			usage.ServiceAccounts = others.ServiceAccounts + 1
+		}
+		if err := r.checkQuota(instance, usage); IsQuotaExceeded(err) {
+			return r.quotaExceeded(instance, gcpv1beta1.ConditionRestrictionSatisfied, err)
+		} else if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionCheckFailed", err)
+		}
+		r.setCondition(instance, gcpv1beta1.ConditionRestrictionSatisfied, corev1.ConditionTrue, "Allowed", "")
+	} else {
+		instance.Status.RestrictionDecisions = nil
+		r.setCondition(instance, gcpv1beta1.ConditionRestrictionSatisfied, corev1.ConditionTrue, "RestrictionCheckDisabled", "")
 	}
-	ok, err := r.GcpService.CheckServiceAccountExists(instance, "")
+
+	// the webhook rejects the change, without webhooks it is reported instead of ignored
+	if instance.Spec.Project != "" && instance.Status.Project != "" && instance.Spec.Project != instance.Status.Project {
+		return r.failed(instance, gcpv1beta1.ConditionAccountCreated, "ProjectChanged",
+			fmt.Errorf("service account %s can not be moved from project %s to %s", instance.Status.ServiceAccountMail, instance.Status.Project, instance.Spec.Project))
+	}
+	project, err := r.resolveProject(instance)
 	if err != nil {
-		return reconcile.Result{}, err
+		return r.failed(instance, gcpv1beta1.ConditionAccountCreated, "ProjectResolutionFailed", err)
+	}
+	existingEmail := instance.Spec.ExistingServiceAccountEmail
+	if existingEmail != "" && instance.Status.ServiceAccountMail != "" && !strings.EqualFold(existingEmail, instance.Status.ServiceAccountMail) {
+		return r.failed(instance, gcpv1beta1.ConditionAccountCreated, "AdoptionConflict",
+			fmt.Errorf("can not adopt service account %s, the GcpServiceAccount already manages %s", existingEmail, instance.Status.ServiceAccountMail))
+	}
+	ok, err := r.serviceAccountExists(instance)
+	if err != nil {
+		return r.failed(instance, gcpv1beta1.ConditionAccountCreated, "AccountLookupFailed", err)
 	}
 
-	if !ok {
-		r.log.Info("create new service account")
-		account, err := r.GcpService.NewServiceAccount(instance, "")
+	if !ok && existingEmail != "" {
+		r.Log.Info("adopt existing service account", "email", existingEmail)
+		account, err := r.adoptServiceAccount(instance)
+		if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionAccountCreated, "AdoptionFailed", err)
+		}
+		split := strings.Split(account.Name, "/")
+
+		instance.Status.Project = split[1]
+		instance.Status.ServiceAccountPath = account.Name
+		instance.Status.ServiceAccountMail = split[3]
+		instance.Status.Adopted = true
+		instance.Status.CredentialKey = ""
+		instance.Status.AppliedGcpRoleBindings = nil
+		instance.Status.PreexistingGcpRoleBindings = nil
+		r.setCondition(instance, gcpv1beta1.ConditionAccountCreated, corev1.ConditionTrue, "Adopted", fmt.Sprintf("service account %s adopted", split[3]))
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonAdopted, "adopted existing service account %s", split[3])
+
+		err = r.updateStatus(instance)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
-		r.log.Info("service account created")
+	} else if !ok {
+		r.Log.Info("create new service account", "project", project)
+		account, created, err := r.ensureServiceAccount(instance, project)
+		if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionAccountCreated, "AccountCreationFailed", err)
+		}
 		split := strings.Split(account.Name, "/")
 		eMail := split[3]
 
-		instance.Status = gcpv1beta1.GcpServiceAccountStatus{
-			ServiceAccountPath: account.Name,
-			ServiceAccountMail: eMail,
+		instance.Status.Project = split[1]
+		instance.Status.ServiceAccountPath = account.Name
+		instance.Status.ServiceAccountMail = eMail
+		instance.Status.Adopted = false
+		instance.Status.CredentialKey = ""
+		instance.Status.AppliedGcpRoleBindings = nil
+		instance.Status.PreexistingGcpRoleBindings = nil
+		if created {
+			r.Log.Info("service account created")
+			r.setCondition(instance, gcpv1beta1.ConditionAccountCreated, corev1.ConditionTrue, "Created", fmt.Sprintf("service account %s created", eMail))
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonCreated, "created service account %s", eMail)
+		} else {
+			r.Log.Info("service account recovered")
+			r.setCondition(instance, gcpv1beta1.ConditionAccountCreated, corev1.ConditionTrue, "Recovered", fmt.Sprintf("service account %s recovered", eMail))
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRecovered, "recovered service account %s created by an earlier reconcile", eMail)
 		}
 
-		err = r.Update(context.TODO(), instance)
+		err = r.updateStatus(instance)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
+	} else {
+		if instance.Status.Project == "" {
+			// service account was created before the project was tracked
+			instance.Status.Project = strings.Split(instance.Status.ServiceAccountPath, "/")[1]
+		}
+		r.setCondition(instance, gcpv1beta1.ConditionAccountCreated, corev1.ConditionTrue, "Exists", fmt.Sprintf("service account %s exists", instance.Status.ServiceAccountMail))
 	}
 
-	err = r.GcpService.HandleAimRoles(instance, "")
+	now := time.Now()
+	resync := r.ResyncInterval > 0 && (instance.Status.LastResync == nil || !now.Before(instance.Status.LastResync.Add(r.ResyncInterval)))
+	// unchanged bindings are compared with the live iam policies only on resync, so the api calls do not scale with the events
+	findings, err := r.applyRoleBindings(instance, bindings, resync || specChanged)
 	if err != nil {
-		return reconcile.Result{}, err
+		return r.failed(instance, gcpv1beta1.ConditionBindingsApplied, "IamPolicyUpdateFailed", err)
 	}
-	instance.Status.AppliedGcpRoleBindings = instance.Spec.GcpRoleBindings
+	instance.Status.AppliedGcpRoleBindings = canonicalBindings(bindings)
+	r.recordDrift(instance, findings)
+	r.setCondition(instance, gcpv1beta1.ConditionBindingsApplied, corev1.ConditionTrue, "Applied", "")
 
-	ok, err = r.GcpService.CheckServiceAccountKeyExists(instance, "")
+	var requeueAfter time.Duration
+	if instance.Spec.Mode == gcpv1beta1.ModeWorkloadIdentity {
+		reason, err := r.reconcileWorkloadIdentity(instance)
+		if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionWorkloadIdentityBound, reason, err)
+		}
+	} else {
+		// the service account was switched back from workload identity
+		if instance.Status.WorkloadIdentityMember != "" || instance.Status.KubernetesServiceAccount != "" {
+			if err := r.cleanupWorkloadIdentity(instance); err != nil {
+				return r.failed(instance, gcpv1beta1.ConditionWorkloadIdentityBound, "WorkloadIdentityCleanupFailed", err)
+			}
+		}
+		var reason string
+		requeueAfter, reason, err = r.reconcileKey(instance)
+		if IsQuotaExceeded(err) {
+			return r.quotaExceeded(instance, gcpv1beta1.ConditionKeyIssued, err)
+		}
+		if err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionKeyIssued, reason, err)
+		}
+	}
+
+	if resync {
+		lastResync := metav1.NewTime(now)
+		instance.Status.LastResync = &lastResync
+	}
+	if r.ResyncInterval > 0 {
+		untilResync := instance.Status.LastResync.Add(r.ResyncInterval).Sub(now)
+		if requeueAfter == 0 || untilResync < requeueAfter {
+			requeueAfter = untilResync
+		}
+	}
+	if expiry := nextBindingExpiry(instance, now); expiry != nil {
+		// the expired binding is removed from the iam policy by the next reconcile
+		untilExpiry := expiry.Sub(now) + time.Second
+		if requeueAfter == 0 || untilExpiry < requeueAfter {
+			requeueAfter = untilExpiry
+		}
+	}
 
+	r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionTrue, "Reconciled", "")
+	err = r.updateStatus(instance)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
+	serviceAccountMetrics.track(instance)
+
+	return reconcile.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// reconcileKey issues a new key if the key or the secret is missing, rotates the key once the rotation
+// is due and deletes the previous key after the overlap window. It returns the duration until the next
+// key step is due or the reason of the failure.
+func (r *GcpServiceAccountReconciler) reconcileKey(instance *gcpv1beta1.GcpServiceAccount) (time.Duration, string, error) {
+	key, err := r.serviceAccountKey(instance)
+	if err != nil {
+		return 0, "KeyLookupFailed", err
+	}
 
 	found := &corev1.Secret{}
 	searchSecretError := r.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, found)
-	deploy := &corev1.Secret{}
-
-	secretKey := instance.Spec.SecretKey
-	if secretKey == "" {
-		secretKey = "credentials.json"
+	if searchSecretError != nil && !errors.IsNotFound(searchSecretError) {
+		return 0, "SecretWriteFailed", searchSecretError
+	}
+	secretFound := searchSecretError == nil
+	// the key data can not be read again from gcp, a secret which lost the data of the current key needs a new key
+	keyLost := key != nil && (!secretFound || !secretHoldsKey(found.Data[secretKeyOf(instance)], key.Name))
+
+	now := time.Now()
+	// the previous key is deleted before a rotation replaces it
+	if instance.Status.PreviousCredentialKey != "" && instance.Status.PreviousCredentialKeyDeletion != nil && !now.Before(instance.Status.PreviousCredentialKeyDeletion.Time) {
+		r.Log.Info("delete previous service account key", "resourceName", instance.Name, "key", instance.Status.PreviousCredentialKey)
+		if err := r.deleteServiceAccountKey(instance, instance.Status.PreviousCredentialKey); err != nil {
+			return 0, "KeyDeletionFailed", err
+		}
+		instance.Status.PreviousCredentialKey = ""
+		instance.Status.PreviousCredentialKeyDeletion = nil
 	}
 
 	//service account does not exists
-	if !ok || (searchSecretError != nil && errors.IsNotFound(searchSecretError)) || (searchSecretError == nil && len(found.Data[secretKey]) == 0) {
-		r.log.Info(fmt.Sprintf("create or update secret: %s", instance.Spec.SecretName))
-		key, err := r.GcpService.CreateServiceAccountKey(instance, "")
+	if key == nil {
+		r.Log.Info(fmt.Sprintf("create or update secret: %s", instance.Spec.SecretName))
+		deletedKey := instance.Status.CredentialKey
+		// all other keys of the service account are replaced by the new key
+		if err := r.checkKeyQuota(instance, 1); err != nil {
+			return 0, "QuotaExceeded", err
+		}
+		newKey, err := r.replaceServiceAccountKeys(instance)
 		if err != nil {
-			return reconcile.Result{}, err
+			return 0, "KeyCreationFailed", err
+		}
+		if deletedKey != "" {
+			r.recordDrift(instance, []gcpv1beta1.DriftFinding{{Type: gcpv1beta1.DriftMissingKey, Resource: deletedKey}})
+		}
+		// all other keys are deleted together with the previous key
+		instance.Status.PreviousCredentialKey = ""
+		instance.Status.PreviousCredentialKeyDeletion = nil
+		if err := r.issueKey(instance, newKey, now); err != nil {
+			return 0, "SecretWriteFailed", err
 		}
-		instance.Status.CredentialKey = key.Name
-		err = r.Update(context.TODO(), instance)
+		r.setCondition(instance, gcpv1beta1.ConditionKeyIssued, corev1.ConditionTrue, "Issued", fmt.Sprintf("key %s written to secret %s", newKey.Name, instance.Spec.SecretName))
+	} else if keyLost {
+		r.Log.Info("replace lost service account key", "resourceName", instance.Name, "key", key.Name)
+		// only the lost key is replaced, the previous key stays valid until its scheduled deletion
+		if err := r.checkKeyQuota(instance, accountKeys(instance)); err != nil {
+			return 0, "QuotaExceeded", err
+		}
+		newKey, err := r.issueServiceAccountKey(instance)
 		if err != nil {
-			return reconcile.Result{}, err
+			return 0, "KeyCreationFailed", err
 		}
-		r.log.Info(fmt.Sprintf("modify secret %s with gcp key %s", instance.Spec.SecretName, key.Name))
-
-		deploy.Name = instance.Spec.SecretName
-		deploy.Namespace = instance.Namespace
-		deploy.Data = map[string][]byte{}
-		bytes, err := base64.StdEncoding.DecodeString(key.PrivateKeyData)
-		deploy.Data[secretKey] = bytes
-
-		if err := controllerutil.SetControllerReference(instance, deploy, r.Scheme); err != nil {
-			return reconcile.Result{}, err
+		if err := r.issueKey(instance, newKey, now); err != nil {
+			return 0, "SecretWriteFailed", err
 		}
-
-		//new secret
-		if searchSecretError != nil && errors.IsNotFound(searchSecretError) {
-			r.log.Info("Creating Secret", "secretName", instance.Spec.SecretName, "namespace", instance.Namespace)
-			err = r.Create(context.TODO(), deploy)
+		if err := r.deleteServiceAccountKey(instance, key.Name); err != nil {
+			return 0, "KeyDeletionFailed", err
+		}
+		if !secretFound {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonSecretRestored, "restored deleted secret %s with new key %s", instance.Spec.SecretName, newKey.Name)
+		} else {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonSecretRestored, "restored secret %s which lost the data of key %s with new key %s", instance.Spec.SecretName, key.Name, newKey.Name)
+		}
+		r.setCondition(instance, gcpv1beta1.ConditionKeyIssued, corev1.ConditionTrue, "Issued", fmt.Sprintf("key %s written to secret %s", newKey.Name, instance.Spec.SecretName))
+	} else {
+		if err := r.restoreSecret(instance, found, key.Name); err != nil {
+			return 0, "SecretWriteFailed", err
+		}
+		if instance.Status.CredentialKeyCreationTime == nil {
+			// key was issued before the creation time was tracked
+			created := keyCreationTime(key, now)
+			instance.Status.CredentialKeyCreationTime = &created
+		}
+		if next := nextKeyRotation(instance); next != nil && !now.Before(next.Time) {
+			r.Log.Info("rotate service account key", "resourceName", instance.Name, "key", instance.Status.CredentialKey)
+			if err := r.checkKeyQuota(instance, accountKeys(instance)+1); err != nil {
+				return 0, "QuotaExceeded", err
+			}
+			newKey, err := r.issueServiceAccountKey(instance)
 			if err != nil {
-				return reconcile.Result{}, searchSecretError
+				return 0, "KeyRotationFailed", err
 			}
-			return reconcile.Result{}, nil
-		} else if searchSecretError != nil {
-			return reconcile.Result{}, searchSecretError
+			deletion := metav1.NewTime(now.Add(keyRotationOverlap(instance.Spec.KeyRotation)))
+			instance.Status.PreviousCredentialKey = instance.Status.CredentialKey
+			instance.Status.PreviousCredentialKeyDeletion = &deletion
+			if err := r.issueKey(instance, newKey, now); err != nil {
+				return 0, "SecretWriteFailed", err
+			}
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonKeyRotated, "rotated key %s, previous key %s is deleted at %s", newKey.Name, instance.Status.PreviousCredentialKey, deletion.Format(time.RFC3339))
+			r.setCondition(instance, gcpv1beta1.ConditionKeyIssued, corev1.ConditionTrue, "Rotated", fmt.Sprintf("key %s written to secret %s", newKey.Name, instance.Spec.SecretName))
+		} else {
+			r.setCondition(instance, gcpv1beta1.ConditionKeyIssued, corev1.ConditionTrue, "Exists", fmt.Sprintf("key %s present in secret %s", instance.Status.CredentialKey, instance.Spec.SecretName))
+		}
+	}
+
+	var requeueAfter time.Duration
+	instance.Status.NextKeyRotation = nextKeyRotation(instance)
+	if instance.Status.NextKeyRotation != nil {
+		requeueAfter = instance.Status.NextKeyRotation.Sub(now)
+	}
+	if instance.Status.PreviousCredentialKeyDeletion != nil {
+		untilDeletion := instance.Status.PreviousCredentialKeyDeletion.Sub(now)
+		if requeueAfter == 0 || untilDeletion < requeueAfter {
+			requeueAfter = untilDeletion
+		}
+	}
+	if requeueAfter != 0 && requeueAfter < time.Second {
+		requeueAfter = time.Second
+	}
+	return requeueAfter, "", nil
+}
+
+// checkKeyQuota fails if the namespace has no room for the given number of keys of the service account
+func (r *GcpServiceAccountReconciler) checkKeyQuota(instance *gcpv1beta1.GcpServiceAccount, keys int32) error {
+	if r.DisableRestrictions {
+		return nil
+	}
+	others, err := r.namespaceUsage(instance)
+	if err != nil {
+		return err
+	}
+	return r.checkQuota(instance, gcpv1beta1.QuotaUsage{Keys: others.Keys + keys})
+}
+
+// checkQuota fails if the usage exceeds the quota of the namespace
+func (r *GcpServiceAccountReconciler) checkQuota(instance *gcpv1beta1.GcpServiceAccount, usage gcpv1beta1.QuotaUsage) error {
+	violations, err := r.RestrictionService.CheckQuota(instance.Namespace, usage)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		restrictionDenials.WithLabelValues(instance.Namespace).Inc()
+		return &QuotaExceededError{Namespace: instance.Namespace, Violations: violations}
+	}
+	return nil
+}
+
+// namespaceUsage returns the quota usage of the other GcpServiceAccounts of the namespace
+func (r *GcpServiceAccountReconciler) namespaceUsage(instance *gcpv1beta1.GcpServiceAccount) (gcpv1beta1.QuotaUsage, error) {
+	list := &gcpv1beta1.GcpServiceAccountList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(instance.Namespace)); err != nil {
+		return gcpv1beta1.QuotaUsage{}, err
+	}
+	var others []gcpv1beta1.GcpServiceAccount
+	for _, account := range list.Items {
+		if account.Name != instance.Name {
+			others = append(others, account)
 		}
+	}
+	return quotaUsage(others), nil
+}
+
+// resolveProject returns the project the service account was created in, the project of the spec or the
+// default project of the namespace. An empty project selects the project of the controller credentials.
+func (r *GcpServiceAccountReconciler) resolveProject(instance *gcpv1beta1.GcpServiceAccount) (string, error) {
+	if instance.Status.Project != "" {
+		return instance.Status.Project, nil
+	}
+	if instance.Spec.Project != "" {
+		return instance.Spec.Project, nil
+	}
+	return r.RestrictionService.DefaultProject(instance.Namespace)
+}
+
+// issueKey records the key as current credential key and writes it to the secret
+func (r *GcpServiceAccountReconciler) issueKey(instance *gcpv1beta1.GcpServiceAccount, key *iam.ServiceAccountKey, now time.Time) error {
+	created := metav1.NewTime(now)
+	instance.Status.CredentialKey = key.Name
+	instance.Status.CredentialKeyCreationTime = &created
+	err := r.updateStatus(instance)
+	if err != nil {
+		return err
+	}
+	r.Log.Info(fmt.Sprintf("modify secret %s with gcp key %s", instance.Spec.SecretName, key.Name))
+
+	deploy := &corev1.Secret{}
+	deploy.Name = instance.Spec.SecretName
+	deploy.Namespace = instance.Namespace
+	deploy.Annotations = map[string]string{credentialKeyAnnotation: key.Name}
+	deploy.Data = map[string][]byte{}
+	bytes, err := base64.StdEncoding.DecodeString(key.PrivateKeyData)
+	if err != nil {
+		return err
+	}
+	deploy.Data[secretKeyOf(instance)] = bytes
 
+	if err := controllerutil.SetControllerReference(instance, deploy, r.Scheme); err != nil {
+		return err
+	}
+
+	found := &corev1.Secret{}
+	err = r.Get(context.TODO(), types.NamespacedName{Name: deploy.Name, Namespace: deploy.Namespace}, found)
+	//new secret
+	if err != nil && errors.IsNotFound(err) {
+		r.Log.Info("Creating Secret", "secretName", instance.Spec.SecretName, "namespace", instance.Namespace)
+		err = r.Create(context.TODO(), deploy)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !reflect.DeepEqual(deploy.Data, found.Data) || found.Annotations[credentialKeyAnnotation] != key.Name {
 		// Update the found object and write the result back if there are any changes
-		if !reflect.DeepEqual(deploy.Data, found.Data) {
-			found.Data = deploy.Data
-			r.log.Info("Updating Deployment", "namespace", deploy.Namespace, "name", deploy.Name)
-			err = r.Update(context.TODO(), found)
-			if err != nil {
-				return reconcile.Result{}, err
-			}
+		found.Data = deploy.Data
+		if found.Annotations == nil {
+			found.Annotations = map[string]string{}
+		}
+		found.Annotations[credentialKeyAnnotation] = key.Name
+		r.Log.Info("Updating Deployment", "namespace", deploy.Namespace, "name", deploy.Name)
+		err = r.Update(context.TODO(), found)
+		if err != nil {
+			return err
+		}
+		r.Recorder.Eventf(found, corev1.EventTypeNormal, eventReasonSecretUpdated, "secret rewritten with key %s of gcp service account %s", key.Name, instance.Name)
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonKeyIssued, "issued key %s into secret %s", key.Name, instance.Spec.SecretName)
+	return nil
+}
+
+// restoreSecret reverts edits of a secret which still holds the data of the current key: entries besides the key,
+// the key annotation and the controller reference are restored without issuing a new key. A secret controlled by
+// someone else is left to its controller.
+func (r *GcpServiceAccountReconciler) restoreSecret(instance *gcpv1beta1.GcpServiceAccount, secret *corev1.Secret, keyName string) error {
+	if controller := metav1.GetControllerOf(secret); controller != nil && controller.UID != instance.UID {
+		return nil
+	}
+	var repairs []string
+	update := false
+	if len(secret.Data) != 1 {
+		secret.Data = map[string][]byte{secretKeyOf(instance): secret.Data[secretKeyOf(instance)]}
+		repairs = append(repairs, "removed other entries")
+	}
+	if annotation := secret.Annotations[credentialKeyAnnotation]; annotation != keyName {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[credentialKeyAnnotation] = keyName
+		// secrets written before the key was annotated get the annotation without a warning
+		if annotation == "" {
+			update = true
+		} else {
+			repairs = append(repairs, "restored the key annotation")
+		}
+	}
+	if metav1.GetControllerOf(secret) == nil {
+		if err := controllerutil.SetControllerReference(instance, secret, r.Scheme); err != nil {
+			return err
+		}
+		repairs = append(repairs, "restored the owner reference")
+	}
+	if len(repairs) == 0 && !update {
+		return nil
+	}
+	r.Log.Info("Restoring Secret", "namespace", secret.Namespace, "name", secret.Name, "repairs", repairs)
+	if err := r.Update(context.TODO(), secret); err != nil {
+		return err
+	}
+	if len(repairs) > 0 {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonSecretRestored, "restored edited secret %s with the existing key %s: %s", secret.Name, keyName, strings.Join(repairs, ", "))
+	}
+	return nil
+}
+
+// secretHoldsKey returns whether the data is the credentials file of the key
+func secretHoldsKey(data []byte, keyName string) bool {
+	credentials := struct {
+		PrivateKeyID string `json:"private_key_id"`
+	}{}
+	if len(data) == 0 || json.Unmarshal(data, &credentials) != nil || credentials.PrivateKeyID == "" {
+		return false
+	}
+	return strings.HasSuffix(keyName, "/keys/"+credentials.PrivateKeyID)
+}
+
+// nextKeyRotation returns when a new key has to be issued so the previous key can be deleted
+// at its max age, nil if the key is not rotated. The rotation waits for the deletion of a pending
+// previous key, which happens if the overlap is longer than half of the max age.
+func nextKeyRotation(instance *gcpv1beta1.GcpServiceAccount) *metav1.Time {
+	rotation := instance.Spec.KeyRotation
+	if rotation == nil || rotation.MaxAge.Duration <= 0 || instance.Status.CredentialKeyCreationTime == nil {
+		return nil
+	}
+	next := metav1.NewTime(instance.Status.CredentialKeyCreationTime.Add(rotation.MaxAge.Duration - keyRotationOverlap(rotation)))
+	if deletion := instance.Status.PreviousCredentialKeyDeletion; instance.Status.PreviousCredentialKey != "" && deletion != nil && deletion.After(next.Time) {
+		next = *deletion
+	}
+	return &next
+}
+
+// nextBindingExpiry returns the earliest expiry of a role binding after now, nil if no binding expires
+func nextBindingExpiry(instance *gcpv1beta1.GcpServiceAccount, now time.Time) *time.Time {
+	var next *time.Time
+	for _, binding := range instance.Spec.GcpRoleBindings {
+		if binding.ExpiresAt == nil || !now.Before(binding.ExpiresAt.Time) {
+			continue
+		}
+		if next == nil || binding.ExpiresAt.Time.Before(*next) {
+			expiry := binding.ExpiresAt.Time
+			next = &expiry
 		}
 	}
+	return next
+}
+
+// keyRotationOverlap returns the overlap window, an overlap which is not shorter than the max age is ignored
+func keyRotationOverlap(rotation *gcpv1beta1.GcpKeyRotation) time.Duration {
+	if rotation == nil || rotation.Overlap.Duration < 0 || rotation.Overlap.Duration >= rotation.MaxAge.Duration {
+		return 0
+	}
+	return rotation.Overlap.Duration
+}
 
-	err = r.Update(context.TODO(), instance)
+// keyCreationTime returns the time the key got valid or the fallback if it is unknown
+func keyCreationTime(key *iam.ServiceAccountKey, fallback time.Time) metav1.Time {
+	created, err := time.Parse(time.RFC3339, key.ValidAfterTime)
 	if err != nil {
+		return metav1.NewTime(fallback)
+	}
+	return metav1.NewTime(created)
+}
+
+// setCondition sets a condition for the current generation of the instance
+func (r *GcpServiceAccountReconciler) setCondition(instance *gcpv1beta1.GcpServiceAccount, conditionType string, status corev1.ConditionStatus, reason string, message string) {
+	gcpv1beta1.SetCondition(&instance.Status.Conditions, gcpv1beta1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: instance.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// recordDrift adds the repaired findings to the status and reports them as warning event
+func (r *GcpServiceAccountReconciler) recordDrift(instance *gcpv1beta1.GcpServiceAccount, findings []gcpv1beta1.DriftFinding) {
+	if len(findings) == 0 {
+		return
+	}
+	now := metav1.Now()
+	var descriptions []string
+	for _, finding := range findings {
+		finding.DetectionTime = now
+		instance.Status.DriftFindings = append(instance.Status.DriftFindings, finding)
+		driftFindings.WithLabelValues(string(finding.Type)).Inc()
+		switch finding.Type {
+		case gcpv1beta1.DriftMissingBinding:
+			descriptions = append(descriptions, fmt.Sprintf("restored missing role %s on %s", finding.Role, finding.Resource))
+		case gcpv1beta1.DriftUnexpectedBinding:
+			descriptions = append(descriptions, fmt.Sprintf("revoked unexpected role %s on %s", finding.Role, finding.Resource))
+		case gcpv1beta1.DriftMissingKey:
+			descriptions = append(descriptions, fmt.Sprintf("reissued deleted key %s", finding.Resource))
+		}
+	}
+	if excess := len(instance.Status.DriftFindings) - maxDriftFindings; excess > 0 {
+		instance.Status.DriftFindings = instance.Status.DriftFindings[excess:]
+	}
+	r.Log.Info("repaired drift", "resourceName", instance.Name, "findings", descriptions)
+	r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonDriftDetected, "repaired drift: %s", strings.Join(descriptions, "; "))
+}
+
+// failed marks the given condition and Ready as false, records a warning event, persists the status
+// and returns the cause so the request is retried
+func (r *GcpServiceAccountReconciler) failed(instance *gcpv1beta1.GcpServiceAccount, conditionType string, reason string, cause error) (ctrl.Result, error) {
+	r.Recorder.Event(instance, corev1.EventTypeWarning, reason, cause.Error())
+	if conditionType != gcpv1beta1.ConditionReady {
+		r.setCondition(instance, conditionType, corev1.ConditionFalse, reason, cause.Error())
+	}
+	r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionFalse, reason, cause.Error())
+	if err := r.updateStatus(instance); err != nil {
+		r.Log.Error(err, "unable to update status", "resourceName", instance.Name)
+	}
+	return reconcile.Result{}, cause
+}
+
+// quotaExceeded marks the given condition and Ready as false and persists the status. Like a denial the request is
+// not retried, a change of the GcpServiceAccount or of a restriction of the namespace triggers the next reconcile.
+func (r *GcpServiceAccountReconciler) quotaExceeded(instance *gcpv1beta1.GcpServiceAccount, conditionType string, cause error) (ctrl.Result, error) {
+	r.Recorder.Event(instance, corev1.EventTypeWarning, eventReasonQuotaExceeded, cause.Error())
+	r.setCondition(instance, conditionType, corev1.ConditionFalse, "QuotaExceeded", cause.Error())
+	r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionFalse, "QuotaExceeded", cause.Error())
+	if err := r.updateStatus(instance); err != nil {
 		return reconcile.Result{}, err
 	}
+	return reconcile.Result{}, nil
+}
 
+// denied revokes the applied bindings the restrictions no longer allow if the namespace enforces them, marks the
+// restriction condition and Ready as false and persists the status. The request is not retried, a change of the
+// GcpServiceAccount or of a restriction of the namespace triggers the next reconcile. Without any restriction
+// the bindings are kept.
+func (r *GcpServiceAccountReconciler) denied(instance *gcpv1beta1.GcpServiceAccount, cause error) (ctrl.Result, error) {
+	action, err := r.RestrictionService.EnforcementAction(instance.Namespace, r.DefaultEnforcementAction)
+	if IsRestrictionNotFound(err) {
+		action = gcpv1beta1.EnforcementReportOnly
+	} else if err != nil {
+		return r.failed(instance, gcpv1beta1.ConditionRestrictionSatisfied, "RestrictionCheckFailed", err)
+	}
+	if action == gcpv1beta1.EnforcementRevoke && len(instance.Status.AppliedGcpRoleBindings) > 0 {
+		if err := r.revokeDeniedBindings(instance); err != nil {
+			return r.failed(instance, gcpv1beta1.ConditionBindingsApplied, "RevocationFailed", err)
+		}
+	}
+	r.Recorder.Event(instance, corev1.EventTypeWarning, eventReasonDenied, cause.Error())
+	r.setCondition(instance, gcpv1beta1.ConditionRestrictionSatisfied, corev1.ConditionFalse, "RestrictionDenied", cause.Error())
+	r.setCondition(instance, gcpv1beta1.ConditionReady, corev1.ConditionFalse, "Denied", cause.Error())
+	if err := r.updateStatus(instance); err != nil {
+		return reconcile.Result{}, err
+	}
 	return reconcile.Result{}, nil
 }
 
-func (r *GcpServiceAccountReconciler) deleteExternalDependency(instance *gcpv1beta1.GcpServiceAccount) error {
-	r.log.Info("deleting the external dependencies")
-	return r.GcpService.DeleteServiceAccount(instance)
+// revokeDeniedBindings removes the roles of the applied bindings which the restrictions of the namespace no longer allow
+func (r *GcpServiceAccountReconciler) revokeDeniedBindings(instance *gcpv1beta1.GcpServiceAccount) error {
+	decisions, err := r.RestrictionService.Evaluate(instance.Namespace, instance.Status.AppliedGcpRoleBindings)
+	if err != nil {
+		return err
+	}
+	allowed := allowedBindings(instance.Status.AppliedGcpRoleBindings, decisions)
+	revoked := countRoleBindings(instance.Status.AppliedGcpRoleBindings) - countRoleBindings(allowed)
+	if revoked == 0 {
+		return nil
+	}
+	findings, err := r.applyRoleBindings(instance, allowed, false)
+	if err != nil {
+		return err
+	}
+	instance.Status.AppliedGcpRoleBindings = canonicalBindings(allowed)
+	r.recordDrift(instance, findings)
+	r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonRevoked, "revoked %d role bindings which are no longer allowed", revoked)
+	r.setCondition(instance, gcpv1beta1.ConditionBindingsApplied, corev1.ConditionFalse, "Revoked",
+		fmt.Sprintf("revoked %d role bindings which are no longer allowed", revoked))
+	return nil
+}
+
+// allowedBindings returns the bindings with the roles the decisions allow, the decisions have to be in the
+// order RestrictionService.Evaluate returns them for the bindings
+func allowedBindings(bindings []gcpv1beta1.GcpRoleBindings, decisions []gcpv1beta1.RestrictionDecision) []gcpv1beta1.GcpRoleBindings {
+	var allowed []gcpv1beta1.GcpRoleBindings
+	i := 0
+	for _, binding := range bindings {
+		if binding.Resource == "" {
+			i++
+			continue
+		}
+		var roles []string
+		for _, role := range binding.Roles {
+			if i < len(decisions) && decisions[i].Allowed {
+				roles = append(roles, role)
+			}
+			i++
+		}
+		if len(roles) > 0 {
+			binding.Roles = roles
+			allowed = append(allowed, binding)
+		}
+	}
+	return allowed
+}
+
+func (r *GcpServiceAccountReconciler) updateStatus(instance *gcpv1beta1.GcpServiceAccount) error {
+	instance.Status.ObservedGeneration = instance.Generation
+	return r.Status().Update(context.TODO(), instance)
+}
+
+// deleteExternalDependency cleans up gcp according to the deletion policy
+func (r *GcpServiceAccountReconciler) deleteExternalDependency(instance *gcpv1beta1.GcpServiceAccount, policy gcpv1beta1.DeletionPolicy) error {
+	r.Log.Info("deleting the external dependencies", "deletionPolicy", policy)
+	if policy == gcpv1beta1.DeletionPolicyAbandon {
+		return nil
+	}
+	if err := r.cleanupWorkloadIdentity(instance); err != nil {
+		return err
+	}
+	if policy == gcpv1beta1.DeletionPolicyRetain || instance.Status.Adopted {
+		return r.releaseServiceAccount(instance)
+	}
+	return r.deleteServiceAccount(instance)
+}
+
+// deletionPolicyOf returns the deletion policy of the spec or the default of the controller
+func (r *GcpServiceAccountReconciler) deletionPolicyOf(instance *gcpv1beta1.GcpServiceAccount) gcpv1beta1.DeletionPolicy {
+	if instance.Spec.DeletionPolicy != "" {
+		return instance.Spec.DeletionPolicy
+	}
+	if r.DefaultDeletionPolicy != "" {
+		return r.DefaultDeletionPolicy
+	}
+	return gcpv1beta1.DeletionPolicyDelete
+}
+
+// restrictionRequests returns the GcpServiceAccounts of the namespaces the restriction applies or applied to,
+// so a changed restriction is enforced
+func (r *GcpServiceAccountReconciler) restrictionRequests(object handler.MapObject) []reconcile.Request {
+	restriction, ok := object.Object.(*gcpv1beta1.GcpNamespaceRestriction)
+	if !ok {
+		return nil
+	}
+	var affected []string
+	for _, restricted := range restriction.Status.Namespaces {
+		affected = append(affected, restricted.Namespace)
+	}
+	namespaces := &corev1.NamespaceList{}
+	if err := r.List(context.TODO(), namespaces); err != nil {
+		r.Log.Error(err, "unable to list namespaces")
+		return nil
+	}
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		if appliesToNamespace(restriction, namespace) && !containsString(affected, namespace.Name) {
+			affected = append(affected, namespace.Name)
+		}
+	}
+	var requests []reconcile.Request
+	for _, namespace := range affected {
+		list := &gcpv1beta1.GcpServiceAccountList{}
+		if err := r.List(context.TODO(), list, client.InNamespace(namespace)); err != nil {
+			r.Log.Error(err, "unable to list gcp service accounts", "namespace", namespace)
+			continue
+		}
+		for _, account := range list.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: account.Namespace, Name: account.Name}})
+		}
+	}
+	return requests
+}
+
+// customRoleRequests returns the GcpServiceAccounts which reference the custom role, so they are reconciled
+// once the role is created
+// namespaceRequests returns the GcpServiceAccounts of the namespace, its labels select the restrictions which apply
+func (r *GcpServiceAccountReconciler) namespaceRequests(object handler.MapObject) []reconcile.Request {
+	list := &gcpv1beta1.GcpServiceAccountList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(object.Meta.GetName())); err != nil {
+		r.Log.Error(err, "unable to list gcp service accounts", "namespace", object.Meta.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, account := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: account.Namespace, Name: account.Name}})
+	}
+	return requests
+}
+
+// namespaceLabelsChanged passes updates of namespaces which change the labels
+var namespaceLabelsChanged = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+	DeleteFunc: func(event.DeleteEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return !reflect.DeepEqual(e.MetaOld.GetLabels(), e.MetaNew.GetLabels())
+	},
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+func (r *GcpServiceAccountReconciler) customRoleRequests(object handler.MapObject) []reconcile.Request {
+	list := &gcpv1beta1.GcpServiceAccountList{}
+	if err := r.List(context.TODO(), list, client.InNamespace(object.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list gcp service accounts", "namespace", object.Meta.GetNamespace())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, account := range list.Items {
+		if containsString(referencedCustomRoles(account.Spec.GcpRoleBindings), object.Meta.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: account.Namespace, Name: account.Name}})
+		}
+	}
+	return requests
 }
 
 func (r *GcpServiceAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&gcpv1beta1.GcpServiceAccount{}).
-		Complete(r)
+		Owns(&corev1.Secret{}).
+		Watches(&source.Kind{Type: &gcpv1beta1.GcpCustomRole{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.customRoleRequests)}).
+		Build(r)
+	if err != nil {
+		return err
+	}
+	// the status of a restriction changes with every evaluation, only changes of the spec are enforced
+	if err := c.Watch(&source.Kind{Type: &gcpv1beta1.GcpNamespaceRestriction{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.restrictionRequests)},
+		predicate.GenerationChangedPredicate{}); err != nil {
+		return err
+	}
+	// a relabeled namespace can be selected by other restrictions
+	return c.Watch(&source.Kind{Type: &corev1.Namespace{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.namespaceRequests)},
+		namespaceLabelsChanged)
 }
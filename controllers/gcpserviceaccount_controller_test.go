@@ -0,0 +1,590 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/api/googleapi"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpfake"
+)
+
+var _ GcpService = &gcpfake.GcpService{}
+
+var _ = Describe("GcpServiceAccount controller", func() {
+	const (
+		timeout  = time.Second * 30
+		interval = time.Millisecond * 250
+		resource = "projects/" + testProject
+	)
+
+	newGcpServiceAccount := func(name string, roles ...string) *gcpv1beta1.GcpServiceAccount {
+		return &gcpv1beta1.GcpServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: gcpv1beta1.GcpServiceAccountSpec{
+				ServiceAccountIdentifier: name,
+				Mode:                     gcpv1beta1.ModeKey,
+				SecretName:               name + "-credentials",
+				SecretKey:                defaultSecretKey,
+				GcpRoleBindings:          []gcpv1beta1.GcpRoleBindings{{Resource: resource, Roles: roles}},
+			},
+		}
+	}
+
+	fetch := func(name string) *gcpv1beta1.GcpServiceAccount {
+		instance := &gcpv1beta1.GcpServiceAccount{}
+		Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "default"}, instance)).To(Succeed())
+		return instance
+	}
+
+	// createReady creates the gcp service account and waits until it is reconciled
+	createReady := func(instance *gcpv1beta1.GcpServiceAccount) *gcpv1beta1.GcpServiceAccount {
+		Expect(k8sClient.Create(context.TODO(), instance)).To(Succeed())
+		Eventually(func() bool {
+			current := fetch(instance.Name)
+			return current.Status.ObservedGeneration == current.Generation &&
+				gcpv1beta1.IsConditionTrue(current.Status.Conditions, gcpv1beta1.ConditionReady)
+		}, timeout, interval).Should(BeTrue())
+		return fetch(instance.Name)
+	}
+
+	secretKeyAnnotation := func(instance *gcpv1beta1.GcpServiceAccount) func() string {
+		return func() string {
+			secret := &corev1.Secret{}
+			err := k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret)
+			if err != nil {
+				return ""
+			}
+			return secret.Annotations[credentialKeyAnnotation]
+		}
+	}
+
+	member := func(instance *gcpv1beta1.GcpServiceAccount) string {
+		return fmt.Sprintf("serviceAccount:%s", instance.Status.ServiceAccountMail)
+	}
+
+	It("creates the service account, applies the bindings and writes the key", func() {
+		instance := createReady(newGcpServiceAccount("create", "roles/viewer"))
+
+		Expect(gcpService.HasServiceAccount(instance.Status.ServiceAccountPath)).To(BeTrue())
+		Expect(instance.Status.Project).To(Equal(testProject))
+		Expect(instance.Status.AppliedGcpRoleBindings).To(Equal(instance.Spec.GcpRoleBindings))
+		Expect(gcpService.Members(resource, "roles/viewer")).To(ContainElement(member(instance)))
+		Expect(gcpService.KeyNames(instance.Status.ServiceAccountPath)).To(ConsistOf(instance.Status.CredentialKey))
+
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret)).To(Succeed())
+		Expect(secret.Annotations[credentialKeyAnnotation]).To(Equal(instance.Status.CredentialKey))
+		Expect(secret.Data[defaultSecretKey]).To(ContainSubstring(instance.Status.ServiceAccountMail))
+		Expect(metav1.IsControlledBy(secret, instance)).To(BeTrue())
+	})
+
+	It("retries a failed creation of the service account", func() {
+		gcpService.InjectErrorTimes(gcpfake.MethodCreateServiceAccount, &googleapi.Error{Code: 503, Message: "unavailable"}, 1)
+
+		instance := createReady(newGcpServiceAccount("retry", "roles/viewer"))
+
+		Expect(gcpService.HasServiceAccount(instance.Status.ServiceAccountPath)).To(BeTrue())
+	})
+
+	It("recovers the service account if the status got lost", func() {
+		instance := createReady(newGcpServiceAccount("recover", "roles/viewer"))
+		path := instance.Status.ServiceAccountPath
+		created := gcpService.CallCount(gcpfake.MethodCreateServiceAccount)
+
+		instance.Status = gcpv1beta1.GcpServiceAccountStatus{}
+		Expect(k8sClient.Status().Update(context.TODO(), instance)).To(Succeed())
+
+		Eventually(func() string {
+			return fetch(instance.Name).Status.ServiceAccountPath
+		}, timeout, interval).Should(Equal(path))
+		Expect(gcpService.CallCount(gcpfake.MethodCreateServiceAccount)).To(Equal(created))
+		Expect(gcpv1beta1.FindCondition(fetch(instance.Name).Status.Conditions, gcpv1beta1.ConditionAccountCreated).Reason).To(Equal("Recovered"))
+	})
+
+	It("adopts an existing service account and releases it on deletion", func() {
+		existing, err := gcpService.CreateServiceAccount("", "adopted-by-hand", "adopted by hand", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		instance := newGcpServiceAccount("adopt", "roles/viewer")
+		instance.Spec.ExistingServiceAccountEmail = existing.Email
+		instance = createReady(instance)
+		Expect(instance.Status.Adopted).To(BeTrue())
+		Expect(instance.Status.ServiceAccountPath).To(Equal(existing.Name))
+		Expect(gcpService.Members(resource, "roles/viewer")).To(ContainElement(member(instance)))
+
+		Expect(k8sClient.Delete(context.TODO(), instance)).To(Succeed())
+		Eventually(func() []string {
+			return gcpService.Members(resource, "roles/viewer")
+		}, timeout, interval).ShouldNot(ContainElement(member(instance)))
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &gcpv1beta1.GcpServiceAccount{})
+			return errors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(gcpService.HasServiceAccount(existing.Name)).To(BeTrue())
+		Expect(gcpService.KeyNames(existing.Name)).To(BeEmpty())
+	})
+
+	It("reports a changed project instead of moving the service account", func() {
+		instance := createReady(newGcpServiceAccount("project-changed", "roles/viewer"))
+		path := instance.Status.ServiceAccountPath
+
+		instance.Spec.Project = "other-project"
+		Expect(k8sClient.Update(context.TODO(), instance)).To(Succeed())
+
+		Eventually(func() string {
+			condition := gcpv1beta1.FindCondition(fetch(instance.Name).Status.Conditions, gcpv1beta1.ConditionAccountCreated)
+			if condition == nil || condition.Status != corev1.ConditionFalse {
+				return ""
+			}
+			return condition.Reason
+		}, timeout, interval).Should(Equal("ProjectChanged"))
+		Expect(fetch(instance.Name).Status.ServiceAccountPath).To(Equal(path))
+		Expect(fetch(instance.Name).Status.Project).To(Equal(testProject))
+	})
+
+	It("reissues a key which was deleted outside of the controller", func() {
+		instance := createReady(newGcpServiceAccount("reissue", "roles/viewer"))
+		oldKey := instance.Status.CredentialKey
+
+		gcpService.RemoveKey(oldKey)
+		// touch the object to trigger a reconciliation
+		instance.Annotations = map[string]string{"test": "reissue"}
+		Expect(k8sClient.Update(context.TODO(), instance)).To(Succeed())
+
+		Eventually(func() string {
+			return fetch(instance.Name).Status.CredentialKey
+		}, timeout, interval).ShouldNot(Equal(oldKey))
+		newKey := fetch(instance.Name).Status.CredentialKey
+		Eventually(secretKeyAnnotation(instance), timeout, interval).Should(Equal(newKey))
+		Expect(gcpService.KeyNames(instance.Status.ServiceAccountPath)).To(ConsistOf(newKey))
+	})
+
+	It("restores a deleted secret with a new key", func() {
+		instance := createReady(newGcpServiceAccount("secret-deleted", "roles/viewer"))
+		oldKey := instance.Status.CredentialKey
+
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: instance.Spec.SecretName, Namespace: instance.Namespace}}
+		Expect(k8sClient.Delete(context.TODO(), secret)).To(Succeed())
+
+		Eventually(func() string {
+			return fetch(instance.Name).Status.CredentialKey
+		}, timeout, interval).ShouldNot(Equal(oldKey))
+		newKey := fetch(instance.Name).Status.CredentialKey
+		Eventually(secretKeyAnnotation(instance), timeout, interval).Should(Equal(newKey))
+		Expect(gcpService.KeyNames(instance.Status.ServiceAccountPath)).To(ConsistOf(newKey))
+	})
+
+	It("restores an edited secret with the existing key", func() {
+		instance := createReady(newGcpServiceAccount("secret-edited", "roles/viewer"))
+
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret)).To(Succeed())
+		data := secret.Data[defaultSecretKey]
+		secret.Annotations = nil
+		secret.Data["extra"] = []byte("edited")
+		Expect(k8sClient.Update(context.TODO(), secret)).To(Succeed())
+
+		Eventually(secretKeyAnnotation(instance), timeout, interval).Should(Equal(instance.Status.CredentialKey))
+		Expect(k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret)).To(Succeed())
+		Expect(secret.Data).To(Equal(map[string][]byte{defaultSecretKey: data}))
+		Expect(fetch(instance.Name).Status.CredentialKey).To(Equal(instance.Status.CredentialKey))
+	})
+
+	It("repairs bindings changed outside of the controller on resync", func() {
+		instance := createReady(newGcpServiceAccount("drift", "roles/viewer"))
+		delta := &iamutil.PolicyDelta{Roles: util.ToSet([]string{"roles/viewer"}), Email: instance.Status.ServiceAccountMail}
+		policy, err := gcpService.GetIamPolicy(resource)
+		Expect(err).NotTo(HaveOccurred())
+		_, changed := policy.ChangedBindings(nil, delta)
+		_, err = gcpService.SetIamPolicy(resource, changed)
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() []string {
+			return gcpService.Members(resource, "roles/viewer")
+		}, timeout, interval).Should(ContainElement(member(instance)))
+		Eventually(func() []string {
+			var findings []string
+			for _, finding := range fetch(instance.Name).Status.DriftFindings {
+				findings = append(findings, fmt.Sprintf("%s %s", finding.Type, finding.Role))
+			}
+			return findings
+		}, timeout, interval).Should(ContainElement("MissingBinding roles/viewer"))
+	})
+
+	It("moves the bindings when the roles change", func() {
+		instance := createReady(newGcpServiceAccount("bindings", "roles/viewer"))
+		Expect(gcpService.Members(resource, "roles/viewer")).To(ContainElement(member(instance)))
+
+		instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: resource, Roles: []string{"roles/editor"}}}
+		Expect(k8sClient.Update(context.TODO(), instance)).To(Succeed())
+
+		Eventually(func() []string {
+			return gcpService.Members(resource, "roles/editor")
+		}, timeout, interval).Should(ContainElement(member(instance)))
+		Eventually(func() []string {
+			return gcpService.Members(resource, "roles/viewer")
+		}, timeout, interval).ShouldNot(ContainElement(member(instance)))
+	})
+
+	It("keeps the service account as the deletion policy says", func() {
+		for policy, keysLeft := range map[gcpv1beta1.DeletionPolicy]int{gcpv1beta1.DeletionPolicyRetain: 0, gcpv1beta1.DeletionPolicyAbandon: 1} {
+			instance := newGcpServiceAccount("policy-"+strings.ToLower(string(policy)), "roles/viewer")
+			instance.Spec.DeletionPolicy = policy
+			instance = createReady(instance)
+
+			Expect(k8sClient.Delete(context.TODO(), instance)).To(Succeed())
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &gcpv1beta1.GcpServiceAccount{})
+				return errors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+			Expect(gcpService.HasServiceAccount(instance.Status.ServiceAccountPath)).To(BeTrue())
+			Expect(gcpService.KeyNames(instance.Status.ServiceAccountPath)).To(HaveLen(keysLeft))
+			Expect(containsString(gcpService.Members(resource, "roles/viewer"), member(instance))).To(Equal(policy == gcpv1beta1.DeletionPolicyAbandon))
+		}
+	})
+
+	It("deletes the service account and its bindings before the finalizer is removed", func() {
+		instance := createReady(newGcpServiceAccount("delete", "roles/viewer"))
+		Expect(instance.Finalizers).To(ContainElement(iamKiwigridFinalizerName))
+
+		Expect(k8sClient.Delete(context.TODO(), instance)).To(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &gcpv1beta1.GcpServiceAccount{})
+			return errors.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(gcpService.HasServiceAccount(instance.Status.ServiceAccountPath)).To(BeFalse())
+		Expect(gcpService.Members(resource, "roles/viewer")).NotTo(ContainElement(member(instance)))
+	})
+})
+
+func TestSecretHoldsKey(t *testing.T) {
+	keyName := "projects/test-project/serviceAccounts/test@test-project.iam.gserviceaccount.com/keys/0123abcd"
+	tests := []struct {
+		data     string
+		expected bool
+	}{
+		{`{"type":"service_account","private_key_id":"0123abcd"}`, true},
+		{`{"type":"service_account","private_key_id":"4567ef01"}`, false},
+		{`{"type":"service_account"}`, false},
+		{`edited`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		if holds := secretHoldsKey([]byte(test.data), keyName); holds != test.expected {
+			t.Errorf("expected %v for secret data %q, got %v", test.expected, test.data, holds)
+		}
+	}
+}
+
+// newTestKeyReconciler returns a reconciler of the instance with the objects in a fake api server, the
+// instance has a service account with a key
+func newTestKeyReconciler(t *testing.T, instance *gcpv1beta1.GcpServiceAccount, objects ...runtime.Object) (*GcpServiceAccountReconciler, *gcpfake.GcpService) {
+	gcpService := gcpfake.NewGcpService(testProject)
+	r := newTestReconciler(gcpService)
+	r.DisableRestrictions = true
+	r.Scheme = runtime.NewScheme()
+	if err := scheme.AddToScheme(r.Scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := gcpv1beta1.AddToScheme(r.Scheme); err != nil {
+		t.Fatal(err)
+	}
+	instance.Spec.SecretName = "app-credentials"
+	createTestServiceAccount(t, r, instance)
+	key, err := r.issueServiceAccountKey(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.CredentialKey = key.Name
+	r.Client = fake.NewFakeClientWithScheme(r.Scheme, append(objects, instance)...)
+	return r, gcpService
+}
+
+func TestReconcileLostKey(t *testing.T) {
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	r, gcpService := newTestKeyReconciler(t, instance)
+	lostKey := instance.Status.CredentialKey
+	previousKey, err := r.issueServiceAccountKey(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletion := metav1.NewTime(time.Now().Add(time.Hour))
+	instance.Status.PreviousCredentialKey = previousKey.Name
+	instance.Status.PreviousCredentialKeyDeletion = &deletion
+
+	// the secret of the current key was deleted during the overlap window of the previous key
+	if _, reason, err := r.reconcileKey(instance); err != nil {
+		t.Fatalf("%s: %v", reason, err)
+	}
+	if instance.Status.CredentialKey == lostKey {
+		t.Errorf("expected a new key instead of the lost key %s", lostKey)
+	}
+	if instance.Status.PreviousCredentialKey != previousKey.Name || !instance.Status.PreviousCredentialKeyDeletion.Equal(&deletion) {
+		t.Errorf("expected the previous key %s to be deleted at %s, got %s at %v", previousKey.Name, deletion,
+			instance.Status.PreviousCredentialKey, instance.Status.PreviousCredentialKeyDeletion)
+	}
+	if keys := gcpService.KeyNames(instance.Status.ServiceAccountPath); len(keys) != 2 {
+		t.Errorf("expected the previous and the new key, got %v", keys)
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if !secretHoldsKey(secret.Data[secretKeyOf(instance)], instance.Status.CredentialKey) {
+		t.Errorf("expected the secret to hold the new key %s", instance.Status.CredentialKey)
+	}
+}
+
+func TestRestoreSecret(t *testing.T) {
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	controller := true
+	tests := []struct {
+		name    string
+		edit    func(secret *corev1.Secret)
+		updated bool
+		warning bool
+	}{
+		{"unchanged", func(secret *corev1.Secret) {}, false, false},
+		// secrets written before the key was annotated
+		{"missing annotation", func(secret *corev1.Secret) { secret.Annotations = nil }, true, false},
+		{"other annotation", func(secret *corev1.Secret) { secret.Annotations[credentialKeyAnnotation] = "edited" }, true, true},
+		{"other entries", func(secret *corev1.Secret) { secret.Data["extra"] = []byte("edited") }, true, true},
+		{"missing owner", func(secret *corev1.Secret) { secret.OwnerReferences = nil }, true, true},
+		{"other controller", func(secret *corev1.Secret) {
+			secret.Data["extra"] = []byte("edited")
+			secret.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "other", UID: "other", Controller: &controller}}
+		}, false, false},
+	}
+	for _, test := range tests {
+		r, _ := newTestKeyReconciler(t, instance.DeepCopy())
+		keyName := "projects/" + testProject + "/serviceAccounts/app/keys/0123abcd"
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "app-credentials", Namespace: instance.Namespace,
+			Annotations: map[string]string{credentialKeyAnnotation: keyName}}}
+		secret.Data = map[string][]byte{secretKeyOf(instance): []byte(`{"private_key_id":"0123abcd"}`)}
+		if err := controllerutil.SetControllerReference(instance, secret, r.Scheme); err != nil {
+			t.Fatal(err)
+		}
+		test.edit(secret)
+		if err := r.Create(context.TODO(), secret); err != nil {
+			t.Fatal(err)
+		}
+		resourceVersion := secret.ResourceVersion
+		events := r.Recorder.(*record.FakeRecorder).Events
+		for len(events) > 0 {
+			<-events
+		}
+
+		if err := r.restoreSecret(instance, secret, keyName); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		restored := &corev1.Secret{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: secret.Name, Namespace: secret.Namespace}, restored); err != nil {
+			t.Fatal(err)
+		}
+		if updated := restored.ResourceVersion != resourceVersion; updated != test.updated {
+			t.Errorf("%s: expected updated %v, got %v", test.name, test.updated, updated)
+		}
+		if test.updated && (len(restored.Data) != 1 || restored.Annotations[credentialKeyAnnotation] != keyName || !metav1.IsControlledBy(restored, instance)) {
+			t.Errorf("%s: expected the secret to be restored, got %+v", test.name, restored)
+		}
+		if warning := len(events) > 0; warning != test.warning {
+			t.Errorf("%s: expected warning %v, got %v", test.name, test.warning, warning)
+		}
+	}
+}
+
+func TestKeyRotationOverlap(t *testing.T) {
+	tests := []struct {
+		rotation *gcpv1beta1.GcpKeyRotation
+		expected time.Duration
+	}{
+		{nil, 0},
+		{&gcpv1beta1.GcpKeyRotation{MaxAge: metav1.Duration{Duration: 10 * time.Hour}}, 0},
+		{&gcpv1beta1.GcpKeyRotation{MaxAge: metav1.Duration{Duration: 10 * time.Hour}, Overlap: metav1.Duration{Duration: 2 * time.Hour}}, 2 * time.Hour},
+		{&gcpv1beta1.GcpKeyRotation{MaxAge: metav1.Duration{Duration: 10 * time.Hour}, Overlap: metav1.Duration{Duration: -time.Hour}}, 0},
+		{&gcpv1beta1.GcpKeyRotation{MaxAge: metav1.Duration{Duration: 10 * time.Hour}, Overlap: metav1.Duration{Duration: 10 * time.Hour}}, 0},
+	}
+	for _, test := range tests {
+		if overlap := keyRotationOverlap(test.rotation); overlap != test.expected {
+			t.Errorf("expected overlap %s for %+v, got %s", test.expected, test.rotation, overlap)
+		}
+	}
+}
+
+func TestNextKeyRotation(t *testing.T) {
+	created := metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rotation := &gcpv1beta1.GcpKeyRotation{MaxAge: metav1.Duration{Duration: 10 * time.Hour}, Overlap: metav1.Duration{Duration: 2 * time.Hour}}
+	deletion := func(after time.Duration) *metav1.Time {
+		deletion := metav1.NewTime(created.Add(after))
+		return &deletion
+	}
+	tests := []struct {
+		name     string
+		rotation *gcpv1beta1.GcpKeyRotation
+		created  *metav1.Time
+		previous string
+		deletion *metav1.Time
+		expected *time.Time
+	}{
+		{"no rotation", nil, &created, "", nil, nil},
+		{"no key", rotation, nil, "", nil, nil},
+		{"overlap", rotation, &created, "", nil, &deletion(8 * time.Hour).Time},
+		{"previous deleted before", rotation, &created, "previous", deletion(2 * time.Hour), &deletion(8 * time.Hour).Time},
+		// a previous key which is still valid is never replaced
+		{"previous deleted after", rotation, &created, "previous", deletion(9 * time.Hour), &deletion(9 * time.Hour).Time},
+	}
+	for _, test := range tests {
+		instance := newTestGcpServiceAccount("app", "000000000001")
+		instance.Spec.KeyRotation = test.rotation
+		instance.Status.CredentialKeyCreationTime = test.created
+		instance.Status.PreviousCredentialKey = test.previous
+		instance.Status.PreviousCredentialKeyDeletion = test.deletion
+		next := nextKeyRotation(instance)
+		if (next == nil) != (test.expected == nil) || (next != nil && !next.Time.Equal(*test.expected)) {
+			t.Errorf("%s: expected the rotation at %v, got %v", test.name, test.expected, next)
+		}
+	}
+}
+
+func TestReconcileKeyRotation(t *testing.T) {
+	for _, overlap := range []time.Duration{2 * time.Hour, 7 * time.Hour} {
+		instance := newTestGcpServiceAccount("app", "000000000001")
+		instance.Spec.KeyRotation = &gcpv1beta1.GcpKeyRotation{MaxAge: metav1.Duration{Duration: 10 * time.Hour}, Overlap: metav1.Duration{Duration: overlap}}
+		r, gcpService := newTestKeyReconciler(t, instance)
+		// the key of the fixture has no secret yet
+		instance.Status.CredentialKey = ""
+		reconcileKey := func() {
+			if _, reason, err := r.reconcileKey(instance); err != nil {
+				t.Fatalf("%s: %v", reason, err)
+			}
+		}
+		ago := func(duration time.Duration) *metav1.Time {
+			ago := metav1.NewTime(time.Now().Add(-duration))
+			return &ago
+		}
+		reconcileKey()
+		firstKey := instance.Status.CredentialKey
+
+		// the rotation is due
+		instance.Status.CredentialKeyCreationTime = ago(10*time.Hour - overlap)
+		reconcileKey()
+		secondKey := instance.Status.CredentialKey
+		if secondKey == firstKey || instance.Status.PreviousCredentialKey != firstKey {
+			t.Fatalf("overlap %s: expected a rotation of %s, got %+v", overlap, firstKey, instance.Status)
+		}
+		if keys := gcpService.KeyNames(instance.Status.ServiceAccountPath); len(keys) != 2 {
+			t.Errorf("overlap %s: expected both keys during the overlap, got %v", overlap, keys)
+		}
+
+		// the next rotation of the new key is due while the previous key is still valid
+		deletion := *instance.Status.PreviousCredentialKeyDeletion
+		instance.Status.CredentialKeyCreationTime = ago(10*time.Hour - overlap)
+		if overlap*2 > 10*time.Hour {
+			reconcileKey()
+			if instance.Status.CredentialKey != secondKey || instance.Status.PreviousCredentialKey != firstKey {
+				t.Errorf("overlap %s: expected the rotation to wait for the deletion of %s, got %+v", overlap, firstKey, instance.Status)
+			}
+			if !instance.Status.NextKeyRotation.Equal(&deletion) {
+				t.Errorf("overlap %s: expected the rotation at %s, got %s", overlap, deletion, instance.Status.NextKeyRotation)
+			}
+		}
+
+		// the overlap is over
+		instance.Status.PreviousCredentialKeyDeletion = ago(time.Second)
+		reconcileKey()
+		keys := gcpService.KeyNames(instance.Status.ServiceAccountPath)
+		if instance.Status.PreviousCredentialKey != secondKey || len(keys) != 2 {
+			t.Errorf("overlap %s: expected %s to be rotated, got %+v", overlap, secondKey, instance.Status)
+		}
+		for _, key := range keys {
+			if key == firstKey {
+				t.Errorf("overlap %s: expected the previous key %s to be deleted", overlap, firstKey)
+			}
+		}
+	}
+}
+
+func TestReconcileQuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		quota     gcpv1beta1.GcpRestrictionQuota
+		condition string
+	}{
+		{"bindings", gcpv1beta1.GcpRestrictionQuota{MaxBindingsPerAccount: int32Ptr(0)}, gcpv1beta1.ConditionRestrictionSatisfied},
+		{"keys", gcpv1beta1.GcpRestrictionQuota{MaxKeys: int32Ptr(0)}, gcpv1beta1.ConditionKeyIssued},
+	}
+	for _, test := range tests {
+		instance := newTestGcpServiceAccount("app", "000000000001")
+		instance.Finalizers = []string{iamKiwigridFinalizerName}
+		instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: "projects/" + testProject, Roles: []string{"roles/viewer"}}}
+		r, _ := newTestKeyReconciler(t, instance)
+		restriction := newTestRestriction(false, gcpv1beta1.GcpRestrictionRoleBinding{Resource: "projects/" + testProject, Roles: []string{"roles/viewer"}})
+		restriction.Spec.Quota = &test.quota
+		r.DisableRestrictions = false
+		r.RestrictionService = *NewRestrictionService(&staticRestrictionResolveService{restrictions: []gcpv1beta1.GcpNamespaceRestriction{*restriction}})
+
+		// only a change of the spec or of a restriction can resolve the violation, it is not retried
+		result, err := r.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}})
+		if err != nil || result.Requeue || result.RequeueAfter != 0 {
+			t.Errorf("%s: expected no retry, got %+v: %v", test.name, result, err)
+		}
+		current := &gcpv1beta1.GcpServiceAccount{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, current); err != nil {
+			t.Fatal(err)
+		}
+		for _, conditionType := range []string{test.condition, gcpv1beta1.ConditionReady} {
+			if condition := gcpv1beta1.FindCondition(current.Status.Conditions, conditionType); condition == nil || condition.Reason != "QuotaExceeded" {
+				t.Errorf("%s: expected condition %s to report the exceeded quota, got %+v", test.name, conditionType, condition)
+			}
+		}
+	}
+}
+
+func TestNamespaceRequests(t *testing.T) {
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	other := newTestGcpServiceAccount("other", "000000000002")
+	other.Namespace = "other"
+	r, _ := newTestKeyReconciler(t, instance, other)
+
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: instance.Namespace, Labels: map[string]string{"team": "a"}}}
+	requests := r.namespaceRequests(handler.MapObject{Meta: namespace, Object: namespace})
+	expected := []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected the service accounts of the namespace %v, got %v", expected, requests)
+	}
+
+	relabeled := namespace.DeepCopy()
+	relabeled.Labels["team"] = "b"
+	if !namespaceLabelsChanged.Update(event.UpdateEvent{MetaOld: namespace, ObjectOld: namespace, MetaNew: relabeled, ObjectNew: relabeled}) {
+		t.Error("expected a relabeled namespace to be passed")
+	}
+	finalized := namespace.DeepCopy()
+	finalized.Finalizers = []string{"kubernetes"}
+	if namespaceLabelsChanged.Update(event.UpdateEvent{MetaOld: namespace, ObjectOld: namespace, MetaNew: finalized, ObjectNew: finalized}) {
+		t.Error("expected an update of a namespace with the same labels to be filtered")
+	}
+}
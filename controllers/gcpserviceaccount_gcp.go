@@ -0,0 +1,452 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"google.golang.org/api/iam/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	serviceAccountMaxLen    = 30
+	serviceAccountIdHashLen = 8
+	// serviceAccountIdCandidates is the number of account ids tried if an id is taken by another account
+	serviceAccountIdCandidates = 5
+	serviceAccountOwnerPrefix  = "managed by gcp-serviceaccount-controller for uid "
+)
+
+// serviceAccountExists checks if the service account recorded in the status still exists
+func (r *GcpServiceAccountReconciler) serviceAccountExists(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) (bool, error) {
+	if gcpServiceAccount.Status.ServiceAccountPath == "" {
+		return false, nil
+	}
+	_, err := r.GcpService.GetServiceAccount(gcpServiceAccount.Status.ServiceAccountPath)
+	if err != nil {
+		if isGoogleApi404Error(err) {
+			return false, nil
+		}
+		return false, errwrap.Wrapf(fmt.Sprintf("unable to get service account '%s': {{err}}", gcpServiceAccount.Status.ServiceAccountPath), err)
+	}
+	return true, nil
+}
+
+// serviceAccountKey returns the current credential key or nil if it does not exist
+func (r *GcpServiceAccountReconciler) serviceAccountKey(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) (*iam.ServiceAccountKey, error) {
+	if gcpServiceAccount.Status.CredentialKey == "" {
+		return nil, nil
+	}
+	key, err := r.GcpService.GetServiceAccountKey(gcpServiceAccount.Status.CredentialKey)
+	if err != nil {
+		if isGoogleApi404Error(err) {
+			return nil, nil
+		}
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to get service account key '%s': {{err}}", gcpServiceAccount.Status.CredentialKey), err)
+	}
+	return key, nil
+}
+
+// ensureServiceAccount returns the service account of the instance and if it was created. The account ids are
+// deterministic, so an account created by an earlier reconcile which failed to record it in the status is found
+// again. An id taken by an account of someone else is skipped.
+func (r *GcpServiceAccountReconciler) ensureServiceAccount(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, project string) (*iam.ServiceAccount, bool, error) {
+	if project == "" {
+		defaultProject, err := r.GcpService.DefaultProject()
+		if err != nil {
+			return nil, false, err
+		}
+		project = defaultProject
+	}
+	owner := serviceAccountOwnerDescription(gcpServiceAccount)
+
+	for attempt := 0; attempt < serviceAccountIdCandidates; attempt++ {
+		accountId := serviceAccountId(gcpServiceAccount, attempt)
+		path := fmt.Sprintf("projects/%s/serviceAccounts/%s@%s.iam.gserviceaccount.com", project, accountId, project)
+		account, err := r.GcpService.GetServiceAccount(path)
+		if err == nil {
+			if account.Description == owner {
+				return account, false, nil
+			}
+			r.Log.Info("service account id is taken by another account", "resourceName", gcpServiceAccount.Name, "accountId", accountId)
+			continue
+		}
+		if !isGoogleApi404Error(err) {
+			return nil, false, errwrap.Wrapf(fmt.Sprintf("unable to get service account '%s': {{err}}", path), err)
+		}
+
+		account, err = r.GcpService.CreateServiceAccount(project, accountId, descriptionOf(gcpServiceAccount), owner)
+		if googleApiErrorCode(err) == http.StatusConflict {
+			// the id is reserved by an account which can not be read, e.g. a recently deleted one
+			r.Log.Info("service account id is not available", "resourceName", gcpServiceAccount.Name, "accountId", accountId)
+			continue
+		}
+		if err != nil {
+			return nil, false, errwrap.Wrapf(fmt.Sprintf("unable to create new service account under project '%s': {{err}}", project), err)
+		}
+		return account, true, nil
+	}
+	return nil, false, fmt.Errorf("all %d service account ids of %s/%s in project %s are taken by other accounts",
+		serviceAccountIdCandidates, gcpServiceAccount.Namespace, gcpServiceAccount.Name, project)
+}
+
+// adoptServiceAccount returns the existing service account of the spec. Accounts created by the controller for
+// another GcpServiceAccount can not be adopted.
+func (r *GcpServiceAccountReconciler) adoptServiceAccount(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) (*iam.ServiceAccount, error) {
+	email := gcpServiceAccount.Spec.ExistingServiceAccountEmail
+	// the project is resolved by gcp, the email is unique across all projects
+	path := fmt.Sprintf("projects/-/serviceAccounts/%s", email)
+	account, err := r.GcpService.GetServiceAccount(path)
+	if err != nil {
+		if isGoogleApi404Error(err) {
+			return nil, fmt.Errorf("service account %s does not exist", email)
+		}
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to get service account '%s': {{err}}", path), err)
+	}
+	if strings.HasPrefix(account.Description, serviceAccountOwnerPrefix) && account.Description != serviceAccountOwnerDescription(gcpServiceAccount) {
+		return nil, fmt.Errorf("service account %s is managed by another GcpServiceAccount", email)
+	}
+	return account, nil
+}
+
+// serviceAccountId returns the account id of the attempt, the normalized identifier followed by a hash of
+// namespace, name and uid of the instance
+func serviceAccountId(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, attempt int) string {
+	seed := fmt.Sprintf("%s/%s/%s", gcpServiceAccount.Namespace, gcpServiceAccount.Name, gcpServiceAccount.UID)
+	if attempt > 0 {
+		seed = fmt.Sprintf("%s/%d", seed, attempt)
+	}
+	sum := sha256.Sum256([]byte(seed))
+	suffix := hex.EncodeToString(sum[:])[:serviceAccountIdHashLen]
+
+	prefix := "kube" + normalizeServiceAccountIdentifier(gcpServiceAccount.Spec.ServiceAccountIdentifier)
+	if maxLen := serviceAccountMaxLen - serviceAccountIdHashLen - 1; len(prefix) > maxLen {
+		prefix = prefix[:maxLen]
+	}
+	return fmt.Sprintf("%s-%s", strings.TrimRight(prefix, "-"), suffix)
+}
+
+// serviceAccountOwnerDescription returns the description which marks a service account as created for the instance
+func serviceAccountOwnerDescription(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) string {
+	return serviceAccountOwnerPrefix + string(gcpServiceAccount.UID)
+}
+
+// replaceServiceAccountKeys deletes all user managed keys and issues a new one
+func (r *GcpServiceAccountReconciler) replaceServiceAccountKeys(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) (*iam.ServiceAccountKey, error) {
+	if err := r.deleteServiceAccountKeys(gcpServiceAccount); err != nil {
+		return nil, err
+	}
+	return r.issueServiceAccountKey(gcpServiceAccount)
+}
+
+// deleteServiceAccountKeys deletes all user managed keys of the service account, only the keys issued by the
+// controller are deleted from an adopted service account
+func (r *GcpServiceAccountReconciler) deleteServiceAccountKeys(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) error {
+	if gcpServiceAccount.Status.Adopted {
+		for _, keyName := range []string{gcpServiceAccount.Status.CredentialKey, gcpServiceAccount.Status.PreviousCredentialKey} {
+			if keyName == "" {
+				continue
+			}
+			if err := r.deleteServiceAccountKey(gcpServiceAccount, keyName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	keys, err := r.GcpService.ListServiceAccountKeys(gcpServiceAccount.Status.ServiceAccountPath)
+	if err != nil {
+		if isGoogleApi404Error(err) {
+			return nil
+		}
+		return errwrap.Wrapf(fmt.Sprintf("unable to listservice account key for service account '%s': {{err}}", gcpServiceAccount.Status.ServiceAccountPath), err)
+	}
+	for _, k := range keys {
+		err = r.GcpService.DeleteServiceAccountKey(k.Name)
+		if err != nil && !isGoogleApi404Error(err) {
+			return errwrap.Wrapf(fmt.Sprintf("unable to delete service account key %s for service account '%s': {{err}}", k.Name, gcpServiceAccount.Status.ServiceAccountPath), err)
+		}
+		r.Recorder.Eventf(gcpServiceAccount, corev1.EventTypeNormal, eventReasonKeyDeleted, "deleted service account key %s", k.Name)
+	}
+	return nil
+}
+
+// issueServiceAccountKey creates an additional key and keeps all existing keys valid
+func (r *GcpServiceAccountReconciler) issueServiceAccountKey(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) (*iam.ServiceAccountKey, error) {
+	key, err := r.GcpService.CreateServiceAccountKey(gcpServiceAccount.Status.ServiceAccountPath)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("unable to create new service account key for service account '%s': {{err}}", gcpServiceAccount.Status.ServiceAccountPath), err)
+	}
+	return key, nil
+}
+
+// deleteServiceAccountKey deletes a single key, a key which is already gone is no error
+func (r *GcpServiceAccountReconciler) deleteServiceAccountKey(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, keyName string) error {
+	err := r.GcpService.DeleteServiceAccountKey(keyName)
+	if err != nil && !isGoogleApi404Error(err) {
+		return errwrap.Wrapf(fmt.Sprintf("unable to delete service account key %s for service account '%s': {{err}}", keyName, gcpServiceAccount.Status.ServiceAccountPath), err)
+	}
+	r.Recorder.Eventf(gcpServiceAccount, corev1.EventTypeNormal, eventReasonKeyDeleted, "deleted service account key %s", keyName)
+	return nil
+}
+
+// applyRoleBindings brings the roles of the service account on all resources of the applied and the desired role
+// bindings in line with the desired bindings. Bindings are grouped by the canonical resource name, so each iam
+// policy is read once and only written if a role has to be added or removed. The policies of resources whose
+// bindings did not change are only read if verify is set. Applied roles the service account lost and roles it got
+// outside of the controller are returned as drift, expired bindings are removed.
+func (r *GcpServiceAccountReconciler) applyRoleBindings(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, bindings []gcpv1beta1.GcpRoleBindings, verify bool) ([]gcpv1beta1.DriftFinding, error) {
+	member := fmt.Sprintf("serviceAccount:%s", gcpServiceAccount.Status.ServiceAccountMail)
+	now := time.Now()
+	var findings []gcpv1beta1.DriftFinding
+	for _, resource := range bindingResources(gcpServiceAccount.Status.AppliedGcpRoleBindings, bindings) {
+		if !verify && sameGrants(grantsOf(gcpServiceAccount.Status.AppliedGcpRoleBindings, resource), desiredGrants(bindings, resource, now)) {
+			continue
+		}
+		policy, err := r.GcpService.GetIamPolicy(resource)
+		if err != nil {
+			return findings, errwrap.Wrapf(fmt.Sprintf("unable to get iam policy of '%s': {{err}}", resource), err)
+		}
+		held := memberGrants(policy, member)
+		applied := grantsOf(gcpServiceAccount.Status.AppliedGcpRoleBindings, resource)
+		if gcpServiceAccount.Status.Adopted && len(applied) == 0 {
+			// the roles an adopted service account has on a resource before the controller manages it are kept
+			for _, grant := range held {
+				gcpServiceAccount.Status.PreexistingGcpRoleBindings = addBindingGrant(gcpServiceAccount.Status.PreexistingGcpRoleBindings, resource, grant)
+			}
+		}
+
+		desired := desiredGrants(bindings, resource, now)
+		toAdd := withoutGrants(desired, held)
+		toRemove := withoutGrants(withoutGrants(held, desired), grantsOf(gcpServiceAccount.Status.PreexistingGcpRoleBindings, resource))
+		for _, grant := range toAdd {
+			if containsGrant(applied, grant) {
+				findings = append(findings, gcpv1beta1.DriftFinding{Type: gcpv1beta1.DriftMissingBinding, Resource: resource, Role: grant.Role, Condition: grant.conditionTitle()})
+			}
+		}
+		for _, grant := range toRemove {
+			if !containsGrant(applied, grant) {
+				findings = append(findings, gcpv1beta1.DriftFinding{Type: gcpv1beta1.DriftUnexpectedBinding, Resource: resource, Role: grant.Role, Condition: grant.conditionTitle()})
+			}
+		}
+		if err := r.updateRoleBindings(gcpServiceAccount, resource, policy, toAdd, toRemove); err != nil {
+			return findings, err
+		}
+	}
+	return findings, nil
+}
+
+// removeRoleBindings removes the applied role bindings of the service account, bindings an adopted
+// service account had before are kept
+func (r *GcpServiceAccountReconciler) removeRoleBindings(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) error {
+	member := fmt.Sprintf("serviceAccount:%s", gcpServiceAccount.Status.ServiceAccountMail)
+	for _, resource := range bindingResources(gcpServiceAccount.Status.AppliedGcpRoleBindings) {
+		policy, err := r.GcpService.GetIamPolicy(resource)
+		if err != nil {
+			if isGoogleApi404Error(err) {
+				// the bindings are gone together with the resource
+				continue
+			}
+			return errwrap.Wrapf(fmt.Sprintf("unable to get iam policy of '%s': {{err}}", resource), err)
+		}
+		held := memberGrants(policy, member)
+		var toRemove []roleGrant
+		for _, grant := range withoutGrants(grantsOf(gcpServiceAccount.Status.AppliedGcpRoleBindings, resource), grantsOf(gcpServiceAccount.Status.PreexistingGcpRoleBindings, resource)) {
+			if containsGrant(held, grant) {
+				toRemove = append(toRemove, grant)
+			}
+		}
+		if err := r.updateRoleBindings(gcpServiceAccount, resource, policy, nil, toRemove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateRoleBindings adds and removes the grants of the service account in a single write of the iam policy
+func (r *GcpServiceAccountReconciler) updateRoleBindings(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, resource string, policy *iamutil.Policy, toAdd []roleGrant, toRemove []roleGrant) error {
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		r.Log.Info("role binding not changed skip", "resource", resource)
+		return nil
+	}
+	member := fmt.Sprintf("serviceAccount:%s", gcpServiceAccount.Status.ServiceAccountMail)
+	if _, err := r.GcpService.SetIamPolicy(resource, changePolicyGrants(policy, member, toAdd, toRemove)); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("unable to set iam policy of '%s': {{err}}", resource), err)
+	}
+	if len(toAdd) > 0 {
+		roleBindingsApplied.WithLabelValues("add").Add(float64(len(toAdd)))
+		r.Recorder.Eventf(gcpServiceAccount, corev1.EventTypeNormal, eventReasonBindingAdded, "added roles %v on %s", toAdd, resource)
+	}
+	if len(toRemove) > 0 {
+		roleBindingsApplied.WithLabelValues("remove").Add(float64(len(toRemove)))
+		r.Recorder.Eventf(gcpServiceAccount, corev1.EventTypeNormal, eventReasonBindingRemoved, "removed roles %v on %s", toRemove, resource)
+	}
+	return nil
+}
+
+// resolveRoleBindings returns the bindings of the spec with the referenced custom roles added to the roles,
+// a custom role which is not created yet or is being deleted fails the resolution
+func (r *GcpServiceAccountReconciler) resolveRoleBindings(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) ([]gcpv1beta1.GcpRoleBindings, error) {
+	var resolved []gcpv1beta1.GcpRoleBindings
+	for _, binding := range gcpServiceAccount.Spec.GcpRoleBindings {
+		binding.Roles = append([]string(nil), binding.Roles...)
+		for _, name := range binding.CustomRoles {
+			customRole := &gcpv1beta1.GcpCustomRole{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Namespace: gcpServiceAccount.Namespace, Name: name}, customRole); err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("unable to get custom role %s: {{err}}", name), err)
+			}
+			if customRole.Status.RoleName == "" || !customRole.DeletionTimestamp.IsZero() {
+				return nil, fmt.Errorf("custom role %s is not ready", name)
+			}
+			if !containsString(binding.Roles, customRole.Status.RoleName) {
+				binding.Roles = append(binding.Roles, customRole.Status.RoleName)
+			}
+		}
+		binding.CustomRoles = nil
+		resolved = append(resolved, binding)
+	}
+	return resolved, nil
+}
+
+// referencedCustomRoles returns the distinct names of the custom roles the bindings reference
+func referencedCustomRoles(bindings []gcpv1beta1.GcpRoleBindings) []string {
+	var names []string
+	for _, binding := range bindings {
+		for _, name := range binding.CustomRoles {
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// bindingResources returns the distinct canonical resources of the bindings in the order of their first occurrence
+func bindingResources(bindings ...[]gcpv1beta1.GcpRoleBindings) []string {
+	var resources []string
+	for _, list := range bindings {
+		for _, b := range list {
+			if resource := resourceKey(b.Resource); !containsString(resources, resource) {
+				resources = append(resources, resource)
+			}
+		}
+	}
+	return resources
+}
+
+// workloadIdentityMember returns the member of the kubernetes service account in the workload identity pool
+// of the cluster, which is independent of the projects of the service account and of the controller credentials
+func (r *GcpServiceAccountReconciler) workloadIdentityMember(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) (string, error) {
+	if r.WorkloadIdentityPool == "" {
+		return "", fmt.Errorf("the workload identity pool of the cluster is not configured, set WORKLOAD_IDENTITY_POOL")
+	}
+	return fmt.Sprintf("serviceAccount:%s[%s/%s]", r.WorkloadIdentityPool, gcpServiceAccount.Namespace, gcpServiceAccount.Spec.KubernetesServiceAccountName), nil
+}
+
+// addServiceAccountIamMember grants the role on the gcp service account itself to the member
+func (r *GcpServiceAccountReconciler) addServiceAccountIamMember(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, role string, member string) error {
+	changed, err := r.changeServiceAccountIamMember(gcpServiceAccount.Status.ServiceAccountPath, role, member, true)
+	if err != nil {
+		return err
+	}
+	if changed {
+		r.Recorder.Eventf(gcpServiceAccount, corev1.EventTypeNormal, eventReasonBindingAdded, "added role %s for %s on the service account", role, member)
+	}
+	return nil
+}
+
+// removeServiceAccountIamMember revokes the role on the gcp service account itself from the member
+func (r *GcpServiceAccountReconciler) removeServiceAccountIamMember(gcpServiceAccount *gcpv1beta1.GcpServiceAccount, role string, member string) error {
+	changed, err := r.changeServiceAccountIamMember(gcpServiceAccount.Status.ServiceAccountPath, role, member, false)
+	if err != nil {
+		return err
+	}
+	if changed {
+		r.Recorder.Eventf(gcpServiceAccount, corev1.EventTypeNormal, eventReasonBindingRemoved, "removed role %s for %s on the service account", role, member)
+	}
+	return nil
+}
+
+func (r *GcpServiceAccountReconciler) changeServiceAccountIamMember(serviceAccountPath string, role string, member string, add bool) (bool, error) {
+	policy, err := r.GcpService.GetIamPolicy(serviceAccountPath)
+	if err != nil {
+		if !add && isGoogleApi404Error(err) {
+			return false, nil
+		}
+		return false, errwrap.Wrapf(fmt.Sprintf("unable to get iam policy of service account '%s': {{err}}", serviceAccountPath), err)
+	}
+
+	changed := false
+	var binding *iamutil.Binding
+	for _, b := range policy.Bindings {
+		if b.Role == role && b.Condition == nil {
+			binding = b
+			break
+		}
+	}
+	if add {
+		if binding == nil {
+			binding = &iamutil.Binding{Role: role}
+			policy.Bindings = append(policy.Bindings, binding)
+		}
+		if !containsString(binding.Members, member) {
+			binding.Members = append(binding.Members, member)
+			changed = true
+		}
+	} else if binding != nil && containsString(binding.Members, member) {
+		binding.Members = removeString(binding.Members, member)
+		changed = true
+		if len(binding.Members) == 0 {
+			var bindings []*iamutil.Binding
+			for _, b := range policy.Bindings {
+				if b != binding {
+					bindings = append(bindings, b)
+				}
+			}
+			policy.Bindings = bindings
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	_, err = r.GcpService.SetIamPolicy(serviceAccountPath, policy)
+	if err != nil {
+		return false, errwrap.Wrapf(fmt.Sprintf("unable to set iam policy of service account '%s': {{err}}", serviceAccountPath), err)
+	}
+	return true, nil
+}
+
+// deleteServiceAccount removes the applied role bindings and deletes the service account
+func (r *GcpServiceAccountReconciler) deleteServiceAccount(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) error {
+	if err := r.removeRoleBindings(gcpServiceAccount); err != nil {
+		return err
+	}
+	if gcpServiceAccount.Status.ServiceAccountPath == "" {
+		return nil
+	}
+	err := r.GcpService.DeleteServiceAccount(gcpServiceAccount.Status.ServiceAccountPath)
+	if err != nil && !isGoogleApi404Error(err) {
+		return errwrap.Wrapf(fmt.Sprintf("unable to delete service account '%s': {{err}}", gcpServiceAccount.Status.ServiceAccountPath), err)
+	}
+	return nil
+}
+
+// releaseServiceAccount removes the role bindings and keys the controller added to the service account
+// and leaves the service account itself in place
+func (r *GcpServiceAccountReconciler) releaseServiceAccount(gcpServiceAccount *gcpv1beta1.GcpServiceAccount) error {
+	if err := r.removeRoleBindings(gcpServiceAccount); err != nil {
+		return err
+	}
+	if gcpServiceAccount.Status.ServiceAccountPath == "" {
+		return nil
+	}
+	return r.deleteServiceAccountKeys(gcpServiceAccount)
+}
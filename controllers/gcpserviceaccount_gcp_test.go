@@ -0,0 +1,548 @@
+package controllers
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpfake"
+)
+
+func TestServiceAccountId(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])$`)
+	tests := []struct {
+		identifier string
+		expected   string
+	}{
+		{"app", "kubeapp-"},
+		{"", "kube-"},
+		{"a-very-long-identifier-of-an-application", "kubea-very-long-ident-"},
+		{"trailing-dash-at-the-cut", "kubetrailing-dash-at-"},
+	}
+	for _, test := range tests {
+		id := serviceAccountId(newTestGcpServiceAccount(test.identifier, "000000000001"), 0)
+		if !strings.HasPrefix(id, test.expected) {
+			t.Errorf("expected id of %q to start with %s, got %s", test.identifier, test.expected, id)
+		}
+		if len(id) < 6 || len(id) > serviceAccountMaxLen || !valid.MatchString(id) || strings.Contains(id, "--") {
+			t.Errorf("invalid id %s of %q", id, test.identifier)
+		}
+	}
+
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	if serviceAccountId(instance, 0) != serviceAccountId(instance.DeepCopy(), 0) {
+		t.Error("expected the id to be deterministic")
+	}
+	if serviceAccountId(instance, 0) == serviceAccountId(instance, 1) {
+		t.Error("expected another id for the next attempt")
+	}
+	if serviceAccountId(instance, 0) == serviceAccountId(newTestGcpServiceAccount("app", "000000000002"), 0) {
+		t.Error("expected another id for another uid")
+	}
+}
+
+func TestEnsureServiceAccount(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	instance := newTestGcpServiceAccount("app", "000000000001")
+
+	// the first id is taken by an account which was not created for the instance
+	if _, err := fake.CreateServiceAccount("", serviceAccountId(instance, 0), "foreign", "created by hand"); err != nil {
+		t.Fatal(err)
+	}
+
+	account, created, err := r.ensureServiceAccount(instance, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || !strings.HasPrefix(account.Email, serviceAccountId(instance, 1)+"@") {
+		t.Errorf("expected the account to be created with the second id, got %s (created %v)", account.Email, created)
+	}
+
+	// the status of the first reconcile got lost
+	recovered, created, err := r.ensureServiceAccount(instance, "test-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || recovered.Name != account.Name {
+		t.Errorf("expected the account %s to be recovered, got %s (created %v)", account.Name, recovered.Name, created)
+	}
+	if count := fake.CallCount(gcpfake.MethodCreateServiceAccount); count != 2 {
+		t.Errorf("expected 2 created accounts, got %d", count)
+	}
+}
+
+func TestAdoptAndReleaseServiceAccount(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	resource := "projects/test-project"
+
+	existing, err := fake.CreateServiceAccount("", "hand-made", "hand made", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handKey, err := fake.CreateServiceAccountKey(existing.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changeMemberRoles(t, fake, resource, existing.Email, []string{"roles/viewer"}, nil)
+
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.ExistingServiceAccountEmail = existing.Email
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: resource, Roles: []string{"roles/viewer", "roles/editor"}}}
+	account, err := r.adoptServiceAccount(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.ServiceAccountPath = account.Name
+	instance.Status.ServiceAccountMail = account.Email
+	instance.Status.Adopted = true
+
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = instance.Spec.GcpRoleBindings
+	if expected := []roleGrant{{Role: "roles/viewer"}}; !reflect.DeepEqual(grantsOf(instance.Status.PreexistingGcpRoleBindings, resource), expected) {
+		t.Errorf("expected preexisting roles %v, got %v", expected, instance.Status.PreexistingGcpRoleBindings)
+	}
+	issued, err := r.replaceServiceAccountKeys(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.CredentialKey = issued.Name
+	if keys := fake.KeyNames(account.Name); len(keys) != 2 {
+		t.Errorf("expected the hand made key to be kept, got %v", keys)
+	}
+
+	if err := r.releaseServiceAccount(instance); err != nil {
+		t.Fatal(err)
+	}
+	member := "serviceAccount:" + existing.Email
+	if !containsString(fake.Members(resource, "roles/viewer"), member) {
+		t.Error("expected the preexisting binding to be kept")
+	}
+	if containsString(fake.Members(resource, "roles/editor"), member) {
+		t.Error("expected the added binding to be removed")
+	}
+	if keys := fake.KeyNames(account.Name); !reflect.DeepEqual(keys, []string{handKey.Name}) {
+		t.Errorf("expected only the hand made key to be left, got %v", keys)
+	}
+	if !fake.HasServiceAccount(account.Name) || fake.CallCount(gcpfake.MethodDeleteServiceAccount) != 0 {
+		t.Error("expected the adopted service account to be kept")
+	}
+
+	other := newTestGcpServiceAccount("other", "000000000002")
+	owned, err := fake.CreateServiceAccount("", serviceAccountId(other, 0), "other", serviceAccountOwnerDescription(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Spec.ExistingServiceAccountEmail = owned.Email
+	if _, err := r.adoptServiceAccount(instance); err == nil {
+		t.Error("expected an account of another GcpServiceAccount not to be adopted")
+	}
+}
+
+func TestDeletionPolicyOf(t *testing.T) {
+	tests := []struct {
+		spec       gcpv1beta1.DeletionPolicy
+		controller gcpv1beta1.DeletionPolicy
+		expected   gcpv1beta1.DeletionPolicy
+	}{
+		{"", "", gcpv1beta1.DeletionPolicyDelete},
+		{gcpv1beta1.DeletionPolicyDelete, gcpv1beta1.DeletionPolicyAbandon, gcpv1beta1.DeletionPolicyDelete},
+		{gcpv1beta1.DeletionPolicyRetain, "", gcpv1beta1.DeletionPolicyRetain},
+		{"", gcpv1beta1.DeletionPolicyRetain, gcpv1beta1.DeletionPolicyRetain},
+	}
+	for _, test := range tests {
+		r := newTestReconciler(gcpfake.NewGcpService("test-project"))
+		r.DefaultDeletionPolicy = test.controller
+		instance := newTestGcpServiceAccount("app", "000000000001")
+		instance.Spec.DeletionPolicy = test.spec
+		if policy := r.deletionPolicyOf(instance); policy != test.expected {
+			t.Errorf("%s (controller %s): expected %s, got %s", test.spec, test.controller, test.expected, policy)
+		}
+	}
+}
+
+func TestRepairRoleBindingDrift(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	resource := "projects/test-project"
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: resource, Roles: []string{"roles/viewer", "roles/pubsub.publisher"}}}
+	account := createTestServiceAccount(t, r, instance)
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = instance.Spec.GcpRoleBindings
+
+	fake.ResetCalls()
+	if findings, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true); err != nil || len(findings) != 0 {
+		t.Fatalf("expected no drift, got %v (%v)", findings, err)
+	}
+	if count := fake.CallCount(gcpfake.MethodSetIamPolicy); count != 0 {
+		t.Errorf("expected the unchanged policy not to be written, got %d writes", count)
+	}
+
+	// the viewer role is revoked and the editor role granted in the console
+	changeMemberRoles(t, fake, resource, account.Email, []string{"roles/editor"}, []string{"roles/viewer"})
+	findings, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gcpv1beta1.DriftFinding{
+		{Type: gcpv1beta1.DriftMissingBinding, Resource: resource, Role: "roles/viewer"},
+		{Type: gcpv1beta1.DriftUnexpectedBinding, Resource: resource, Role: "roles/editor"},
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("expected findings %v, got %v", expected, findings)
+	}
+	member := "serviceAccount:" + account.Email
+	if !containsString(fake.Members(resource, "roles/viewer"), member) || containsString(fake.Members(resource, "roles/editor"), member) {
+		t.Error("expected the drift to be repaired")
+	}
+
+	for i := 0; i < maxDriftFindings; i++ {
+		r.recordDrift(instance, findings)
+	}
+	if len(instance.Status.DriftFindings) != maxDriftFindings {
+		t.Errorf("expected %d findings in the status, got %d", maxDriftFindings, len(instance.Status.DriftFindings))
+	}
+}
+
+func TestApplyRoleBindingsDiff(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	project := "projects/test-project"
+	topic := "projects/test-project/topics/events"
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{
+		{Resource: project, Roles: []string{"roles/viewer", "roles/cloudsql.client"}},
+		{Resource: topic, Roles: []string{"roles/pubsub.publisher"}},
+	}
+	account := createTestServiceAccount(t, r, instance)
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = instance.Spec.GcpRoleBindings
+
+	// cloudsql.client is replaced by editor, the topic is no longer bound
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: project, Roles: []string{"roles/viewer", "roles/editor"}}}
+	fake.ResetCalls()
+	findings, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected a spec change not to be reported as drift, got %v", findings)
+	}
+	var written []string
+	for _, call := range fake.Calls() {
+		if call.Method == gcpfake.MethodSetIamPolicy {
+			written = append(written, call.Args[0])
+		}
+	}
+	if expected := []string{project, topic}; !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected a single write per resource %v, got %v", expected, written)
+	}
+	member := "serviceAccount:" + account.Email
+	for role, bound := range map[string]bool{"roles/viewer": true, "roles/editor": true, "roles/cloudsql.client": false} {
+		if containsString(fake.Members(project, role), member) != bound {
+			t.Errorf("expected %s bound %v", role, bound)
+		}
+	}
+	if containsString(fake.Members(topic, "roles/pubsub.publisher"), member) {
+		t.Error("expected the binding on the topic to be removed")
+	}
+}
+
+func TestApplyRoleBindingsResourceSpellings(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	relative := "projects/test-project"
+	full := "//cloudresourcemanager.googleapis.com/projects/test-project"
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	account := createTestServiceAccount(t, r, instance)
+	applied := []gcpv1beta1.GcpRoleBindings{{Resource: full, Roles: []string{"roles/viewer", "roles/editor"}}}
+	if _, err := r.applyRoleBindings(instance, applied, true); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = applied
+
+	// the spec was rewritten to the relative name, editor is no longer requested
+	fake.ResetCalls()
+	findings, err := r.applyRoleBindings(instance, []gcpv1beta1.GcpRoleBindings{{Resource: relative, Roles: []string{"roles/viewer"}}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected no drift, got %v", findings)
+	}
+	if reads, writes := fake.CallCount(gcpfake.MethodGetIamPolicy), fake.CallCount(gcpfake.MethodSetIamPolicy); reads != 1 || writes != 1 {
+		t.Errorf("expected a single read and write of the policy, got %d reads and %d writes", reads, writes)
+	}
+	member := "serviceAccount:" + account.Email
+	if !containsString(fake.Members(relative, "roles/viewer"), member) || containsString(fake.Members(relative, "roles/editor"), member) {
+		t.Error("expected viewer to be kept and editor to be removed")
+	}
+	if bindings := canonicalBindings(applied); bindings[0].Resource != relative {
+		t.Errorf("expected the applied resource to be canonical, got %s", bindings[0].Resource)
+	}
+}
+
+func TestApplyRoleBindingsBetweenResyncs(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	project := "projects/test-project"
+	topic := "projects/test-project/topics/events"
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{
+		{Resource: project, Roles: []string{"roles/viewer"}},
+		{Resource: topic, Roles: []string{"roles/pubsub.publisher"}},
+	}
+	createTestServiceAccount(t, r, instance)
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = instance.Spec.GcpRoleBindings
+
+	fake.ResetCalls()
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, false); err != nil {
+		t.Fatal(err)
+	}
+	if count := fake.CallCount(gcpfake.MethodGetIamPolicy); count != 0 {
+		t.Errorf("expected no iam policy to be read between resyncs, got %d reads", count)
+	}
+
+	// only the policy of the changed topic binding is read
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{
+		{Resource: project, Roles: []string{"roles/viewer"}},
+		{Resource: topic, Roles: []string{"roles/pubsub.subscriber"}},
+	}
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, false); err != nil {
+		t.Fatal(err)
+	}
+	var read []string
+	for _, call := range fake.Calls() {
+		if call.Method == gcpfake.MethodGetIamPolicy {
+			read = append(read, call.Args[0])
+		}
+	}
+	if expected := []string{topic}; !reflect.DeepEqual(read, expected) {
+		t.Errorf("expected only the changed resource %v to be read, got %v", expected, read)
+	}
+}
+
+// changeMemberRoles grants and revokes roles of the service account outside of the controller
+func changeMemberRoles(t *testing.T, fake *gcpfake.GcpService, resource string, email string, toAdd []string, toRemove []string) {
+	policy, err := fake.GetIamPolicy(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addDelta, removeDelta *iamutil.PolicyDelta
+	if len(toAdd) > 0 {
+		addDelta = &iamutil.PolicyDelta{Roles: util.ToSet(toAdd), Email: email}
+	}
+	if len(toRemove) > 0 {
+		removeDelta = &iamutil.PolicyDelta{Roles: util.ToSet(toRemove), Email: email}
+	}
+	_, updated := policy.ChangedBindings(addDelta, removeDelta)
+	if _, err := fake.SetIamPolicy(resource, updated); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangePolicyGrants(t *testing.T) {
+	member := "serviceAccount:app@test-project.iam.gserviceaccount.com"
+	other := "user:someone@example.com"
+	officeHours := &iamutil.Condition{Title: "office hours", Expression: "request.time.getHours() < 18"}
+	weekdays := &iamutil.Condition{Title: "weekdays", Expression: "request.time.getDayOfWeek() < 5"}
+	policy := &iamutil.Policy{Etag: "etag", Version: 3, Bindings: []*iamutil.Binding{
+		{Role: "roles/viewer", Members: []string{member, other}},
+		{Role: "roles/viewer", Members: []string{member}, Condition: officeHours},
+		{Role: "roles/editor", Members: []string{other}, Condition: weekdays},
+	}}
+
+	updated := changePolicyGrants(policy, member,
+		[]roleGrant{{Role: "roles/editor", Condition: officeHours}},
+		[]roleGrant{{Role: "roles/viewer", Condition: officeHours}})
+
+	expected := []roleGrant{{Role: "roles/viewer"}, {Role: "roles/editor", Condition: officeHours}}
+	if grants := memberGrants(updated, member); !reflect.DeepEqual(grants, expected) {
+		t.Errorf("expected grants %v, got %v", expected, grants)
+	}
+	if grants := memberGrants(updated, other); !containsGrant(grants, roleGrant{Role: "roles/editor", Condition: weekdays}) {
+		t.Errorf("expected the conditional binding of other members to be kept, got %v", grants)
+	}
+	if updated.Version != conditionalPolicyVersion || updated.Etag != "etag" {
+		t.Errorf("expected version %d and the etag to be kept, got %d %s", conditionalPolicyVersion, updated.Version, updated.Etag)
+	}
+	if len(memberGrants(policy, member)) != 2 {
+		t.Error("expected the original policy to be unchanged")
+	}
+}
+
+func TestBindingCondition(t *testing.T) {
+	expiresAt := metav1.NewTime(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	condition := &gcpv1beta1.GcpRoleBindingCondition{Title: "office hours", Description: "only at work", Expression: "request.time.getHours() < 18"}
+	tests := []struct {
+		name     string
+		binding  gcpv1beta1.GcpRoleBindings
+		expected *iamutil.Condition
+	}{
+		{"unconditional", gcpv1beta1.GcpRoleBindings{}, nil},
+		{"condition", gcpv1beta1.GcpRoleBindings{Condition: condition},
+			&iamutil.Condition{Title: "office hours", Description: "only at work", Expression: "request.time.getHours() < 18"}},
+		{"expiry", gcpv1beta1.GcpRoleBindings{ExpiresAt: &expiresAt},
+			&iamutil.Condition{Title: "expires 2030-01-02T03:04:05Z", Expression: `request.time < timestamp("2030-01-02T03:04:05Z")`}},
+		{"condition and expiry", gcpv1beta1.GcpRoleBindings{Condition: condition, ExpiresAt: &expiresAt},
+			&iamutil.Condition{Title: "office hours", Description: "only at work", Expression: `(request.time.getHours() < 18) && request.time < timestamp("2030-01-02T03:04:05Z")`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if condition := bindingCondition(test.binding); !reflect.DeepEqual(condition, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, condition)
+			}
+		})
+	}
+}
+
+func TestApplyConditionalRoleBindings(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	r := newTestReconciler(fake)
+	project := "projects/test-project"
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	account := createTestServiceAccount(t, r, instance)
+	member := "serviceAccount:" + account.Email
+
+	expired := metav1.NewTime(time.Now().Add(-time.Minute))
+	expiredBinding := gcpv1beta1.GcpRoleBindings{Resource: project, Roles: []string{"roles/editor"}, ExpiresAt: &expired}
+	// the expired grant was applied while it was still valid
+	policy, err := fake.GetIamPolicy(project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredGrant := roleGrant{Role: "roles/editor", Condition: bindingCondition(expiredBinding)}
+	if _, err := fake.SetIamPolicy(project, changePolicyGrants(policy, member, []roleGrant{expiredGrant}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = []gcpv1beta1.GcpRoleBindings{expiredBinding}
+
+	conditional := gcpv1beta1.GcpRoleBindings{Resource: project, Roles: []string{"roles/viewer"},
+		Condition: &gcpv1beta1.GcpRoleBindingCondition{Title: "office hours", Expression: "request.time.getHours() < 18"}}
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{conditional, expiredBinding}
+	findings, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected no drift, got %v", findings)
+	}
+	expected := []roleGrant{{Role: "roles/viewer", Condition: bindingCondition(conditional)}}
+	if grants := memberGrants(fake.Policy(project), member); !reflect.DeepEqual(grants, expected) {
+		t.Errorf("expected the expired grant to be replaced by %v, got %v", expected, grants)
+	}
+	if len(fake.Members(project, "roles/viewer")) != 0 {
+		t.Error("expected no unconditional binding of roles/viewer")
+	}
+}
+
+func TestConditionAllowed(t *testing.T) {
+	expiresAt := metav1.NewTime(time.Now().Add(time.Hour))
+	plain := gcpv1beta1.GcpRoleBindings{Resource: "projects/test-project", Roles: []string{"roles/viewer"}}
+	conditional := plain
+	conditional.Condition = &gcpv1beta1.GcpRoleBindingCondition{Title: "office hours", Expression: "request.time.getHours() < 18"}
+	expiring := plain
+	expiring.ExpiresAt = &expiresAt
+	tests := []struct {
+		requirement gcpv1beta1.ConditionRequirement
+		binding     gcpv1beta1.GcpRoleBindings
+		allowed     bool
+	}{
+		{"", plain, true},
+		{gcpv1beta1.ConditionOptional, conditional, true},
+		{gcpv1beta1.ConditionRequired, plain, false},
+		{gcpv1beta1.ConditionRequired, conditional, true},
+		{gcpv1beta1.ConditionRequired, expiring, true},
+		{gcpv1beta1.ConditionForbidden, plain, true},
+		{gcpv1beta1.ConditionForbidden, expiring, false},
+	}
+	for i, test := range tests {
+		restriction := &gcpv1beta1.GcpRestrictionRoleBinding{Resource: plain.Resource, Roles: plain.Roles, Condition: test.requirement}
+		if allowed := conditionAllowed(restriction, test.binding); allowed != test.allowed {
+			t.Errorf("%d: expected allowed %v for %s, got %v", i, test.allowed, test.requirement, allowed)
+		}
+	}
+}
+
+func TestRevokeDeniedBindings(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	restriction := newTestRestriction(false,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "projects/test-project", Roles: []string{"roles/viewer", "roles/editor"}})
+	restrictions := &staticRestrictionResolveService{restrictions: []gcpv1beta1.GcpNamespaceRestriction{*restriction}}
+	r := newTestReconciler(fake)
+	r.RestrictionService = *NewRestrictionService(restrictions)
+	resource := "projects/test-project"
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: resource, Roles: []string{"roles/viewer", "roles/editor"}}}
+	account := createTestServiceAccount(t, r, instance)
+	if _, err := r.applyRoleBindings(instance, instance.Spec.GcpRoleBindings, true); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.AppliedGcpRoleBindings = instance.Spec.GcpRoleBindings
+
+	// the restriction is tightened, editor is denied for all namespaces
+	restriction.Spec.Deny = []gcpv1beta1.GcpRestrictionDeny{{Roles: []string{"roles/editor"}}}
+	restrictions.restrictions = []gcpv1beta1.GcpNamespaceRestriction{*restriction}
+	if err := r.revokeDeniedBindings(instance); err != nil {
+		t.Fatal(err)
+	}
+	member := "serviceAccount:" + account.Email
+	if !containsString(fake.Members(resource, "roles/viewer"), member) || containsString(fake.Members(resource, "roles/editor"), member) {
+		t.Error("expected only the denied role to be revoked")
+	}
+	expected := []gcpv1beta1.GcpRoleBindings{{Resource: resource, Roles: []string{"roles/viewer"}}}
+	if !reflect.DeepEqual(instance.Status.AppliedGcpRoleBindings, expected) {
+		t.Errorf("expected applied bindings %v, got %v", expected, instance.Status.AppliedGcpRoleBindings)
+	}
+
+	fake.ResetCalls()
+	if err := r.revokeDeniedBindings(instance); err != nil {
+		t.Fatal(err)
+	}
+	if count := fake.CallCount(gcpfake.MethodSetIamPolicy); count != 0 {
+		t.Errorf("expected nothing to be revoked twice, got %d writes", count)
+	}
+}
+
+func TestEnforcementAction(t *testing.T) {
+	reportOnly := newNamedTestRestriction("report-only", false)
+	reportOnly.Spec.EnforcementAction = gcpv1beta1.EnforcementReportOnly
+	revoke := newNamedTestRestriction("revoke", false)
+	revoke.Spec.EnforcementAction = gcpv1beta1.EnforcementRevoke
+	defaulted := newNamedTestRestriction("defaulted", false)
+
+	tests := []struct {
+		restrictions  []gcpv1beta1.GcpNamespaceRestriction
+		defaultAction gcpv1beta1.EnforcementAction
+		expected      gcpv1beta1.EnforcementAction
+	}{
+		{[]gcpv1beta1.GcpNamespaceRestriction{*defaulted}, "", gcpv1beta1.EnforcementRevoke},
+		{[]gcpv1beta1.GcpNamespaceRestriction{*defaulted}, gcpv1beta1.EnforcementReportOnly, gcpv1beta1.EnforcementReportOnly},
+		{[]gcpv1beta1.GcpNamespaceRestriction{*reportOnly, *defaulted}, gcpv1beta1.EnforcementReportOnly, gcpv1beta1.EnforcementReportOnly},
+		{[]gcpv1beta1.GcpNamespaceRestriction{*reportOnly, *revoke}, gcpv1beta1.EnforcementReportOnly, gcpv1beta1.EnforcementRevoke},
+		{[]gcpv1beta1.GcpNamespaceRestriction{*reportOnly, *defaulted}, "", gcpv1beta1.EnforcementRevoke},
+	}
+	for i, test := range tests {
+		if action := enforcementAction(test.restrictions, test.defaultAction); action != test.expected {
+			t.Errorf("%d: expected %s, got %s", i, test.expected, action)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/mutate-gcp-kiwigrid-com-v1beta1-gcpserviceaccount,mutating=true,failurePolicy=fail,groups=gcp.kiwigrid.com,resources=gcpserviceaccounts,verbs=create;update,versions=v1beta1,name=mgcpserviceaccount.kb.io
+// +kubebuilder:webhook:path=/validate-gcp-kiwigrid-com-v1beta1-gcpserviceaccount,mutating=false,failurePolicy=fail,groups=gcp.kiwigrid.com,resources=gcpserviceaccounts,verbs=create;update,versions=v1beta1,name=vgcpserviceaccount.kb.io
+
+const (
+	// GcpServiceAccountDefaulterPath is the path the GcpServiceAccountDefaulter is served at
+	GcpServiceAccountDefaulterPath = "/mutate-gcp-kiwigrid-com-v1beta1-gcpserviceaccount"
+	// GcpServiceAccountValidatorPath is the path the GcpServiceAccountValidator is served at
+	GcpServiceAccountValidatorPath = "/validate-gcp-kiwigrid-com-v1beta1-gcpserviceaccount"
+
+	defaultSecretKey         = "credentials.json"
+	serviceAccountDescMaxLen = 100
+)
+
+var (
+	invalidServiceAccountIdentifierChars = regexp.MustCompile("[^a-z0-9-]+")
+	serviceAccountEmailPattern           = regexp.MustCompile(`^[a-z0-9-]+@([a-z0-9.-]+)$`)
+	userManagedServiceAccountDomain      = regexp.MustCompile(`^([a-z0-9.-]+)\.iam\.gserviceaccount\.com$`)
+)
+
+// GcpServiceAccountDefaulter persists the defaults the controller would apply anyway into the spec
+type GcpServiceAccountDefaulter struct {
+	log     logr.Logger
+	decoder *admission.Decoder
+}
+
+func NewGcpServiceAccountDefaulter() *GcpServiceAccountDefaulter {
+	return &GcpServiceAccountDefaulter{log: logf.Log.WithName("gcpserviceaccountdefaulter")}
+}
+
+func (d *GcpServiceAccountDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	instance := &gcpv1beta1.GcpServiceAccount{}
+	if err := d.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !instance.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+	if instance.Namespace == "" {
+		instance.Namespace = req.Namespace
+	}
+
+	defaultGcpServiceAccount(instance)
+
+	marshaled, err := json.Marshal(instance)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+func (d *GcpServiceAccountDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+// maxConditionTitleLength is the longest title iam accepts for a condition
+const maxConditionTitleLength = 100
+
+// validateGcpServiceAccountSpec returns all problems of the spec the reconciler can not handle
+func validateGcpServiceAccountSpec(spec *gcpv1beta1.GcpServiceAccountSpec) []string {
+	var problems []string
+	switch spec.Mode {
+	case "", gcpv1beta1.ModeKey:
+		if spec.SecretName == "" {
+			problems = append(problems, "secretName is required in Key mode")
+		}
+	case gcpv1beta1.ModeWorkloadIdentity:
+		if spec.KubernetesServiceAccountName == "" {
+			problems = append(problems, "kubernetesServiceAccountName is required in WorkloadIdentity mode")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown mode %s", spec.Mode))
+	}
+	if !ValidDeletionPolicy(spec.DeletionPolicy) {
+		problems = append(problems, fmt.Sprintf("unknown deletionPolicy %s", spec.DeletionPolicy))
+	}
+	if spec.ExistingServiceAccountEmail != "" {
+		if !serviceAccountEmailPattern.MatchString(spec.ExistingServiceAccountEmail) {
+			problems = append(problems, fmt.Sprintf("existingServiceAccountEmail %s is not a service account email", spec.ExistingServiceAccountEmail))
+		} else if project := serviceAccountEmailProject(spec.ExistingServiceAccountEmail); spec.Project != "" && project != "" && project != spec.Project {
+			problems = append(problems, fmt.Sprintf("existingServiceAccountEmail %s is not in project %s", spec.ExistingServiceAccountEmail, spec.Project))
+		}
+	}
+	for i, binding := range spec.GcpRoleBindings {
+		if binding.Condition == nil {
+			continue
+		}
+		if binding.Condition.Title == "" || len(binding.Condition.Title) > maxConditionTitleLength {
+			problems = append(problems, fmt.Sprintf("bindings[%d].condition.title must have 1 to %d characters", i, maxConditionTitleLength))
+		}
+		if binding.Condition.Expression == "" {
+			problems = append(problems, fmt.Sprintf("bindings[%d].condition.expression must not be empty", i))
+		}
+	}
+	if rotation := spec.KeyRotation; rotation != nil {
+		if rotation.MaxAge.Duration <= 0 {
+			problems = append(problems, "keyRotation.maxAge must be positive")
+		}
+		// a longer overlap would rotate the key again before the previous key is deleted
+		if rotation.Overlap.Duration < 0 || (rotation.MaxAge.Duration > 0 && rotation.Overlap.Duration > rotation.MaxAge.Duration/2) {
+			problems = append(problems, "keyRotation.overlap must be non-negative and at most half of keyRotation.maxAge")
+		}
+	}
+	return problems
+}
+
+// defaultGcpServiceAccount sets all defaults of the spec
+func defaultGcpServiceAccount(instance *gcpv1beta1.GcpServiceAccount) {
+	if instance.Spec.Mode == "" {
+		instance.Spec.Mode = gcpv1beta1.ModeKey
+	}
+	if instance.Spec.Mode == gcpv1beta1.ModeKey {
+		instance.Spec.SecretKey = secretKeyOf(instance)
+	}
+	instance.Spec.ServiceAccountDescription = descriptionOf(instance)
+	instance.Spec.ServiceAccountIdentifier = normalizeServiceAccountIdentifier(instance.Spec.ServiceAccountIdentifier)
+	for i, binding := range instance.Spec.GcpRoleBindings {
+		// unparsable resources are left untouched, they are reported by the reconciler
+		if canonical, err := canonicalResourceName(binding.Resource); err == nil {
+			instance.Spec.GcpRoleBindings[i].Resource = canonical
+		}
+	}
+}
+
+func secretKeyOf(instance *gcpv1beta1.GcpServiceAccount) string {
+	if instance.Spec.SecretKey == "" {
+		return defaultSecretKey
+	}
+	return instance.Spec.SecretKey
+}
+
+func descriptionOf(instance *gcpv1beta1.GcpServiceAccount) string {
+	if instance.Spec.ServiceAccountDescription != "" {
+		return instance.Spec.ServiceAccountDescription
+	}
+	name := instance.Name
+	if name == "" {
+		name = instance.GenerateName
+	}
+	description := fmt.Sprintf("%s/%s", instance.Namespace, name)
+	if len(description) > serviceAccountDescMaxLen {
+		description = description[:serviceAccountDescMaxLen]
+	}
+	return description
+}
+
+// ValidDeletionPolicy returns if the policy is known, empty selects the default of the controller
+func ValidDeletionPolicy(policy gcpv1beta1.DeletionPolicy) bool {
+	switch policy {
+	case "", gcpv1beta1.DeletionPolicyDelete, gcpv1beta1.DeletionPolicyRetain, gcpv1beta1.DeletionPolicyAbandon:
+		return true
+	}
+	return false
+}
+
+// requestedProject returns the project of the spec or the project of the adopted service account,
+// empty if the project is not known before the service account is reconciled
+func requestedProject(spec *gcpv1beta1.GcpServiceAccountSpec) string {
+	if spec.Project != "" {
+		return spec.Project
+	}
+	return serviceAccountEmailProject(spec.ExistingServiceAccountEmail)
+}
+
+// serviceAccountEmailProject returns the project of a user managed service account email,
+// empty for emails of other service accounts, e.g. the default service accounts of gcp
+func serviceAccountEmailProject(email string) string {
+	m := serviceAccountEmailPattern.FindStringSubmatch(email)
+	if m == nil {
+		return ""
+	}
+	domain := userManagedServiceAccountDomain.FindStringSubmatch(m[1])
+	if domain == nil {
+		return ""
+	}
+	return domain[1]
+}
+
+// normalizeServiceAccountIdentifier lower cases the identifier and replaces all characters
+// which are not allowed in a gcp service account id
+func normalizeServiceAccountIdentifier(identifier string) string {
+	identifier = invalidServiceAccountIdentifierChars.ReplaceAllString(strings.ToLower(identifier), "-")
+	return strings.Trim(identifier, "-")
+}
+
+// canonicalResourceName returns the relative resource name if it identifies the same resource
+// as the given name, otherwise the full resource name
+func canonicalResourceName(resource string) (string, error) {
+	iamResources := iamutil.GetEnabledResources()
+	parsed, err := iamResources.Parse(resource)
+	if err != nil {
+		return "", err
+	}
+	relativeId := parsed.GetRelativeId()
+	var tokens []string
+	for _, collection := range relativeId.OrderedCollectionIds {
+		tokens = append(tokens, collection, relativeId.IdTuples[collection])
+	}
+	relativeName := strings.Join(tokens, "/")
+
+	if relative, err := iamResources.Parse(relativeName); err == nil && relative.GetConfig().Service == parsed.GetConfig().Service {
+		return relativeName, nil
+	}
+	return fmt.Sprintf("//%s.googleapis.com/%s", parsed.GetConfig().Service, relativeName), nil
+}
+
+// GcpServiceAccountValidator rejects invalid GcpServiceAccounts and GcpServiceAccounts with bindings
+// which are not allowed by the GcpNamespaceRestriction of their namespace
+type GcpServiceAccountValidator struct {
+	log                 logr.Logger
+	client              client.Client
+	restrictionService  *RestrictionService
+	disableRestrictions bool
+	decoder             *admission.Decoder
+}
+
+func NewGcpServiceAccountValidator(client client.Client, restrictionService *RestrictionService, disableRestrictions bool) *GcpServiceAccountValidator {
+	return &GcpServiceAccountValidator{
+		log:                 logf.Log.WithName("gcpserviceaccountvalidator"),
+		client:              client,
+		restrictionService:  restrictionService,
+		disableRestrictions: disableRestrictions}
+}
+
+func (v *GcpServiceAccountValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	instance := &gcpv1beta1.GcpServiceAccount{}
+	if err := v.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// the finalizer has to be removable even if the restriction changed in the meantime
+	if !instance.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+	namespace := instance.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+
+	problems := validateGcpServiceAccountSpec(&instance.Spec)
+	specChanged := true
+	if len(req.OldObject.Raw) > 0 {
+		old := &gcpv1beta1.GcpServiceAccount{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if old.Status.Project != "" && instance.Spec.Project != "" && instance.Spec.Project != old.Status.Project {
+			problems = append(problems, fmt.Sprintf("project can not be changed, the service account exists in project %s", old.Status.Project))
+		}
+		if old.Status.ServiceAccountMail != "" && instance.Spec.ExistingServiceAccountEmail != old.Spec.ExistingServiceAccountEmail {
+			problems = append(problems, fmt.Sprintf("existingServiceAccountEmail can not be changed, the GcpServiceAccount manages %s", old.Status.ServiceAccountMail))
+		}
+		specChanged = !equality.Semantic.DeepEqual(old.Spec, instance.Spec)
+	}
+	if len(problems) > 0 {
+		return admission.Denied(fmt.Sprintf("invalid gcp service account: %s", strings.Join(problems, "; ")))
+	}
+	// updates of the metadata, e.g. of the finalizer by the controller, are not checked against tightened
+	// restrictions, the controller enforces them on the service account instead
+	if v.disableRestrictions || !specChanged {
+		return admission.Allowed("")
+	}
+
+	bindings, err := v.customRoleBindings(ctx, namespace, instance.Spec.GcpRoleBindings)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	violations, err := v.restrictionService.Violations(namespace, bindings)
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+	if project := requestedProject(&instance.Spec); project != "" {
+		projectAllowed, err := v.restrictionService.CheckProjectAllowed(namespace, project)
+		if err != nil {
+			return admission.Denied(err.Error())
+		}
+		if !projectAllowed {
+			violations = append(violations, fmt.Sprintf("project %s is not allowed", project))
+		}
+	}
+	quotaViolations, err := v.restrictionService.CheckQuota(namespace, gcpv1beta1.QuotaUsage{BindingsPerAccount: countRoleBindings(instance.Spec.GcpRoleBindings)})
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+	violations = append(violations, quotaViolations...)
+	if len(violations) > 0 {
+		v.log.Info("rejected gcp service account", "namespace", namespace, "name", instance.Name, "violations", violations)
+		restrictionDenials.WithLabelValues(namespace).Inc()
+		return admission.Denied(fmt.Sprintf("namespace %s is not allowed to use the requested bindings: %s", namespace, strings.Join(violations, "; ")))
+	}
+	return admission.Allowed("")
+}
+
+// customRoleBindings returns the bindings with the names of the referenced GcpCustomRoles added to the roles like
+// resolveRoleBindings adds them. The name of a role which is not created yet is derived from its spec, roles which
+// do not exist yet or whose project is only known once they are reconciled are checked by the reconciler.
+func (v *GcpServiceAccountValidator) customRoleBindings(ctx context.Context, namespace string, bindings []gcpv1beta1.GcpRoleBindings) ([]gcpv1beta1.GcpRoleBindings, error) {
+	var resolved []gcpv1beta1.GcpRoleBindings
+	for _, binding := range bindings {
+		binding.Roles = append([]string(nil), binding.Roles...)
+		for _, name := range binding.CustomRoles {
+			customRole := &gcpv1beta1.GcpCustomRole{}
+			if err := v.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, customRole); err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				return nil, errwrap.Wrapf(fmt.Sprintf("unable to get custom role %s: {{err}}", name), err)
+			}
+			roleName := customRole.Status.RoleName
+			if roleName == "" {
+				project := customRole.Spec.Project
+				if project == "" {
+					defaultProject, err := v.restrictionService.DefaultProject(namespace)
+					if err != nil {
+						return nil, err
+					}
+					project = defaultProject
+				}
+				if project == "" {
+					continue
+				}
+				roleName = fmt.Sprintf("projects/%s/roles/%s", project, customRoleId(customRole))
+			}
+			if !containsString(binding.Roles, roleName) {
+				binding.Roles = append(binding.Roles, roleName)
+			}
+		}
+		binding.CustomRoles = nil
+		resolved = append(resolved, binding)
+	}
+	return resolved, nil
+}
+
+func (v *GcpServiceAccountValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+// newTestValidator returns a GcpServiceAccountValidator with the restrictions for every namespace and the objects
+// in a fake api server
+func newTestValidator(t *testing.T, restrictions []gcpv1beta1.GcpNamespaceRestriction, objects ...runtime.Object) *GcpServiceAccountValidator {
+	scheme := runtime.NewScheme()
+	if err := gcpv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	validator := NewGcpServiceAccountValidator(fake.NewFakeClientWithScheme(scheme, objects...),
+		NewRestrictionService(&staticRestrictionResolveService{restrictions: restrictions}), false)
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+	return validator
+}
+
+// newTestAdmissionRequest returns the request of the operation, old is only sent for updates
+func newTestAdmissionRequest(t *testing.T, operation admissionv1beta1.Operation, instance *gcpv1beta1.GcpServiceAccount, old *gcpv1beta1.GcpServiceAccount) admission.Request {
+	request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Operation: operation, Namespace: instance.Namespace}}
+	raw, err := json.Marshal(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Object.Raw = raw
+	if old != nil {
+		if request.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return request
+}
+
+func TestValidateCustomRoles(t *testing.T) {
+	restriction := newTestRestriction(true,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "^projects/team-project$", Roles: []string{"^roles/viewer$", "^projects/team-project/roles/reader$"}})
+	restriction.Spec.DefaultProject = "team-project"
+	created := &gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: "default"}}
+	created.Status.RoleName = "projects/team-project/roles/admin"
+	pending := &gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "pending-admin", Namespace: "default"}}
+	pending.Spec.RoleId = "pending_admin"
+	reader := &gcpv1beta1.GcpCustomRole{ObjectMeta: metav1.ObjectMeta{Name: "reader", Namespace: "default"}}
+	reader.Spec.RoleId = "reader"
+	validator := newTestValidator(t, []gcpv1beta1.GcpNamespaceRestriction{*restriction}, created, pending, reader)
+
+	tests := []struct {
+		customRole string
+		allowed    bool
+	}{
+		{"admin", false},
+		{"pending-admin", false},
+		{"reader", true},
+		// a role which does not exist yet is checked by the reconciler
+		{"missing", true},
+	}
+	for _, test := range tests {
+		instance := newTestGcpServiceAccount("app", "000000000001")
+		instance.Spec.SecretName = "app-credentials"
+		instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: "projects/team-project", Roles: []string{"roles/viewer"}, CustomRoles: []string{test.customRole}}}
+		response := validator.Handle(context.TODO(), newTestAdmissionRequest(t, admissionv1beta1.Create, instance, nil))
+		if response.Allowed != test.allowed {
+			t.Errorf("expected custom role %s allowed %v, got %v (%s)", test.customRole, test.allowed, response.Allowed, response.Result.Reason)
+		}
+	}
+}
+
+func TestValidateUnchangedSpec(t *testing.T) {
+	restriction := newTestRestriction(false, gcpv1beta1.GcpRestrictionRoleBinding{Resource: "projects/team-project", Roles: []string{"roles/viewer"}})
+	old := newTestGcpServiceAccount("app", "000000000001")
+	old.Spec.SecretName = "app-credentials"
+	old.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: "projects/team-project", Roles: []string{"roles/editor"}}}
+
+	for _, restrictions := range [][]gcpv1beta1.GcpNamespaceRestriction{{*restriction}, nil} {
+		validator := newTestValidator(t, restrictions)
+		if response := validator.Handle(context.TODO(), newTestAdmissionRequest(t, admissionv1beta1.Create, old, nil)); response.Allowed {
+			t.Errorf("expected the creation to be denied with restrictions %v", restrictions)
+		}
+
+		// the controller adds its finalizer after the restriction was tightened or removed
+		finalized := old.DeepCopy()
+		finalized.Finalizers = []string{iamKiwigridFinalizerName}
+		if response := validator.Handle(context.TODO(), newTestAdmissionRequest(t, admissionv1beta1.Update, finalized, old)); !response.Allowed {
+			t.Errorf("expected an update of the metadata to be allowed, got %s", response.Result.Reason)
+		}
+
+		changed := finalized.DeepCopy()
+		changed.Spec.GcpRoleBindings[0].Roles = []string{"roles/editor", "roles/owner"}
+		if response := validator.Handle(context.TODO(), newTestAdmissionRequest(t, admissionv1beta1.Update, changed, finalized)); response.Allowed {
+			t.Errorf("expected a changed spec to be checked with restrictions %v", restrictions)
+		}
+	}
+}
+
+func TestDefaultGcpServiceAccount(t *testing.T) {
+	longName := strings.Repeat("a", serviceAccountDescMaxLen)
+	tests := []struct {
+		name     string
+		edit     func(instance *gcpv1beta1.GcpServiceAccount)
+		expected func(spec *gcpv1beta1.GcpServiceAccountSpec)
+	}{
+		{"empty", func(instance *gcpv1beta1.GcpServiceAccount) {}, func(spec *gcpv1beta1.GcpServiceAccountSpec) {
+			spec.Mode = gcpv1beta1.ModeKey
+			spec.SecretKey = defaultSecretKey
+			spec.ServiceAccountDescription = "default/test"
+		}},
+		{"explicit values", func(instance *gcpv1beta1.GcpServiceAccount) {
+			instance.Spec.SecretKey = "key.json"
+			instance.Spec.ServiceAccountDescription = "my app"
+		}, func(spec *gcpv1beta1.GcpServiceAccountSpec) {
+			spec.Mode = gcpv1beta1.ModeKey
+			spec.SecretKey = "key.json"
+			spec.ServiceAccountDescription = "my app"
+		}},
+		// the secret key is only used in Key mode
+		{"workload identity", func(instance *gcpv1beta1.GcpServiceAccount) {
+			instance.Spec.Mode = gcpv1beta1.ModeWorkloadIdentity
+		}, func(spec *gcpv1beta1.GcpServiceAccountSpec) {
+			spec.Mode = gcpv1beta1.ModeWorkloadIdentity
+			spec.ServiceAccountDescription = "default/test"
+		}},
+		{"generated name", func(instance *gcpv1beta1.GcpServiceAccount) {
+			instance.Name = ""
+			instance.GenerateName = "test-"
+		}, func(spec *gcpv1beta1.GcpServiceAccountSpec) {
+			spec.Mode = gcpv1beta1.ModeKey
+			spec.SecretKey = defaultSecretKey
+			spec.ServiceAccountDescription = "default/test-"
+		}},
+		{"long description", func(instance *gcpv1beta1.GcpServiceAccount) {
+			instance.Name = longName
+		}, func(spec *gcpv1beta1.GcpServiceAccountSpec) {
+			spec.Mode = gcpv1beta1.ModeKey
+			spec.SecretKey = defaultSecretKey
+			spec.ServiceAccountDescription = ("default/" + longName)[:serviceAccountDescMaxLen]
+		}},
+		{"identifier", func(instance *gcpv1beta1.GcpServiceAccount) {
+			instance.Spec.ServiceAccountIdentifier = "-My_App.Frontend-"
+		}, func(spec *gcpv1beta1.GcpServiceAccountSpec) {
+			spec.Mode = gcpv1beta1.ModeKey
+			spec.SecretKey = defaultSecretKey
+			spec.ServiceAccountDescription = "default/test"
+			spec.ServiceAccountIdentifier = "my-app-frontend"
+		}},
+	}
+	for _, test := range tests {
+		instance := newTestGcpServiceAccount("", "000000000001")
+		test.edit(instance)
+		expected := gcpv1beta1.GcpServiceAccountSpec{}
+		test.expected(&expected)
+		defaultGcpServiceAccount(instance)
+		if !reflect.DeepEqual(instance.Spec, expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, expected, instance.Spec)
+		}
+		// defaulting twice changes nothing
+		defaulted := instance.DeepCopy()
+		defaultGcpServiceAccount(defaulted)
+		if !reflect.DeepEqual(defaulted.Spec, instance.Spec) {
+			t.Errorf("%s: expected the defaults to be stable, got %+v", test.name, defaulted.Spec)
+		}
+	}
+}
+
+func TestCanonicalResourceName(t *testing.T) {
+	tests := []struct {
+		spellings []string
+		canonical string
+	}{
+		{[]string{"projects/team-project", "//cloudresourcemanager.googleapis.com/projects/team-project",
+			"https://cloudresourcemanager.googleapis.com/v1/projects/team-project"}, "projects/team-project"},
+		{[]string{"buckets/my-bucket", "//storage.googleapis.com/buckets/my-bucket"}, "buckets/my-bucket"},
+		{[]string{"projects/team-project/topics/events", "//pubsub.googleapis.com/projects/team-project/topics/events"}, "projects/team-project/topics/events"},
+		// the relative name of an instance is ambiguous, the full name is kept
+		{[]string{"//spanner.googleapis.com/projects/team-project/instances/db"}, "//spanner.googleapis.com/projects/team-project/instances/db"},
+	}
+	for _, test := range tests {
+		for _, spelling := range test.spellings {
+			canonical, err := canonicalResourceName(spelling)
+			if err != nil || canonical != test.canonical {
+				t.Errorf("expected %s for %s, got %s (%v)", test.canonical, spelling, canonical, err)
+			}
+		}
+	}
+	if _, err := canonicalResourceName("unknown/thing"); err == nil {
+		t.Error("expected an error for an unknown resource type")
+	}
+
+	// unparsable resources are left to the reconciler
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{
+		{Resource: "//storage.googleapis.com/buckets/my-bucket", Roles: []string{"roles/storage.objectViewer"}},
+		{Resource: "unknown/thing", Roles: []string{"roles/viewer"}},
+	}
+	defaultGcpServiceAccount(instance)
+	if resources := []string{instance.Spec.GcpRoleBindings[0].Resource, instance.Spec.GcpRoleBindings[1].Resource}; !reflect.DeepEqual(resources, []string{"buckets/my-bucket", "unknown/thing"}) {
+		t.Errorf("expected the canonical resources, got %v", resources)
+	}
+}
+
+func TestGcpServiceAccountDefaulter(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := gcpv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	defaulter := NewGcpServiceAccountDefaulter()
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := defaulter.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	instance := newTestGcpServiceAccount("My App", "000000000001")
+	instance.Namespace = ""
+	instance.Spec.GcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: "//cloudresourcemanager.googleapis.com/projects/team-project", Roles: []string{"roles/viewer"}}}
+	request := newTestAdmissionRequest(t, admissionv1beta1.Create, instance, nil)
+	request.Namespace = "team"
+	response := defaulter.Handle(context.TODO(), request)
+	if !response.Allowed {
+		t.Fatalf("expected the defaults to be allowed, got %s", response.Result.Reason)
+	}
+	patches := map[string]interface{}{}
+	for _, patch := range response.Patches {
+		patches[patch.Path] = patch.Value
+	}
+	expected := map[string]interface{}{
+		"/spec/mode":                      string(gcpv1beta1.ModeKey),
+		"/spec/secretKey":                 defaultSecretKey,
+		"/spec/serviceAccountDescription": "team/test",
+		"/spec/serviceAccountIdentifier":  "my-app",
+		"/spec/bindings/0/resource":       "projects/team-project",
+	}
+	for path, value := range expected {
+		if patches[path] != value {
+			t.Errorf("expected %s to be patched to %v, got %v", path, value, patches[path])
+		}
+	}
+}
+
+func TestValidateKeyRotation(t *testing.T) {
+	hours := func(hours int) metav1.Duration {
+		return metav1.Duration{Duration: time.Duration(hours) * time.Hour}
+	}
+	tests := []struct {
+		rotation gcpv1beta1.GcpKeyRotation
+		problem  string
+	}{
+		{gcpv1beta1.GcpKeyRotation{MaxAge: hours(10)}, ""},
+		{gcpv1beta1.GcpKeyRotation{MaxAge: hours(10), Overlap: hours(5)}, ""},
+		{gcpv1beta1.GcpKeyRotation{}, "keyRotation.maxAge must be positive"},
+		{gcpv1beta1.GcpKeyRotation{MaxAge: hours(10), Overlap: hours(-1)}, "keyRotation.overlap must be non-negative and at most half of keyRotation.maxAge"},
+		// the key would be rotated again before the previous key is deleted
+		{gcpv1beta1.GcpKeyRotation{MaxAge: hours(10), Overlap: hours(6)}, "keyRotation.overlap must be non-negative and at most half of keyRotation.maxAge"},
+	}
+	for _, test := range tests {
+		spec := gcpv1beta1.GcpServiceAccountSpec{SecretName: "app-credentials", KeyRotation: &test.rotation}
+		problems := validateGcpServiceAccountSpec(&spec)
+		if test.problem == "" && len(problems) > 0 || test.problem != "" && !reflect.DeepEqual(problems, []string{test.problem}) {
+			t.Errorf("expected problem %q for %+v, got %v", test.problem, test.rotation, problems)
+		}
+	}
+}
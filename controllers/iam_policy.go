@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+// conditionalPolicyVersion is the iam policy version which supports conditions
+const conditionalPolicyVersion = 3
+
+// roleGrant is a role with an optional condition, a member is bound to each grant separately
+type roleGrant struct {
+	Role      string
+	Condition *iamutil.Condition
+}
+
+func (g roleGrant) String() string {
+	if g.Condition == nil {
+		return g.Role
+	}
+	return fmt.Sprintf("%s (%s)", g.Role, g.Condition.Title)
+}
+
+func (g roleGrant) equals(other roleGrant) bool {
+	return g.Role == other.Role && sameCondition(g.Condition, other.Condition)
+}
+
+// conditionTitle returns the title of the condition, empty if there is no condition
+func (g roleGrant) conditionTitle() string {
+	if g.Condition == nil {
+		return ""
+	}
+	return g.Condition.Title
+}
+
+// sameCondition compares conditions like iam does, by title, description and expression
+func sameCondition(a *iamutil.Condition, b *iamutil.Condition) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// bindingCondition renders the iam condition of the binding, an expiry is added to the expression of the condition
+func bindingCondition(binding gcpv1beta1.GcpRoleBindings) *iamutil.Condition {
+	if binding.Condition == nil && binding.ExpiresAt == nil {
+		return nil
+	}
+	var expiry string
+	if binding.ExpiresAt != nil {
+		expiry = fmt.Sprintf(`request.time < timestamp("%s")`, binding.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if binding.Condition == nil {
+		return &iamutil.Condition{
+			Title:      fmt.Sprintf("expires %s", binding.ExpiresAt.UTC().Format(time.RFC3339)),
+			Expression: expiry,
+		}
+	}
+	condition := &iamutil.Condition{
+		Title:       binding.Condition.Title,
+		Description: binding.Condition.Description,
+		Expression:  binding.Condition.Expression,
+	}
+	if expiry != "" {
+		condition.Expression = fmt.Sprintf("(%s) && %s", condition.Expression, expiry)
+	}
+	return condition
+}
+
+// resourceKey returns the canonical name of the resource, so all spellings of a resource share one key.
+// Unparsable resources are used as they are.
+func resourceKey(resource string) string {
+	if canonical, err := canonicalResourceName(resource); err == nil {
+		return canonical
+	}
+	return resource
+}
+
+// canonicalBindings returns a copy of the bindings with the canonical resource names
+func canonicalBindings(bindings []gcpv1beta1.GcpRoleBindings) []gcpv1beta1.GcpRoleBindings {
+	var canonical []gcpv1beta1.GcpRoleBindings
+	for _, binding := range bindings {
+		binding.Resource = resourceKey(binding.Resource)
+		canonical = append(canonical, binding)
+	}
+	return canonical
+}
+
+// grantsOf returns the grants of the bindings on the resource, whatever name the bindings use for it
+func grantsOf(bindings []gcpv1beta1.GcpRoleBindings, resource string) []roleGrant {
+	key := resourceKey(resource)
+	var grants []roleGrant
+	for _, binding := range bindings {
+		if resourceKey(binding.Resource) != key {
+			continue
+		}
+		condition := bindingCondition(binding)
+		for _, role := range binding.Roles {
+			grants = addGrant(grants, roleGrant{Role: role, Condition: condition})
+		}
+	}
+	return grants
+}
+
+// desiredGrants returns the grants of the bindings on the resource which did not expire before now
+func desiredGrants(bindings []gcpv1beta1.GcpRoleBindings, resource string, now time.Time) []roleGrant {
+	var active []gcpv1beta1.GcpRoleBindings
+	for _, binding := range bindings {
+		if binding.ExpiresAt == nil || now.Before(binding.ExpiresAt.Time) {
+			active = append(active, binding)
+		}
+	}
+	return grantsOf(active, resource)
+}
+
+// memberGrants returns the grants of the member in the policy
+func memberGrants(policy *iamutil.Policy, member string) []roleGrant {
+	var grants []roleGrant
+	for _, binding := range policy.Bindings {
+		if containsString(binding.Members, member) {
+			grants = addGrant(grants, roleGrant{Role: binding.Role, Condition: binding.Condition})
+		}
+	}
+	return grants
+}
+
+func containsGrant(grants []roleGrant, grant roleGrant) bool {
+	for _, g := range grants {
+		if g.equals(grant) {
+			return true
+		}
+	}
+	return false
+}
+
+func addGrant(grants []roleGrant, grant roleGrant) []roleGrant {
+	if containsGrant(grants, grant) {
+		return grants
+	}
+	return append(grants, grant)
+}
+
+// withoutGrants returns the grants which are not in excluded
+func withoutGrants(grants []roleGrant, excluded []roleGrant) []roleGrant {
+	var remaining []roleGrant
+	for _, grant := range grants {
+		if !containsGrant(excluded, grant) {
+			remaining = append(remaining, grant)
+		}
+	}
+	return remaining
+}
+
+// sameGrants returns if both contain the same grants in any order
+func sameGrants(a []roleGrant, b []roleGrant) bool {
+	return len(withoutGrants(a, b)) == 0 && len(withoutGrants(b, a)) == 0
+}
+
+// addBindingGrant returns the bindings with the grant added on the resource
+func addBindingGrant(bindings []gcpv1beta1.GcpRoleBindings, resource string, grant roleGrant) []gcpv1beta1.GcpRoleBindings {
+	resource = resourceKey(resource)
+	for i, b := range bindings {
+		if resourceKey(b.Resource) == resource && sameCondition(bindingCondition(b), grant.Condition) {
+			if !containsString(b.Roles, grant.Role) {
+				bindings[i].Roles = append(bindings[i].Roles, grant.Role)
+			}
+			return bindings
+		}
+	}
+	binding := gcpv1beta1.GcpRoleBindings{Resource: resource, Roles: []string{grant.Role}}
+	if grant.Condition != nil {
+		binding.Condition = &gcpv1beta1.GcpRoleBindingCondition{
+			Title:       grant.Condition.Title,
+			Description: grant.Condition.Description,
+			Expression:  grant.Condition.Expression,
+		}
+	}
+	return append(bindings, binding)
+}
+
+// changePolicyGrants returns a copy of the policy with the member added to and removed from the bindings of the
+// grants. Unlike iamutil.Policy.ChangedBindings it matches bindings by role and condition and keeps the conditions
+// of all bindings.
+func changePolicyGrants(policy *iamutil.Policy, member string, toAdd []roleGrant, toRemove []roleGrant) *iamutil.Policy {
+	updated := &iamutil.Policy{Etag: policy.Etag, Version: policy.Version}
+	for _, binding := range policy.Bindings {
+		members := append([]string(nil), binding.Members...)
+		if containsGrant(toRemove, roleGrant{Role: binding.Role, Condition: binding.Condition}) {
+			members = removeString(members, member)
+		}
+		if len(members) == 0 {
+			continue
+		}
+		updated.Bindings = append(updated.Bindings, &iamutil.Binding{Role: binding.Role, Members: members, Condition: binding.Condition})
+	}
+
+	for _, grant := range toAdd {
+		var target *iamutil.Binding
+		for _, binding := range updated.Bindings {
+			if binding.Role == grant.Role && sameCondition(binding.Condition, grant.Condition) {
+				target = binding
+				break
+			}
+		}
+		if target == nil {
+			target = &iamutil.Binding{Role: grant.Role, Condition: grant.Condition}
+			updated.Bindings = append(updated.Bindings, target)
+		}
+		if !containsString(target.Members, member) {
+			target.Members = append(target.Members, member)
+		}
+	}
+
+	for _, binding := range updated.Bindings {
+		if binding.Condition != nil {
+			updated.Version = conditionalPolicyVersion
+			break
+		}
+	}
+	return updated
+}
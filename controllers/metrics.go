@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/iam/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "gcp_serviceaccount_controller"
+
+// names of the gcp api methods in the metrics
+const (
+	gcpMethodGetServiceAccount    = "serviceAccounts.get"
+	gcpMethodCreateServiceAccount = "serviceAccounts.create"
+	gcpMethodDeleteServiceAccount = "serviceAccounts.delete"
+	gcpMethodGetKey               = "keys.get"
+	gcpMethodListKeys             = "keys.list"
+	gcpMethodCreateKey            = "keys.create"
+	gcpMethodDeleteKey            = "keys.delete"
+	gcpMethodGetIamPolicy         = "getIamPolicy"
+	gcpMethodSetIamPolicy         = "setIamPolicy"
+	gcpMethodGetRole              = "roles.get"
+	gcpMethodCreateRole           = "roles.create"
+	gcpMethodUpdateRole           = "roles.patch"
+	gcpMethodDeleteRole           = "roles.delete"
+	gcpMethodUndeleteRole         = "roles.undelete"
+)
+
+var (
+	gcpApiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gcp_api_requests_total",
+		Help:      "Number of requests to the gcp apis per method.",
+	}, []string{"method"})
+	gcpApiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gcp_api_errors_total",
+		Help:      "Number of failed requests to the gcp apis per method and http status code, 0 if there was no response.",
+	}, []string{"method", "code"})
+	gcpApiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "gcp_api_request_duration_seconds",
+		Help:      "Duration of the requests to the gcp apis per method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	restrictionDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restriction_denials_total",
+		Help:      "Number of GcpServiceAccounts denied by the namespace restriction per namespace.",
+	}, []string{"namespace"})
+	roleBindingsApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "role_bindings_applied_total",
+		Help:      "Number of role bindings added to or removed from iam policies.",
+	}, []string{"operation"})
+	driftFindings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_findings_total",
+		Help:      "Number of deviations from the applied state which were detected and repaired per drift type.",
+	}, []string{"type"})
+
+	serviceAccountMetrics = newServiceAccountCollector()
+)
+
+func init() {
+	metrics.Registry.MustRegister(gcpApiRequests, gcpApiErrors, gcpApiDuration, restrictionDenials, roleBindingsApplied, driftFindings, serviceAccountMetrics)
+}
+
+// serviceAccountCollector reports the managed service accounts and the age of their keys at the time of the scrape
+type serviceAccountCollector struct {
+	mu       sync.Mutex
+	accounts map[types.NamespacedName]time.Time
+	now      func() time.Time
+
+	managedDesc *prometheus.Desc
+	keyAgeDesc  *prometheus.Desc
+}
+
+func newServiceAccountCollector() *serviceAccountCollector {
+	return &serviceAccountCollector{
+		accounts: map[types.NamespacedName]time.Time{},
+		now:      time.Now,
+		managedDesc: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "managed_service_accounts"),
+			"Number of gcp service accounts managed by the controller.", nil, nil),
+		keyAgeDesc: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "service_account_key_age_seconds"),
+			"Age of the current key of the gcp service account.", []string{"namespace", "name"}, nil),
+	}
+}
+
+// track records the service account as managed, the key age is reported if a key was issued
+func (c *serviceAccountCollector) track(instance *gcpv1beta1.GcpServiceAccount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keyCreated time.Time
+	if instance.Status.CredentialKey != "" && instance.Status.CredentialKeyCreationTime != nil {
+		keyCreated = instance.Status.CredentialKeyCreationTime.Time
+	}
+	c.accounts[types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}] = keyCreated
+}
+
+func (c *serviceAccountCollector) forget(name types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.accounts, name)
+}
+
+func (c *serviceAccountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.managedDesc
+	ch <- c.keyAgeDesc
+}
+
+func (c *serviceAccountCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	ch <- prometheus.MustNewConstMetric(c.managedDesc, prometheus.GaugeValue, float64(len(c.accounts)))
+	for name, keyCreated := range c.accounts {
+		if keyCreated.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.keyAgeDesc, prometheus.GaugeValue, now.Sub(keyCreated).Seconds(), name.Namespace, name.Name)
+	}
+}
+
+// instrumentedGcpService counts and times the requests to the gcp apis
+type instrumentedGcpService struct {
+	service GcpService
+}
+
+// NewInstrumentedGcpService returns a GcpService which records metrics of all requests of the service
+func NewInstrumentedGcpService(service GcpService) GcpService {
+	return &instrumentedGcpService{service: service}
+}
+
+// observe records a request of the method which started at start and failed with err if it is not nil
+func observe(method string, start time.Time, err error) {
+	gcpApiRequests.WithLabelValues(method).Inc()
+	gcpApiDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		gcpApiErrors.WithLabelValues(method, strconv.Itoa(googleApiErrorCode(err))).Inc()
+	}
+}
+
+func (s *instrumentedGcpService) DefaultProject() (string, error) {
+	return s.service.DefaultProject()
+}
+
+func (s *instrumentedGcpService) GetServiceAccount(path string) (*iam.ServiceAccount, error) {
+	start := time.Now()
+	account, err := s.service.GetServiceAccount(path)
+	observe(gcpMethodGetServiceAccount, start, err)
+	return account, err
+}
+
+func (s *instrumentedGcpService) CreateServiceAccount(project string, accountId string, displayName string, description string) (*iam.ServiceAccount, error) {
+	start := time.Now()
+	account, err := s.service.CreateServiceAccount(project, accountId, displayName, description)
+	observe(gcpMethodCreateServiceAccount, start, err)
+	return account, err
+}
+
+func (s *instrumentedGcpService) DeleteServiceAccount(path string) error {
+	start := time.Now()
+	err := s.service.DeleteServiceAccount(path)
+	observe(gcpMethodDeleteServiceAccount, start, err)
+	return err
+}
+
+func (s *instrumentedGcpService) GetServiceAccountKey(name string) (*iam.ServiceAccountKey, error) {
+	start := time.Now()
+	key, err := s.service.GetServiceAccountKey(name)
+	observe(gcpMethodGetKey, start, err)
+	return key, err
+}
+
+func (s *instrumentedGcpService) ListServiceAccountKeys(path string) ([]*iam.ServiceAccountKey, error) {
+	start := time.Now()
+	keys, err := s.service.ListServiceAccountKeys(path)
+	observe(gcpMethodListKeys, start, err)
+	return keys, err
+}
+
+func (s *instrumentedGcpService) CreateServiceAccountKey(path string) (*iam.ServiceAccountKey, error) {
+	start := time.Now()
+	key, err := s.service.CreateServiceAccountKey(path)
+	observe(gcpMethodCreateKey, start, err)
+	return key, err
+}
+
+func (s *instrumentedGcpService) DeleteServiceAccountKey(name string) error {
+	start := time.Now()
+	err := s.service.DeleteServiceAccountKey(name)
+	observe(gcpMethodDeleteKey, start, err)
+	return err
+}
+
+func (s *instrumentedGcpService) GetIamPolicy(resource string) (*iamutil.Policy, error) {
+	start := time.Now()
+	policy, err := s.service.GetIamPolicy(resource)
+	observe(gcpMethodGetIamPolicy, start, err)
+	return policy, err
+}
+
+func (s *instrumentedGcpService) SetIamPolicy(resource string, policy *iamutil.Policy) (*iamutil.Policy, error) {
+	start := time.Now()
+	updated, err := s.service.SetIamPolicy(resource, policy)
+	observe(gcpMethodSetIamPolicy, start, err)
+	return updated, err
+}
+
+func (s *instrumentedGcpService) GetRole(name string) (*iam.Role, error) {
+	start := time.Now()
+	role, err := s.service.GetRole(name)
+	observe(gcpMethodGetRole, start, err)
+	return role, err
+}
+
+func (s *instrumentedGcpService) CreateRole(project string, roleId string, role *iam.Role) (*iam.Role, error) {
+	start := time.Now()
+	created, err := s.service.CreateRole(project, roleId, role)
+	observe(gcpMethodCreateRole, start, err)
+	return created, err
+}
+
+func (s *instrumentedGcpService) UpdateRole(name string, role *iam.Role) (*iam.Role, error) {
+	start := time.Now()
+	updated, err := s.service.UpdateRole(name, role)
+	observe(gcpMethodUpdateRole, start, err)
+	return updated, err
+}
+
+func (s *instrumentedGcpService) DeleteRole(name string) error {
+	start := time.Now()
+	err := s.service.DeleteRole(name)
+	observe(gcpMethodDeleteRole, start, err)
+	return err
+}
+
+func (s *instrumentedGcpService) UndeleteRole(name string) (*iam.Role, error) {
+	start := time.Now()
+	role, err := s.service.UndeleteRole(name)
+	observe(gcpMethodUndeleteRole, start, err)
+	return role, err
+}
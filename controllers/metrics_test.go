@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpfake"
+)
+
+func TestServiceAccountCollector(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	collector := newServiceAccountCollector()
+	collector.now = func() time.Time { return now }
+
+	keyCreated := metav1.NewTime(now.Add(-time.Hour))
+	withKey := &gcpv1beta1.GcpServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "with-key", Namespace: "team-a"}}
+	withKey.Status.CredentialKey = "projects/p/serviceAccounts/a@p.iam.gserviceaccount.com/keys/1"
+	withKey.Status.CredentialKeyCreationTime = &keyCreated
+	withoutKey := &gcpv1beta1.GcpServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "without-key", Namespace: "team-a"}}
+	forgotten := &gcpv1beta1.GcpServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "forgotten", Namespace: "team-b"}}
+	collector.track(withKey)
+	collector.track(withoutKey)
+	collector.track(forgotten)
+	collector.forget(types.NamespacedName{Name: "forgotten", Namespace: "team-b"})
+
+	expected := `
+# HELP gcp_serviceaccount_controller_managed_service_accounts Number of gcp service accounts managed by the controller.
+# TYPE gcp_serviceaccount_controller_managed_service_accounts gauge
+gcp_serviceaccount_controller_managed_service_accounts 2
+# HELP gcp_serviceaccount_controller_service_account_key_age_seconds Age of the current key of the gcp service account.
+# TYPE gcp_serviceaccount_controller_service_account_key_age_seconds gauge
+gcp_serviceaccount_controller_service_account_key_age_seconds{name="with-key",namespace="team-a"} 3600
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInstrumentedGcpService(t *testing.T) {
+	fake := gcpfake.NewGcpService("test-project")
+	service := NewInstrumentedGcpService(fake)
+	requests := testutil.ToFloat64(gcpApiRequests.WithLabelValues(gcpMethodCreateServiceAccount))
+	errors := testutil.ToFloat64(gcpApiErrors.WithLabelValues(gcpMethodCreateServiceAccount, "503"))
+
+	fake.InjectErrorTimes(gcpfake.MethodCreateServiceAccount, &googleapi.Error{Code: http.StatusServiceUnavailable}, 1)
+	if _, err := service.CreateServiceAccount("", "kube-metrics", "default/metrics", ""); err == nil {
+		t.Fatal("expected the injected error")
+	}
+	if _, err := service.CreateServiceAccount("", "kube-metrics", "default/metrics", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(gcpApiRequests.WithLabelValues(gcpMethodCreateServiceAccount)) - requests; got != 2 {
+		t.Errorf("expected 2 requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(gcpApiErrors.WithLabelValues(gcpMethodCreateServiceAccount, "503")) - errors; got != 1 {
+		t.Errorf("expected 1 error, got %v", got)
+	}
+}
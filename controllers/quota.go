@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+// QuotaExceededError is returned if a GcpServiceAccount would exceed the quota of its namespace
+type QuotaExceededError struct {
+	Namespace  string
+	Violations []string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota of namespace %s exceeded: %s", e.Namespace, strings.Join(e.Violations, "; "))
+}
+
+// IsQuotaExceeded returns true if the error reports an exceeded quota
+func IsQuotaExceeded(err error) bool {
+	_, ok := err.(*QuotaExceededError)
+	return ok
+}
+
+// CheckQuota returns the quota limits of the namespace the usage exceeds, usage which is zero is not checked
+func (r *RestrictionService) CheckQuota(namespace string, usage gcpv1beta1.QuotaUsage) ([]string, error) {
+	restrictions, err := r.resolveService.ResolveRestrictions(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return quotaViolations(mergedQuota(restrictions), usage), nil
+}
+
+// mergedQuota returns the lowest limits of the restrictions, nil if no restriction has a quota
+func mergedQuota(restrictions []gcpv1beta1.GcpNamespaceRestriction) *gcpv1beta1.GcpRestrictionQuota {
+	var merged *gcpv1beta1.GcpRestrictionQuota
+	for _, restriction := range restrictions {
+		quota := restriction.Spec.Quota
+		if quota == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &gcpv1beta1.GcpRestrictionQuota{}
+		}
+		merged.MaxServiceAccounts = lowerLimit(merged.MaxServiceAccounts, quota.MaxServiceAccounts)
+		merged.MaxBindingsPerAccount = lowerLimit(merged.MaxBindingsPerAccount, quota.MaxBindingsPerAccount)
+		merged.MaxKeys = lowerLimit(merged.MaxKeys, quota.MaxKeys)
+	}
+	return merged
+}
+
+func lowerLimit(current *int32, limit *int32) *int32 {
+	if limit == nil || (current != nil && *current <= *limit) {
+		return current
+	}
+	value := *limit
+	return &value
+}
+
+func quotaViolations(quota *gcpv1beta1.GcpRestrictionQuota, usage gcpv1beta1.QuotaUsage) []string {
+	if quota == nil {
+		return nil
+	}
+	var violations []string
+	if quota.MaxServiceAccounts != nil && usage.ServiceAccounts > 0 && usage.ServiceAccounts > *quota.MaxServiceAccounts {
+		violations = append(violations, fmt.Sprintf("%d service accounts exceed the quota of %d", usage.ServiceAccounts, *quota.MaxServiceAccounts))
+	}
+	if quota.MaxBindingsPerAccount != nil && usage.BindingsPerAccount > 0 && usage.BindingsPerAccount > *quota.MaxBindingsPerAccount {
+		violations = append(violations, fmt.Sprintf("%d role bindings exceed the quota of %d per service account", usage.BindingsPerAccount, *quota.MaxBindingsPerAccount))
+	}
+	if quota.MaxKeys != nil && usage.Keys > 0 && usage.Keys > *quota.MaxKeys {
+		violations = append(violations, fmt.Sprintf("%d keys exceed the quota of %d", usage.Keys, *quota.MaxKeys))
+	}
+	return violations
+}
+
+// quotaUsage returns the usage of the service accounts, only accounts with a gcp service account count
+func quotaUsage(accounts []gcpv1beta1.GcpServiceAccount) gcpv1beta1.QuotaUsage {
+	usage := gcpv1beta1.QuotaUsage{}
+	for i := range accounts {
+		account := &accounts[i]
+		if account.Status.ServiceAccountMail == "" {
+			continue
+		}
+		usage.ServiceAccounts++
+		usage.Keys += accountKeys(account)
+		if bindings := countRoleBindings(account.Status.AppliedGcpRoleBindings); bindings > usage.BindingsPerAccount {
+			usage.BindingsPerAccount = bindings
+		}
+	}
+	return usage
+}
+
+// accountKeys returns the number of keys the controller issued for the service account
+func accountKeys(account *gcpv1beta1.GcpServiceAccount) int32 {
+	var keys int32
+	if account.Status.CredentialKey != "" {
+		keys++
+	}
+	if account.Status.PreviousCredentialKey != "" {
+		keys++
+	}
+	return keys
+}
+
+// countRoleBindings returns the number of roles of the bindings, custom roles included
+func countRoleBindings(bindings []gcpv1beta1.GcpRoleBindings) int32 {
+	var count int32
+	for _, binding := range bindings {
+		count += int32(len(binding.Roles) + len(binding.CustomRoles))
+	}
+	return count
+}
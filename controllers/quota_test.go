@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+func int32Ptr(value int32) *int32 {
+	return &value
+}
+
+func TestMergedQuota(t *testing.T) {
+	team := newNamedTestRestriction("a-team", false)
+	team.Spec.Quota = &gcpv1beta1.GcpRestrictionQuota{MaxServiceAccounts: int32Ptr(10), MaxKeys: int32Ptr(4)}
+	platform := newNamedTestRestriction("b-platform", false)
+	platform.Spec.Quota = &gcpv1beta1.GcpRestrictionQuota{MaxServiceAccounts: int32Ptr(5), MaxBindingsPerAccount: int32Ptr(3)}
+	unlimited := newNamedTestRestriction("c-unlimited", false)
+
+	merged := mergedQuota([]gcpv1beta1.GcpNamespaceRestriction{*team, *platform, *unlimited})
+	expected := &gcpv1beta1.GcpRestrictionQuota{MaxServiceAccounts: int32Ptr(5), MaxBindingsPerAccount: int32Ptr(3), MaxKeys: int32Ptr(4)}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected the lowest limits %+v, got %+v", expected, merged)
+	}
+	if *team.Spec.Quota.MaxServiceAccounts != 10 {
+		t.Errorf("expected the quota of the restriction to be unchanged, got %d", *team.Spec.Quota.MaxServiceAccounts)
+	}
+	if quota := mergedQuota([]gcpv1beta1.GcpNamespaceRestriction{*unlimited}); quota != nil {
+		t.Errorf("expected no quota without limits, got %+v", quota)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	restriction := newTestRestriction(false)
+	restriction.Spec.Quota = &gcpv1beta1.GcpRestrictionQuota{MaxServiceAccounts: int32Ptr(2), MaxBindingsPerAccount: int32Ptr(3), MaxKeys: int32Ptr(0)}
+	service := NewRestrictionService(&staticRestrictionResolveService{restrictions: []gcpv1beta1.GcpNamespaceRestriction{*restriction}})
+
+	tests := []struct {
+		usage    gcpv1beta1.QuotaUsage
+		expected []string
+	}{
+		{gcpv1beta1.QuotaUsage{ServiceAccounts: 2, BindingsPerAccount: 3}, nil},
+		{gcpv1beta1.QuotaUsage{ServiceAccounts: 3, BindingsPerAccount: 4, Keys: 1}, []string{
+			"3 service accounts exceed the quota of 2",
+			"4 role bindings exceed the quota of 3 per service account",
+			"1 keys exceed the quota of 0",
+		}},
+	}
+	for _, test := range tests {
+		violations, err := service.CheckQuota("default", test.usage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(violations, test.expected) {
+			t.Errorf("expected violations %v for usage %+v, got %v", test.expected, test.usage, violations)
+		}
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	account := func(name string, mail string, key string, previousKey string, roles ...string) gcpv1beta1.GcpServiceAccount {
+		instance := gcpv1beta1.GcpServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		instance.Status.ServiceAccountMail = mail
+		instance.Status.CredentialKey = key
+		instance.Status.PreviousCredentialKey = previousKey
+		if len(roles) > 0 {
+			instance.Status.AppliedGcpRoleBindings = []gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: roles}}
+		}
+		return instance
+	}
+	usage := quotaUsage([]gcpv1beta1.GcpServiceAccount{
+		account("rotating", "rotating@team.iam.gserviceaccount.com", "key-2", "key-1", "roles/viewer"),
+		account("keyed", "keyed@team.iam.gserviceaccount.com", "key-3", "", "roles/viewer", "roles/pubsub.publisher"),
+		account("workload", "workload@team.iam.gserviceaccount.com", "", ""),
+		account("pending", "", "", "", "roles/viewer", "roles/editor", "roles/owner"),
+	})
+	expected := gcpv1beta1.QuotaUsage{ServiceAccounts: 3, BindingsPerAccount: 2, Keys: 3}
+	if usage != expected {
+		t.Errorf("expected usage %+v, got %+v", expected, usage)
+	}
+}
@@ -3,15 +3,23 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
 
 	"github.com/go-logr/logr"
 	"github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
 type RestrictionResolveService interface {
-	CheckNamespaceHasRights(namespace string) (*v1beta1.GcpNamespaceRestriction, error)
+	// ResolveRestrictions returns all GcpNamespaceRestrictions which apply to the namespace ordered by name
+	ResolveRestrictions(namespace string) ([]v1beta1.GcpNamespaceRestriction, error)
 }
 
 type RestrictionResolveServiceImpl struct {
@@ -27,15 +35,75 @@ func NewRestrictionResolveService(kubernetesClient client.Client) *RestrictionRe
 
 }
 
-func (r *RestrictionResolveServiceImpl) CheckNamespaceHasRights(namespace string) (*v1beta1.GcpNamespaceRestriction, error) {
+func (r *RestrictionResolveServiceImpl) ResolveRestrictions(namespace string) ([]v1beta1.GcpNamespaceRestriction, error) {
 	list := &v1beta1.GcpNamespaceRestrictionList{}
 	err := r.List(context.TODO(), list, &client.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
-	res := findItem(list.Items, namespace)
-	if res == nil {
-		return nil, fmt.Errorf("could not found GcpNamespaceRestriction for namespace %s", namespace)
+	ns := &corev1.Namespace{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: namespace}, ns); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		// a namespace which does not exist (anymore) is only matched by name
+		ns = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
 	}
-	return findItem(list.Items, namespace), nil
+	res := restrictionsForNamespace(list.Items, ns)
+	if len(res) == 0 {
+		return nil, &RestrictionNotFoundError{Namespace: namespace}
+	}
+	return res, nil
+}
+
+// restrictionsForNamespace returns the restrictions which apply to the namespace ordered by name,
+// so restrictions are always merged in the same order
+func restrictionsForNamespace(list []v1beta1.GcpNamespaceRestriction, namespace *corev1.Namespace) []v1beta1.GcpNamespaceRestriction {
+	var res []v1beta1.GcpNamespaceRestriction
+	for _, element := range list {
+		if appliesToNamespace(&element, namespace) {
+			res = append(res, element)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// appliesToNamespace returns true if the name, the name pattern or the label selector of the restriction
+// matches the namespace
+func appliesToNamespace(restriction *v1beta1.GcpNamespaceRestriction, namespace *corev1.Namespace) bool {
+	spec := &restriction.Spec
+	if spec.Namespace != "" && spec.Namespace == namespace.Name {
+		return true
+	}
+	if spec.NamespacePattern != "" {
+		pattern, err := regexp.Compile(spec.NamespacePattern)
+		if err == nil && pattern.MatchString(namespace.Name) {
+			return true
+		}
+	}
+	if spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector)
+		if err == nil && selector.Matches(labels.Set(namespace.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RestrictionNotFoundError is returned if no GcpNamespaceRestriction exists for the namespace
+type RestrictionNotFoundError struct {
+	Namespace string
+}
+
+func (e *RestrictionNotFoundError) Error() string {
+	return fmt.Sprintf("could not found GcpNamespaceRestriction for namespace %s", e.Namespace)
+}
+
+// IsRestrictionNotFound returns true if the error reports a missing GcpNamespaceRestriction
+func IsRestrictionNotFound(err error) bool {
+	_, ok := err.(*RestrictionNotFoundError)
+	return ok
 }
@@ -1,6 +1,9 @@
 package controllers
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/go-logr/logr"
 	"github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
 	"regexp"
@@ -18,39 +21,242 @@ func NewRestrictionService(restrictionResolveService RestrictionResolveService)
 		resolveService: restrictionResolveService}
 }
 
+// CheckNamespaceHasRights returns true if the restrictions of the namespace allow every role of the bindings
 func (r *RestrictionService) CheckNamespaceHasRights(namespace string, resources []v1beta1.GcpRoleBindings) (bool, error) {
-	restriction, err := r.resolveService.CheckNamespaceHasRights(namespace)
+	decisions, err := r.Evaluate(namespace, resources)
 	if err != nil {
 		return false, err
 	}
-	//check if we find a match for each entry
+	return len(deniedReasons(decisions)) == 0, nil
+}
+
+// Evaluate decides for every role of every binding whether a restriction of the namespace allows it.
+// Bindings without resource are denied, like a spec without any binding with a resource.
+func (r *RestrictionService) Evaluate(namespace string, resources []v1beta1.GcpRoleBindings) ([]v1beta1.RestrictionDecision, error) {
+	restrictions, err := r.resolveService.ResolveRestrictions(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return r.evaluate(restrictions, resources), nil
+}
+
+// evaluate decides for every role of every binding whether one of the restrictions allows it
+func (r *RestrictionService) evaluate(restrictions []v1beta1.GcpNamespaceRestriction, resources []v1beta1.GcpRoleBindings) []v1beta1.RestrictionDecision {
+	names := restrictionNames(restrictions)
+	var decisions []v1beta1.RestrictionDecision
+	hasResource := false
 	for _, res := range resources {
-		if res.Resource != "" {
-			find, binding := r.getMatchingResource(restriction, res.Resource)
-			if !find {
-				return false, nil
+		if res.Resource == "" {
+			decisions = append(decisions, v1beta1.RestrictionDecision{Restriction: names, Reason: "binding without resource"})
+			continue
+		}
+		hasResource = true
+		for _, role := range res.Roles {
+			decisions = append(decisions, r.decide(restrictions, res, role))
+		}
+	}
+	if !hasResource {
+		decisions = append(decisions, v1beta1.RestrictionDecision{Restriction: names, Reason: "no binding with a resource defined"})
+	}
+	return decisions
+}
+
+// Violations lists every resource and role of the bindings that is not allowed for the namespace
+func (r *RestrictionService) Violations(namespace string, resources []v1beta1.GcpRoleBindings) ([]string, error) {
+	decisions, err := r.Evaluate(namespace, resources)
+	if err != nil {
+		return nil, err
+	}
+	return deniedReasons(decisions), nil
+}
+
+// decide looks for an entry of the restrictions which allows the role on the resource of the binding,
+// the restrictions are searched in order and the first allowing entry decides. A deny entry of any
+// restriction takes precedence.
+func (r *RestrictionService) decide(restrictions []v1beta1.GcpNamespaceRestriction, binding v1beta1.GcpRoleBindings, role string) v1beta1.RestrictionDecision {
+	decision := v1beta1.RestrictionDecision{Restriction: restrictionNames(restrictions), Resource: binding.Resource, Role: role}
+	if restriction, entry, matchedRole := r.denyingEntry(restrictions, binding.Resource, role); entry != nil {
+		decision.Restriction = restriction.Name
+		decision.MatchedResource = entry.Resource
+		decision.MatchedRole = matchedRole
+		decision.Reason = fmt.Sprintf("role %s is denied on resource %s by %s", role, binding.Resource, restriction.Name)
+		return decision
+	}
+	resourceMatched := false
+	var conditionDenied *v1beta1.GcpRestrictionRoleBinding
+	for i := range restrictions {
+		restriction := &restrictions[i]
+		for j := range restriction.Spec.GcpRestriction {
+			entry := &restriction.Spec.GcpRestriction[j]
+			if entry.Resource == "" || !r.matchesResource(entry.Resource, binding.Resource, restriction.Spec.Regex) {
+				continue
+			}
+			resourceMatched = true
+			matchedRole, ok := r.matchingRole(entry.Roles, role, restriction.Spec.Regex)
+			if !ok {
+				continue
+			}
+			if !conditionAllowed(entry, binding) {
+				if conditionDenied == nil {
+					conditionDenied = entry
+				}
+				continue
 			}
-			return r.checkAllRolesMatch(binding, res.Roles, restriction.Spec.Regex), nil
+			decision.Restriction = restriction.Name
+			decision.Allowed = true
+			decision.MatchedResource = entry.Resource
+			decision.MatchedRole = matchedRole
+			return decision
 		}
+	}
+	switch {
+	case conditionDenied != nil:
+		decision.MatchedResource = conditionDenied.Resource
+		decision.Reason = fmt.Sprintf("bindings on resource %s must have %s", binding.Resource, conditionRequirementText(conditionDenied.Condition))
+	case resourceMatched:
+		decision.Reason = fmt.Sprintf("role %s is not allowed on resource %s", role, binding.Resource)
+	default:
+		decision.Reason = fmt.Sprintf("resource %s is not allowed", binding.Resource)
+	}
+	return decision
+}
+
+// deniedReasons returns the distinct reasons of the denied decisions
+func deniedReasons(decisions []v1beta1.RestrictionDecision) []string {
+	var reasons []string
+	for _, decision := range decisions {
+		if !decision.Allowed && !containsString(reasons, decision.Reason) {
+			reasons = append(reasons, decision.Reason)
+		}
+	}
+	return reasons
+}
 
+// DefaultProject returns the default project of the namespace, "" if the namespace has no default project
+func (r *RestrictionService) DefaultProject(namespace string) (string, error) {
+	restrictions, err := r.resolveService.ResolveRestrictions(namespace)
+	if err != nil {
+		if IsRestrictionNotFound(err) {
+			return "", nil
+		}
+		return "", err
 	}
-	return false, nil
+	return defaultProject(restrictions), nil
 }
 
-func (r *RestrictionService) checkAllRolesMatch(binding *v1beta1.GcpRestrictionRoleBinding, roles []string, regex bool) bool {
-	for _, role := range roles {
-		found := false
-		for _, check := range binding.Roles {
-			if r.matches(check, role, regex) {
-				found = true
-				break
+// CheckProjectAllowed returns true if any restriction of the namespace allows service accounts in the project
+func (r *RestrictionService) CheckProjectAllowed(namespace string, project string) (bool, error) {
+	restrictions, err := r.resolveService.ResolveRestrictions(namespace)
+	if err != nil {
+		return false, err
+	}
+	return r.projectAllowed(restrictions, project), nil
+}
+
+func (r *RestrictionService) projectAllowed(restrictions []v1beta1.GcpNamespaceRestriction, project string) bool {
+	for _, restriction := range restrictions {
+		if project == restriction.Spec.DefaultProject {
+			return true
+		}
+		for _, check := range restriction.Spec.Projects {
+			if r.matches(check, project, restriction.Spec.Regex) {
+				return true
 			}
 		}
-		if !found {
-			return false
+	}
+	return false
+}
+
+// EnforcementAction returns Revoke if any restriction of the namespace revokes applied bindings which are no
+// longer allowed, restrictions without enforcement action use the default action
+func (r *RestrictionService) EnforcementAction(namespace string, defaultAction v1beta1.EnforcementAction) (v1beta1.EnforcementAction, error) {
+	restrictions, err := r.resolveService.ResolveRestrictions(namespace)
+	if err != nil {
+		return "", err
+	}
+	return enforcementAction(restrictions, defaultAction), nil
+}
+
+func enforcementAction(restrictions []v1beta1.GcpNamespaceRestriction, defaultAction v1beta1.EnforcementAction) v1beta1.EnforcementAction {
+	if defaultAction == "" {
+		defaultAction = v1beta1.EnforcementRevoke
+	}
+	for _, restriction := range restrictions {
+		action := restriction.Spec.EnforcementAction
+		if action == "" {
+			action = defaultAction
+		}
+		if action == v1beta1.EnforcementRevoke {
+			return v1beta1.EnforcementRevoke
+		}
+	}
+	return v1beta1.EnforcementReportOnly
+}
+
+// defaultProject returns the default project of the first restriction which has one
+func defaultProject(restrictions []v1beta1.GcpNamespaceRestriction) string {
+	for _, restriction := range restrictions {
+		if restriction.Spec.DefaultProject != "" {
+			return restriction.Spec.DefaultProject
+		}
+	}
+	return ""
+}
+
+func restrictionNames(restrictions []v1beta1.GcpNamespaceRestriction) string {
+	names := make([]string, 0, len(restrictions))
+	for _, restriction := range restrictions {
+		names = append(names, restriction.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// denyingEntry returns the first deny entry of the restrictions which matches the role on the resource
+func (r *RestrictionService) denyingEntry(restrictions []v1beta1.GcpNamespaceRestriction, resource string, role string) (*v1beta1.GcpNamespaceRestriction, *v1beta1.GcpRestrictionDeny, string) {
+	for i := range restrictions {
+		restriction := &restrictions[i]
+		for j := range restriction.Spec.Deny {
+			entry := &restriction.Spec.Deny[j]
+			if entry.Resource != "" && !r.matchesResource(entry.Resource, resource, restriction.Spec.Regex) {
+				continue
+			}
+			if matchedRole, ok := r.matchingRole(entry.Roles, role, restriction.Spec.Regex); ok {
+				return restriction, entry, matchedRole
+			}
 		}
 	}
-	return true
+	return nil, nil, ""
+}
+
+// matchingRole returns the role pattern which matches the role
+func (r *RestrictionService) matchingRole(checks []string, role string, regex bool) (string, bool) {
+	for _, check := range checks {
+		if r.matches(check, role, regex) {
+			return check, true
+		}
+	}
+	return "", false
+}
+
+// conditionAllowed returns true if the binding fulfills the condition requirement of the restriction,
+// an expiry counts as condition
+func conditionAllowed(restriction *v1beta1.GcpRestrictionRoleBinding, binding v1beta1.GcpRoleBindings) bool {
+	conditional := binding.Condition != nil || binding.ExpiresAt != nil
+	switch restriction.Condition {
+	case v1beta1.ConditionRequired:
+		return conditional
+	case v1beta1.ConditionForbidden:
+		return !conditional
+	default:
+		return true
+	}
+}
+
+func conditionRequirementText(requirement v1beta1.ConditionRequirement) string {
+	if requirement == v1beta1.ConditionForbidden {
+		return "neither condition nor expiry"
+	}
+	return "a condition or expiry"
 }
 
 func (r *RestrictionService) matches(check string, toCheck string, regex bool) bool {
@@ -65,20 +271,22 @@ func (r *RestrictionService) matches(check string, toCheck string, regex bool) b
 	}
 }
 
-func (r *RestrictionService) getMatchingResource(restriction *v1beta1.GcpNamespaceRestriction, resource string) (bool, *v1beta1.GcpRestrictionRoleBinding) {
-	for _, res := range restriction.Spec.GcpRestriction {
-		if res.Resource != "" && r.matches(res.Resource, resource, restriction.Spec.Regex) {
-			return true, &res
-		}
+// matchesResource compares literal resources by their canonical name, so the full and
+// the relative resource name of the same resource match
+func (r *RestrictionService) matchesResource(check string, toCheck string, regex bool) bool {
+	if r.matches(check, toCheck, regex) {
+		return true
 	}
-	return false, nil
-}
-
-func findItem(list []v1beta1.GcpNamespaceRestriction, namespace string) *v1beta1.GcpNamespaceRestriction {
-	for _, element := range list {
-		if element.Spec.Namespace == namespace {
-			return &element
-		}
+	if regex {
+		return false
+	}
+	canonicalCheck, err := canonicalResourceName(check)
+	if err != nil {
+		return false
+	}
+	canonicalToCheck, err := canonicalResourceName(toCheck)
+	if err != nil {
+		return false
 	}
-	return nil
+	return canonicalCheck == canonicalToCheck
 }
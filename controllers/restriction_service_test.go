@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+)
+
+// staticRestrictionResolveService resolves every namespace to the same restrictions
+type staticRestrictionResolveService struct {
+	restrictions []gcpv1beta1.GcpNamespaceRestriction
+}
+
+func (s *staticRestrictionResolveService) ResolveRestrictions(namespace string) ([]gcpv1beta1.GcpNamespaceRestriction, error) {
+	if len(s.restrictions) == 0 {
+		return nil, &RestrictionNotFoundError{Namespace: namespace}
+	}
+	return s.restrictions, nil
+}
+
+func newTestRestriction(regex bool, restrictions ...gcpv1beta1.GcpRestrictionRoleBinding) *gcpv1beta1.GcpNamespaceRestriction {
+	return newNamedTestRestriction("team", regex, restrictions...)
+}
+
+func newNamedTestRestriction(name string, regex bool, restrictions ...gcpv1beta1.GcpRestrictionRoleBinding) *gcpv1beta1.GcpNamespaceRestriction {
+	return &gcpv1beta1.GcpNamespaceRestriction{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "default", Regex: regex, GcpRestriction: restrictions},
+	}
+}
+
+func TestRestrictionEvaluate(t *testing.T) {
+	literal := newTestRestriction(false,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "projects/team", Roles: []string{"roles/viewer"}},
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "projects/team", Roles: []string{"roles/cloudsql.client"}, Condition: gcpv1beta1.ConditionRequired},
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "buckets/team-data", Roles: []string{"roles/storage.objectViewer"}},
+	)
+	regex := newTestRestriction(true,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "^projects/team-.*$", Roles: []string{"^roles/pubsub\\..*$", "^roles/viewer$"}},
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "^buckets/team-.*$", Roles: []string{"^roles/storage\\.object.*$"}},
+	)
+	condition := &gcpv1beta1.GcpRoleBindingCondition{Title: "office hours", Expression: "request.time.getHours() < 18"}
+
+	allowed := func(resource string, role string, matchedResource string, matchedRole string) gcpv1beta1.RestrictionDecision {
+		return gcpv1beta1.RestrictionDecision{Restriction: "team", Resource: resource, Role: role, Allowed: true, MatchedResource: matchedResource, MatchedRole: matchedRole}
+	}
+	denied := func(resource string, role string, reason string) gcpv1beta1.RestrictionDecision {
+		return gcpv1beta1.RestrictionDecision{Restriction: "team", Resource: resource, Role: role, Reason: reason}
+	}
+
+	tests := []struct {
+		name        string
+		restriction *gcpv1beta1.GcpNamespaceRestriction
+		bindings    []gcpv1beta1.GcpRoleBindings
+		expected    []gcpv1beta1.RestrictionDecision
+	}{
+		{"literal allowed", literal,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: []string{"roles/viewer"}}},
+			[]gcpv1beta1.RestrictionDecision{allowed("projects/team", "roles/viewer", "projects/team", "roles/viewer")}},
+		{"literal matches the full resource name", literal,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "//storage.googleapis.com/buckets/team-data", Roles: []string{"roles/storage.objectViewer"}}},
+			[]gcpv1beta1.RestrictionDecision{allowed("//storage.googleapis.com/buckets/team-data", "roles/storage.objectViewer", "buckets/team-data", "roles/storage.objectViewer")}},
+		{"literal role of a later entry for the same resource", literal,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: []string{"roles/cloudsql.client"}, Condition: condition}},
+			[]gcpv1beta1.RestrictionDecision{allowed("projects/team", "roles/cloudsql.client", "projects/team", "roles/cloudsql.client")}},
+		{"literal requires a condition", literal,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: []string{"roles/cloudsql.client"}}},
+			[]gcpv1beta1.RestrictionDecision{{Restriction: "team", Resource: "projects/team", Role: "roles/cloudsql.client", MatchedResource: "projects/team",
+				Reason: "bindings on resource projects/team must have a condition or expiry"}}},
+		{"literal does not match patterns", literal,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: []string{"roles/view.*"}}},
+			[]gcpv1beta1.RestrictionDecision{denied("projects/team", "roles/view.*", "role roles/view.* is not allowed on resource projects/team")}},
+		{"every binding is evaluated", literal,
+			[]gcpv1beta1.GcpRoleBindings{
+				{Resource: "projects/team", Roles: []string{"roles/viewer"}},
+				{Resource: "projects/other", Roles: []string{"roles/viewer"}},
+				{Resource: "buckets/team-data", Roles: []string{"roles/storage.objectViewer", "roles/storage.admin"}},
+			},
+			[]gcpv1beta1.RestrictionDecision{
+				allowed("projects/team", "roles/viewer", "projects/team", "roles/viewer"),
+				denied("projects/other", "roles/viewer", "resource projects/other is not allowed"),
+				allowed("buckets/team-data", "roles/storage.objectViewer", "buckets/team-data", "roles/storage.objectViewer"),
+				denied("buckets/team-data", "roles/storage.admin", "role roles/storage.admin is not allowed on resource buckets/team-data"),
+			}},
+		{"regex allowed", regex,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "projects/team-a/topics/events", Roles: []string{"roles/pubsub.publisher", "roles/viewer"}}},
+			[]gcpv1beta1.RestrictionDecision{
+				allowed("projects/team-a/topics/events", "roles/pubsub.publisher", "^projects/team-.*$", "^roles/pubsub\\..*$"),
+				allowed("projects/team-a/topics/events", "roles/viewer", "^projects/team-.*$", "^roles/viewer$"),
+			}},
+		{"regex denies after an allowed binding", regex,
+			[]gcpv1beta1.GcpRoleBindings{
+				{Resource: "buckets/team-logs", Roles: []string{"roles/storage.objectCreator"}},
+				{Resource: "buckets/team-logs", Roles: []string{"roles/storage.admin"}},
+				{Resource: "projects/platform", Roles: []string{"roles/owner"}},
+			},
+			[]gcpv1beta1.RestrictionDecision{
+				allowed("buckets/team-logs", "roles/storage.objectCreator", "^buckets/team-.*$", "^roles/storage\\.object.*$"),
+				denied("buckets/team-logs", "roles/storage.admin", "role roles/storage.admin is not allowed on resource buckets/team-logs"),
+				denied("projects/platform", "roles/owner", "resource projects/platform is not allowed"),
+			}},
+		{"binding without resource", regex,
+			[]gcpv1beta1.GcpRoleBindings{{Resource: "buckets/team-logs", Roles: []string{"roles/storage.objectViewer"}}, {Roles: []string{"roles/viewer"}}},
+			[]gcpv1beta1.RestrictionDecision{
+				allowed("buckets/team-logs", "roles/storage.objectViewer", "^buckets/team-.*$", "^roles/storage\\.object.*$"),
+				{Restriction: "team", Reason: "binding without resource"},
+			}},
+		{"no bindings", regex, nil,
+			[]gcpv1beta1.RestrictionDecision{{Restriction: "team", Reason: "no binding with a resource defined"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := NewRestrictionService(&staticRestrictionResolveService{restrictions: []gcpv1beta1.GcpNamespaceRestriction{*test.restriction}})
+			decisions, err := service.Evaluate("default", test.bindings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decisions, test.expected) {
+				t.Errorf("expected decisions\n%+v\ngot\n%+v", test.expected, decisions)
+			}
+			hasRights, err := service.CheckNamespaceHasRights("default", test.bindings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasRights != (len(deniedReasons(test.expected)) == 0) {
+				t.Errorf("expected CheckNamespaceHasRights to agree with the decisions, got %v", hasRights)
+			}
+		})
+	}
+}
+
+func TestRestrictionEvaluateWithoutRestriction(t *testing.T) {
+	service := NewRestrictionService(&staticRestrictionResolveService{})
+	_, err := service.Evaluate("default", []gcpv1beta1.GcpRoleBindings{{Resource: "projects/team", Roles: []string{"roles/viewer"}}})
+	if !IsRestrictionNotFound(err) {
+		t.Errorf("expected a missing restriction to be reported, got %v", err)
+	}
+}
+
+func TestRestrictionEvaluateMerged(t *testing.T) {
+	literal := newNamedTestRestriction("a-buckets", false,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "buckets/team-data", Roles: []string{"roles/storage.objectViewer"}})
+	literal.Spec.DefaultProject = "team-project"
+	regex := newNamedTestRestriction("b-topics", true,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "^projects/team-.*$", Roles: []string{"^roles/pubsub\\..*$"}},
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "^buckets/team-.*$", Roles: []string{"^roles/storage\\.objectCreator$"}})
+	regex.Spec.DefaultProject = "other-project"
+	regex.Spec.Projects = []string{"^shared-.*$"}
+	service := NewRestrictionService(&staticRestrictionResolveService{restrictions: []gcpv1beta1.GcpNamespaceRestriction{*literal, *regex}})
+
+	decisions, err := service.Evaluate("default", []gcpv1beta1.GcpRoleBindings{
+		{Resource: "buckets/team-data", Roles: []string{"roles/storage.objectViewer", "roles/storage.objectCreator", "roles/storage.admin"}},
+		{Resource: "projects/team-a/topics/events", Roles: []string{"roles/pubsub.publisher"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gcpv1beta1.RestrictionDecision{
+		{Restriction: "a-buckets", Resource: "buckets/team-data", Role: "roles/storage.objectViewer", Allowed: true,
+			MatchedResource: "buckets/team-data", MatchedRole: "roles/storage.objectViewer"},
+		{Restriction: "b-topics", Resource: "buckets/team-data", Role: "roles/storage.objectCreator", Allowed: true,
+			MatchedResource: "^buckets/team-.*$", MatchedRole: "^roles/storage\\.objectCreator$"},
+		{Restriction: "a-buckets,b-topics", Resource: "buckets/team-data", Role: "roles/storage.admin",
+			Reason: "role roles/storage.admin is not allowed on resource buckets/team-data"},
+		{Restriction: "b-topics", Resource: "projects/team-a/topics/events", Role: "roles/pubsub.publisher", Allowed: true,
+			MatchedResource: "^projects/team-.*$", MatchedRole: "^roles/pubsub\\..*$"},
+	}
+	if !reflect.DeepEqual(decisions, expected) {
+		t.Errorf("expected decisions\n%+v\ngot\n%+v", expected, decisions)
+	}
+
+	project, err := service.DefaultProject("default")
+	if err != nil || project != "team-project" {
+		t.Errorf("expected the default project of the first restriction, got %s (%v)", project, err)
+	}
+	for project, expected := range map[string]bool{"team-project": true, "other-project": true, "shared-data": true, "foreign": false} {
+		allowed, err := service.CheckProjectAllowed("default", project)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != expected {
+			t.Errorf("expected project %s to be allowed %v, got %v", project, expected, allowed)
+		}
+	}
+}
+
+func TestRestrictionsForNamespace(t *testing.T) {
+	restriction := func(name string, spec gcpv1beta1.GcpNamespaceRestrictionSpec) gcpv1beta1.GcpNamespaceRestriction {
+		return gcpv1beta1.GcpNamespaceRestriction{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+	}
+	list := []gcpv1beta1.GcpNamespaceRestriction{
+		restriction("selector", gcpv1beta1.GcpNamespaceRestrictionSpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}}),
+		restriction("pattern", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespacePattern: "^team-a-.*$"}),
+		restriction("name", gcpv1beta1.GcpNamespaceRestrictionSpec{Namespace: "team-a-dev"}),
+		restriction("invalid", gcpv1beta1.GcpNamespaceRestrictionSpec{NamespacePattern: "("}),
+	}
+	namespace := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	tests := []struct {
+		namespace *corev1.Namespace
+		expected  []string
+	}{
+		{namespace("team-a-dev", map[string]string{"team": "a"}), []string{"name", "pattern", "selector"}},
+		{namespace("team-a-prod", nil), []string{"pattern"}},
+		{namespace("shared", map[string]string{"team": "a"}), []string{"selector"}},
+		{namespace("team-b", map[string]string{"team": "b"}), []string{}},
+	}
+	for _, test := range tests {
+		names := []string{}
+		for _, restriction := range restrictionsForNamespace(list, test.namespace) {
+			names = append(names, restriction.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("expected restrictions %v for namespace %s, got %v", test.expected, test.namespace.Name, names)
+		}
+	}
+}
+
+func TestRestrictionEvaluateDeny(t *testing.T) {
+	regex := newNamedTestRestriction("a-team", true,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "^projects/team-.*$", Roles: []string{"^roles/pubsub\\..*$", "^roles/.*$"}})
+	regex.Spec.Deny = []gcpv1beta1.GcpRestrictionDeny{{Resource: "^projects/team-.*$", Roles: []string{"^roles/pubsub\\.admin$"}}}
+	platform := newNamedTestRestriction("b-platform", false,
+		gcpv1beta1.GcpRestrictionRoleBinding{Resource: "buckets/shared", Roles: []string{"roles/owner", "roles/storage.objectViewer"}})
+	platform.Spec.Deny = []gcpv1beta1.GcpRestrictionDeny{
+		{Roles: []string{"roles/owner", "roles/editor"}},
+		{Resource: "//storage.googleapis.com/buckets/shared", Roles: []string{"roles/storage.admin"}},
+	}
+	service := NewRestrictionService(&staticRestrictionResolveService{restrictions: []gcpv1beta1.GcpNamespaceRestriction{*regex, *platform}})
+
+	decisions, err := service.Evaluate("default", []gcpv1beta1.GcpRoleBindings{
+		{Resource: "projects/team-a", Roles: []string{"roles/pubsub.publisher", "roles/pubsub.admin", "roles/editor"}},
+		{Resource: "buckets/shared", Roles: []string{"roles/owner", "roles/storage.objectViewer", "roles/storage.admin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gcpv1beta1.RestrictionDecision{
+		{Restriction: "a-team", Resource: "projects/team-a", Role: "roles/pubsub.publisher", Allowed: true,
+			MatchedResource: "^projects/team-.*$", MatchedRole: "^roles/pubsub\\..*$"},
+		{Restriction: "a-team", Resource: "projects/team-a", Role: "roles/pubsub.admin",
+			MatchedResource: "^projects/team-.*$", MatchedRole: "^roles/pubsub\\.admin$",
+			Reason: "role roles/pubsub.admin is denied on resource projects/team-a by a-team"},
+		{Restriction: "b-platform", Resource: "projects/team-a", Role: "roles/editor", MatchedRole: "roles/editor",
+			Reason: "role roles/editor is denied on resource projects/team-a by b-platform"},
+		{Restriction: "b-platform", Resource: "buckets/shared", Role: "roles/owner", MatchedRole: "roles/owner",
+			Reason: "role roles/owner is denied on resource buckets/shared by b-platform"},
+		{Restriction: "b-platform", Resource: "buckets/shared", Role: "roles/storage.objectViewer", Allowed: true,
+			MatchedResource: "buckets/shared", MatchedRole: "roles/storage.objectViewer"},
+		{Restriction: "b-platform", Resource: "buckets/shared", Role: "roles/storage.admin",
+			MatchedResource: "//storage.googleapis.com/buckets/shared", MatchedRole: "roles/storage.admin",
+			Reason: "role roles/storage.admin is denied on resource buckets/shared by b-platform"},
+	}
+	if !reflect.DeepEqual(decisions, expected) {
+		t.Errorf("expected decisions\n%+v\ngot\n%+v", expected, decisions)
+	}
+}
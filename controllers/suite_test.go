@@ -20,12 +20,18 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"google.golang.org/api/iam/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -33,6 +39,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpfake"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -42,6 +49,33 @@ import (
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var gcpService *gcpfake.GcpService
+var stopManager chan struct{}
+
+const testProject = "test-project"
+
+// newTestReconciler returns a GcpServiceAccountReconciler on the fake gcp apis for tests without an api server
+func newTestReconciler(fake *gcpfake.GcpService) *GcpServiceAccountReconciler {
+	return &GcpServiceAccountReconciler{Log: logf.Log, Recorder: record.NewFakeRecorder(100), GcpService: fake}
+}
+
+func newTestGcpServiceAccount(identifier string, uid string) *gcpv1beta1.GcpServiceAccount {
+	instance := &gcpv1beta1.GcpServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+	instance.UID = types.UID("2f7b1c4e-6c3f-4d0a-9a57-" + uid)
+	instance.Spec.ServiceAccountIdentifier = identifier
+	return instance
+}
+
+// createTestServiceAccount creates the gcp service account of the instance and records it in the status
+func createTestServiceAccount(t *testing.T, r *GcpServiceAccountReconciler, instance *gcpv1beta1.GcpServiceAccount) *iam.ServiceAccount {
+	account, _, err := r.ensureServiceAccount(instance, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.ServiceAccountPath = account.Name
+	instance.Status.ServiceAccountMail = account.Email
+	return account
+}
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -87,11 +121,55 @@ var _ = BeforeSuite(func(done Done) {
 	Expect(err).ToNot(HaveOccurred())
 	Expect(k8sClient).ToNot(BeNil())
 
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{Scheme: scheme.Scheme, MetricsBindAddress: "0"})
+	Expect(err).ToNot(HaveOccurred())
+
+	gcpService = gcpfake.NewGcpService(testProject)
+	err = (&GcpServiceAccountReconciler{
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("GcpServiceAccount"),
+		Scheme:              mgr.GetScheme(),
+		Recorder:            mgr.GetEventRecorderFor("gcp-serviceaccount-controller"),
+		GcpService:          gcpService,
+		RestrictionService:  *NewRestrictionService(NewRestrictionResolveService(mgr.GetClient())),
+		DisableRestrictions: true,
+		ResyncInterval:      2 * time.Second,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+	err = (&GcpCustomRoleReconciler{
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("GcpCustomRole"),
+		Scheme:              mgr.GetScheme(),
+		Recorder:            mgr.GetEventRecorderFor("gcp-serviceaccount-controller"),
+		GcpService:          gcpService,
+		RestrictionService:  *NewRestrictionService(NewRestrictionResolveService(mgr.GetClient())),
+		DisableRestrictions: true,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = (&GcpNamespaceRestrictionReconciler{
+		Client:             mgr.GetClient(),
+		Log:                ctrl.Log.WithName("controllers").WithName("GcpNamespaceRestriction"),
+		Scheme:             mgr.GetScheme(),
+		RestrictionService: *NewRestrictionService(NewRestrictionResolveService(mgr.GetClient())),
+		ResyncInterval:     2 * time.Second,
+	}).SetupWithManager(mgr)
+	Expect(err).ToNot(HaveOccurred())
+
+	stopManager = make(chan struct{})
+	go func() {
+		defer GinkgoRecover()
+		Expect(mgr.Start(stopManager)).To(Succeed())
+	}()
+
 	close(done)
 }, 60)
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	if stopManager != nil {
+		close(stopManager)
+	}
 	err := testEnv.Stop()
 	Expect(err).ToNot(HaveOccurred())
 })
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	workloadIdentityUserRole   = "roles/iam.workloadIdentityUser"
+	workloadIdentityAnnotation = "iam.gke.io/gcp-service-account"
+)
+
+var workloadIdentityPoolPattern = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]\.svc\.id\.goog$`)
+
+// ValidWorkloadIdentityPool returns if the pool is a workload identity pool of a cluster, empty disables WorkloadIdentity mode
+func ValidWorkloadIdentityPool(pool string) bool {
+	return pool == "" || workloadIdentityPoolPattern.MatchString(pool)
+}
+
+// reconcileWorkloadIdentity binds the kubernetes service account to the gcp service account,
+// removes exported keys and returns the reason of a failure
+func (r *GcpServiceAccountReconciler) reconcileWorkloadIdentity(instance *gcpv1beta1.GcpServiceAccount) (string, error) {
+	// the identity pool belongs to the project of the cluster, not to the project of the service account
+	member, err := r.workloadIdentityMember(instance)
+	if err != nil {
+		return "WorkloadIdentityPoolNotConfigured", err
+	}
+	// the kubernetes service account was renamed
+	if instance.Status.WorkloadIdentityMember != "" && instance.Status.WorkloadIdentityMember != member {
+		if err := r.cleanupWorkloadIdentity(instance); err != nil {
+			return "WorkloadIdentityCleanupFailed", err
+		}
+	}
+
+	if err := r.addServiceAccountIamMember(instance, workloadIdentityUserRole, member); err != nil {
+		return "IamPolicyUpdateFailed", err
+	}
+	instance.Status.WorkloadIdentityMember = member
+	if err := r.updateStatus(instance); err != nil {
+		return "StatusUpdateFailed", err
+	}
+
+	ksa := &corev1.ServiceAccount{}
+	err = r.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.KubernetesServiceAccountName, Namespace: instance.Namespace}, ksa)
+	if err != nil && errors.IsNotFound(err) {
+		ksa.Name = instance.Spec.KubernetesServiceAccountName
+		ksa.Namespace = instance.Namespace
+		ksa.Annotations = map[string]string{workloadIdentityAnnotation: instance.Status.ServiceAccountMail}
+		if err := controllerutil.SetControllerReference(instance, ksa, r.Scheme); err != nil {
+			return "KubernetesServiceAccountWriteFailed", err
+		}
+		r.Log.Info("Creating ServiceAccount", "serviceAccountName", ksa.Name, "namespace", ksa.Namespace)
+		if err := r.Create(context.TODO(), ksa); err != nil {
+			return "KubernetesServiceAccountWriteFailed", err
+		}
+	} else if err != nil {
+		return "KubernetesServiceAccountWriteFailed", err
+	} else if ksa.Annotations[workloadIdentityAnnotation] != instance.Status.ServiceAccountMail {
+		if ksa.Annotations == nil {
+			ksa.Annotations = map[string]string{}
+		}
+		ksa.Annotations[workloadIdentityAnnotation] = instance.Status.ServiceAccountMail
+		r.Log.Info("Annotating ServiceAccount", "serviceAccountName", ksa.Name, "namespace", ksa.Namespace)
+		if err := r.Update(context.TODO(), ksa); err != nil {
+			return "KubernetesServiceAccountWriteFailed", err
+		}
+	}
+	instance.Status.KubernetesServiceAccount = ksa.Name
+
+	// no exported keys may remain once the service account is used via workload identity
+	if instance.Status.CredentialKey != "" {
+		if err := r.deleteServiceAccountKeys(instance); err != nil {
+			return "KeyDeletionFailed", err
+		}
+		if err := r.deleteOwnedSecret(instance); err != nil {
+			return "SecretDeletionFailed", err
+		}
+		instance.Status.CredentialKey = ""
+		instance.Status.CredentialKeyCreationTime = nil
+		instance.Status.NextKeyRotation = nil
+		instance.Status.PreviousCredentialKey = ""
+		instance.Status.PreviousCredentialKeyDeletion = nil
+	}
+
+	r.setCondition(instance, gcpv1beta1.ConditionWorkloadIdentityBound, corev1.ConditionTrue, "Bound",
+		fmt.Sprintf("kubernetes service account %s is bound as %s", ksa.Name, member))
+	gcpv1beta1.RemoveCondition(&instance.Status.Conditions, gcpv1beta1.ConditionKeyIssued)
+	return "", nil
+}
+
+// cleanupWorkloadIdentity revokes the workload identity binding and releases the kubernetes
+// service account, a service account created by the controller is deleted
+func (r *GcpServiceAccountReconciler) cleanupWorkloadIdentity(instance *gcpv1beta1.GcpServiceAccount) error {
+	if instance.Status.WorkloadIdentityMember != "" {
+		if err := r.removeServiceAccountIamMember(instance, workloadIdentityUserRole, instance.Status.WorkloadIdentityMember); err != nil {
+			return err
+		}
+	}
+
+	if instance.Status.KubernetesServiceAccount != "" {
+		ksa := &corev1.ServiceAccount{}
+		err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Status.KubernetesServiceAccount, Namespace: instance.Namespace}, ksa)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if metav1.IsControlledBy(ksa, instance) {
+				r.Log.Info("Deleting ServiceAccount", "serviceAccountName", ksa.Name, "namespace", ksa.Namespace)
+				if err := r.Delete(context.TODO(), ksa); err != nil && !errors.IsNotFound(err) {
+					return err
+				}
+			} else if _, ok := ksa.Annotations[workloadIdentityAnnotation]; ok {
+				delete(ksa.Annotations, workloadIdentityAnnotation)
+				r.Log.Info("Removing annotation from ServiceAccount", "serviceAccountName", ksa.Name, "namespace", ksa.Namespace)
+				if err := r.Update(context.TODO(), ksa); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	instance.Status.WorkloadIdentityMember = ""
+	instance.Status.KubernetesServiceAccount = ""
+	gcpv1beta1.RemoveCondition(&instance.Status.Conditions, gcpv1beta1.ConditionWorkloadIdentityBound)
+	return nil
+}
+
+// deleteOwnedSecret deletes the credentials secret if it was created by the controller
+func (r *GcpServiceAccountReconciler) deleteOwnedSecret(instance *gcpv1beta1.GcpServiceAccount) error {
+	if instance.Spec.SecretName == "" {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(secret, instance) {
+		return nil
+	}
+	r.Log.Info("Deleting Secret", "secretName", secret.Name, "namespace", secret.Namespace)
+	if err := r.Delete(context.TODO(), secret); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
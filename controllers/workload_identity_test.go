@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
+	"github.com/kiwigrid/gcp-serviceaccount-controller/pkg/gcpfake"
+)
+
+func TestWorkloadIdentityMember(t *testing.T) {
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	instance.Spec.KubernetesServiceAccountName = "app"
+	r := newTestReconciler(gcpfake.NewGcpService("service-account-project"))
+	if _, err := r.workloadIdentityMember(instance); err == nil {
+		t.Error("expected an error without a workload identity pool")
+	}
+
+	r.WorkloadIdentityPool = "cluster-project.svc.id.goog"
+	member, err := r.workloadIdentityMember(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "serviceAccount:cluster-project.svc.id.goog[default/app]"; member != expected {
+		t.Errorf("expected member %s, got %s", expected, member)
+	}
+	for pool, valid := range map[string]bool{"": true, "cluster-project.svc.id.goog": true, "cluster-project": false, "svc.id.goog": false} {
+		if ValidWorkloadIdentityPool(pool) != valid {
+			t.Errorf("expected pool %q to be valid %v", pool, valid)
+		}
+	}
+}
+
+func TestReconcileWorkloadIdentity(t *testing.T) {
+	instance := newTestGcpServiceAccount("app", "000000000001")
+	// a kubernetes service account of the user which is bound later
+	frontend := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: instance.Namespace}}
+	r, gcpService := newTestKeyReconciler(t, instance, frontend)
+	instance.Status.CredentialKey = ""
+	if _, reason, err := r.reconcileKey(instance); err != nil {
+		t.Fatalf("%s: %v", reason, err)
+	}
+
+	// switch from Key mode
+	instance.Spec.Mode = gcpv1beta1.ModeWorkloadIdentity
+	instance.Spec.KubernetesServiceAccountName = "app"
+	if reason, err := r.reconcileWorkloadIdentity(instance); err == nil || reason != "WorkloadIdentityPoolNotConfigured" {
+		t.Errorf("expected a failure without a workload identity pool, got %s: %v", reason, err)
+	}
+	r.WorkloadIdentityPool = "cluster-project.svc.id.goog"
+	if reason, err := r.reconcileWorkloadIdentity(instance); err != nil {
+		t.Fatalf("%s: %v", reason, err)
+	}
+	path := instance.Status.ServiceAccountPath
+	member := "serviceAccount:cluster-project.svc.id.goog[default/app]"
+	if members := gcpService.Members(path, workloadIdentityUserRole); len(members) != 1 || members[0] != member {
+		t.Errorf("expected the binding of %s, got %v", member, members)
+	}
+	if keys := gcpService.KeyNames(path); len(keys) != 0 || instance.Status.CredentialKey != "" {
+		t.Errorf("expected all keys to be deleted, got %v", keys)
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.SecretName, Namespace: instance.Namespace}, secret); !errors.IsNotFound(err) {
+		t.Errorf("expected the secret to be deleted, got %v", err)
+	}
+	ksa := &corev1.ServiceAccount{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: instance.Namespace}, ksa); err != nil {
+		t.Fatal(err)
+	}
+	if ksa.Annotations[workloadIdentityAnnotation] != instance.Status.ServiceAccountMail || !metav1.IsControlledBy(ksa, instance) {
+		t.Errorf("expected an annotated kubernetes service account of the instance, got %+v", ksa.ObjectMeta)
+	}
+
+	// the kubernetes service account is renamed
+	instance.Spec.KubernetesServiceAccountName = frontend.Name
+	if reason, err := r.reconcileWorkloadIdentity(instance); err != nil {
+		t.Fatalf("%s: %v", reason, err)
+	}
+	frontendMember := "serviceAccount:cluster-project.svc.id.goog[default/frontend]"
+	if members := gcpService.Members(path, workloadIdentityUserRole); len(members) != 1 || members[0] != frontendMember {
+		t.Errorf("expected the binding to move to %s, got %v", frontendMember, members)
+	}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: instance.Namespace}, ksa); !errors.IsNotFound(err) {
+		t.Errorf("expected the created kubernetes service account to be deleted, got %v", err)
+	}
+
+	if err := r.cleanupWorkloadIdentity(instance); err != nil {
+		t.Fatal(err)
+	}
+	if members := gcpService.Members(path, workloadIdentityUserRole); len(members) != 0 {
+		t.Errorf("expected the binding to be removed, got %v", members)
+	}
+	ksa = &corev1.ServiceAccount{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: frontend.Name, Namespace: instance.Namespace}, ksa); err != nil {
+		t.Fatalf("expected the kubernetes service account of the user to be kept, got %v", err)
+	}
+	if _, ok := ksa.Annotations[workloadIdentityAnnotation]; ok {
+		t.Errorf("expected the annotation to be removed, got %v", ksa.Annotations)
+	}
+	if instance.Status.WorkloadIdentityMember != "" || instance.Status.KubernetesServiceAccount != "" {
+		t.Errorf("expected the workload identity status to be cleared, got %+v", instance.Status)
+	}
+}
@@ -18,13 +18,16 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	gcpv1beta1 "github.com/kiwigrid/gcp-serviceaccount-controller/api/v1beta1"
 	"github.com/kiwigrid/gcp-serviceaccount-controller/controllers"
@@ -71,20 +74,87 @@ func main() {
 		restrictionCheck = true
 	}
 
+	defaultDeletionPolicy := gcpv1beta1.DeletionPolicy(os.Getenv("DEFAULT_DELETION_POLICY"))
+	if !controllers.ValidDeletionPolicy(defaultDeletionPolicy) {
+		setupLog.Error(fmt.Errorf("unknown deletion policy %s", defaultDeletionPolicy), "invalid DEFAULT_DELETION_POLICY")
+		os.Exit(1)
+	}
+
+	defaultEnforcementAction := gcpv1beta1.EnforcementAction(os.Getenv("DEFAULT_ENFORCEMENT_ACTION"))
+	if !controllers.ValidEnforcementAction(defaultEnforcementAction) {
+		setupLog.Error(fmt.Errorf("unknown enforcement action %s", defaultEnforcementAction), "invalid DEFAULT_ENFORCEMENT_ACTION")
+		os.Exit(1)
+	}
+
+	workloadIdentityPool := os.Getenv("WORKLOAD_IDENTITY_POOL")
+	if !controllers.ValidWorkloadIdentityPool(workloadIdentityPool) {
+		setupLog.Error(fmt.Errorf("%s is not a workload identity pool like <project>.svc.id.goog", workloadIdentityPool), "invalid WORKLOAD_IDENTITY_POOL")
+		os.Exit(1)
+	}
+
+	var resyncInterval time.Duration
+	if value := os.Getenv("RESYNC_INTERVAL"); value != "" {
+		resyncInterval, err = time.ParseDuration(value)
+		if err != nil {
+			setupLog.Error(err, "invalid RESYNC_INTERVAL")
+			os.Exit(1)
+		}
+	}
+
 	resolveService := controllers.NewRestrictionResolveService(mgr.GetClient())
 	restrictionService := controllers.NewRestrictionService(resolveService)
+	gcpService, err := controllers.NewGcpService()
+	if err != nil {
+		setupLog.Error(err, "unable to create gcp service")
+		os.Exit(1)
+	}
 
 	if err = (&controllers.GcpServiceAccountReconciler{
+		Client:                   mgr.GetClient(),
+		Log:                      ctrl.Log.WithName("controllers").WithName("GcpServiceAccount"),
+		Scheme:                   mgr.GetScheme(),
+		Recorder:                 mgr.GetEventRecorderFor("gcp-serviceaccount-controller"),
+		GcpService:               controllers.NewInstrumentedGcpService(gcpService),
+		DisableRestrictions:      restrictionCheck,
+		RestrictionService:       *restrictionService,
+		DefaultDeletionPolicy:    defaultDeletionPolicy,
+		ResyncInterval:           resyncInterval,
+		DefaultEnforcementAction: defaultEnforcementAction,
+		WorkloadIdentityPool:     workloadIdentityPool,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GcpServiceAccount")
+		os.Exit(1)
+	}
+	if err = (&controllers.GcpCustomRoleReconciler{
 		Client:              mgr.GetClient(),
-		Log:                 ctrl.Log.WithName("controllers").WithName("GcpServiceAccount"),
+		Log:                 ctrl.Log.WithName("controllers").WithName("GcpCustomRole"),
 		Scheme:              mgr.GetScheme(),
-		GcpService:          controllers.NewGcpService(),
+		Recorder:            mgr.GetEventRecorderFor("gcp-serviceaccount-controller"),
+		GcpService:          controllers.NewInstrumentedGcpService(gcpService),
 		DisableRestrictions: restrictionCheck,
 		RestrictionService:  *restrictionService,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "GcpServiceAccount")
+		setupLog.Error(err, "unable to create controller", "controller", "GcpCustomRole")
 		os.Exit(1)
 	}
+	if err = (&controllers.GcpNamespaceRestrictionReconciler{
+		Client:             mgr.GetClient(),
+		Log:                ctrl.Log.WithName("controllers").WithName("GcpNamespaceRestriction"),
+		Scheme:             mgr.GetScheme(),
+		RestrictionService: *restrictionService,
+		ResyncInterval:     resyncInterval,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GcpNamespaceRestriction")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+		mgr.GetWebhookServer().Register(controllers.GcpNamespaceRestrictionValidatorPath,
+			&webhook.Admission{Handler: controllers.NewGcpNamespaceRestrictionValidator()})
+		mgr.GetWebhookServer().Register(controllers.GcpServiceAccountDefaulterPath,
+			&webhook.Admission{Handler: controllers.NewGcpServiceAccountDefaulter()})
+		mgr.GetWebhookServer().Register(controllers.GcpServiceAccountValidatorPath,
+			&webhook.Admission{Handler: controllers.NewGcpServiceAccountValidator(mgr.GetClient(), restrictionService, restrictionCheck)})
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -0,0 +1,253 @@
+// Package gcpemulator serves the parts of the gcp apis used by the controllers from memory:
+// service accounts, keys and custom roles of the IAM admin api and the iam policies of projects,
+// storage buckets, pub/sub topics and subscriptions and service accounts.
+//
+// The api is selected by the host of the request, so the emulator expects the requests the gcp
+// clients send to *.googleapis.com redirected to its address while keeping the host, which is what
+// the endpoint option of the controllers gcp service does.
+package gcpemulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	"google.golang.org/api/iam/v1"
+)
+
+// apis served by the emulator, the first label of the host of the request
+const (
+	ServiceIam                  = "iam"
+	ServiceCloudResourceManager = "cloudresourcemanager"
+	ServiceStorage              = "storage"
+	ServicePubSub               = "pubsub"
+)
+
+// Request is a request received by the emulator
+type Request struct {
+	Service string
+	Method  string
+	Path    string
+}
+
+// Fault makes matching requests fail with the code
+type Fault struct {
+	// Service matches the api of the request, "" matches all apis
+	Service string
+	// Method matches the http method of the request, "" matches all methods
+	Method string
+	// Path is a regular expression matched against the path of the request, "" matches all paths
+	Path    string
+	Code    int
+	Message string
+	// Times is the number of requests which fail, <= 0 fails all matching requests
+	Times int
+
+	path *regexp.Regexp
+}
+
+// Emulator is a http.Handler keeping the state of the emulated apis in memory
+type Emulator struct {
+	mu       sync.Mutex
+	accounts map[string]*iam.ServiceAccount
+	keys     map[string]*iam.ServiceAccountKey
+	policies map[string]*iamutil.Policy
+	roles    map[string]*iam.Role
+	faults   []*Fault
+	requests []Request
+	sequence int
+}
+
+// New creates an emulator without any service accounts and with empty policies
+func New() *Emulator {
+	return &Emulator{
+		accounts: map[string]*iam.ServiceAccount{},
+		keys:     map[string]*iam.ServiceAccountKey{},
+		policies: map[string]*iamutil.Policy{},
+		roles:    map[string]*iam.Role{},
+	}
+}
+
+// NewServer starts a http server serving a new emulator, the server has to be closed by the caller
+func NewServer() (*httptest.Server, *Emulator) {
+	emulator := New()
+	return httptest.NewServer(emulator), emulator
+}
+
+// InjectFault adds a fault, the first matching fault fails a request
+func (e *Emulator) InjectFault(fault Fault) error {
+	if fault.Path != "" {
+		path, err := regexp.Compile(fault.Path)
+		if err != nil {
+			return err
+		}
+		fault.path = path
+	}
+	if fault.Message == "" {
+		fault.Message = http.StatusText(fault.Code)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.faults = append(e.faults, &fault)
+	return nil
+}
+
+// ClearFaults removes all faults
+func (e *Emulator) ClearFaults() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.faults = nil
+}
+
+// Requests returns the received requests in order
+func (e *Emulator) Requests() []Request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Request(nil), e.requests...)
+}
+
+// ServiceAccount returns the service account with the email or nil if it does not exist
+func (e *Emulator) ServiceAccount(email string) *iam.ServiceAccount {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	account, ok := e.accounts[email]
+	if !ok {
+		return nil
+	}
+	copied := *account
+	return &copied
+}
+
+// KeyNames returns the names of the keys of the service account with the email
+func (e *Emulator) KeyNames(email string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var names []string
+	for name := range e.keys {
+		if strings.Contains(name, "/serviceAccounts/"+email+"/keys/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Policy returns the policy of the resource. The resource is the service followed by the relative name
+// of the resource, e.g. "cloudresourcemanager/projects/my-project" or "storage/b/my-bucket".
+func (e *Emulator) Policy(resource string) *iamutil.Policy {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	policy, ok := e.policies[resource]
+	if !ok {
+		return nil
+	}
+	return copyPolicy(policy)
+}
+
+// Members returns the members of the unconditional binding of the role in the policy of the resource
+func (e *Emulator) Members(resource string, role string) []string {
+	policy := e.Policy(resource)
+	if policy == nil {
+		return nil
+	}
+	for _, binding := range policy.Bindings {
+		if binding.Role == role && binding.Condition == nil {
+			return binding.Members
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.HasSuffix(host, ".googleapis.com") {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("host %s is not a gcp api", r.Host))
+		return
+	}
+	service := strings.TrimSuffix(host, ".googleapis.com")
+	e.requests = append(e.requests, Request{Service: service, Method: r.Method, Path: r.URL.Path})
+
+	if fault := e.matchFault(service, r); fault != nil {
+		writeError(w, fault.Code, fault.Message)
+		return
+	}
+
+	switch service {
+	case ServiceIam:
+		e.serveIam(w, r)
+	case ServiceCloudResourceManager:
+		e.servePolicy(w, r, service, projectPolicyPath)
+	case ServiceStorage:
+		e.servePolicy(w, r, service, bucketPolicyPath)
+	case ServicePubSub:
+		e.servePolicy(w, r, service, pubSubPolicyPath)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("api %s is not emulated", service))
+	}
+}
+
+func (e *Emulator) matchFault(service string, r *http.Request) *Fault {
+	for i, fault := range e.faults {
+		if fault.Service != "" && fault.Service != service {
+			continue
+		}
+		if fault.Method != "" && fault.Method != r.Method {
+			continue
+		}
+		if fault.path != nil && !fault.path.MatchString(r.URL.Path) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				e.faults = append(e.faults[:i], e.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func (e *Emulator) nextSequence() int {
+	e.sequence++
+	return e.sequence
+}
+
+var errorStatus = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusConflict:            "ABORTED",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError: "INTERNAL",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+}
+
+// writeError writes the error in the format of the gcp apis, so it is returned as googleapi.Error
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJson(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  errorStatus[code],
+		},
+	})
+}
+
+func writeJson(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,213 @@
+package gcpemulator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iam/v1"
+)
+
+var (
+	serviceAccountsPath      = regexp.MustCompile(`^/v1/projects/([^/]+)/serviceAccounts$`)
+	serviceAccountPath       = regexp.MustCompile(`^/v1/projects/([^/]+)/serviceAccounts/([^/:]+)$`)
+	serviceAccountPolicyPath = regexp.MustCompile(`^/v1/projects/([^/]+)/serviceAccounts/([^/:]+):(getIamPolicy|setIamPolicy)$`)
+	keysPath                 = regexp.MustCompile(`^/v1/projects/([^/]+)/serviceAccounts/([^/]+)/keys$`)
+	keyPath                  = regexp.MustCompile(`^/v1/projects/([^/]+)/serviceAccounts/([^/]+)/keys/([^/]+)$`)
+	accountIdPattern         = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])$`)
+)
+
+func (e *Emulator) serveIam(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if e.serveRoles(w, r) {
+		return
+	}
+	if m := serviceAccountsPath.FindStringSubmatch(path); m != nil {
+		switch r.Method {
+		case http.MethodGet:
+			e.listServiceAccounts(w, m[1])
+		case http.MethodPost:
+			e.createServiceAccount(w, r, m[1])
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		}
+		return
+	}
+	if m := serviceAccountPolicyPath.FindStringSubmatch(path); m != nil {
+		account, ok := e.findServiceAccount(m[2])
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service account %s not found", m[2]))
+			return
+		}
+		e.servePolicyAction(w, r, ServiceIam+"/"+account.Name, m[3] == "setIamPolicy", true)
+		return
+	}
+	if m := serviceAccountPath.FindStringSubmatch(path); m != nil {
+		account, ok := e.findServiceAccount(m[2])
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service account %s not found", m[2]))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, http.StatusOK, account)
+		case http.MethodDelete:
+			e.deleteServiceAccount(account)
+			writeJson(w, http.StatusOK, struct{}{})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		}
+		return
+	}
+	if m := keysPath.FindStringSubmatch(path); m != nil {
+		account, ok := e.findServiceAccount(m[2])
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service account %s not found", m[2]))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			e.listKeys(w, account)
+		case http.MethodPost:
+			e.createKey(w, account)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		}
+		return
+	}
+	if m := keyPath.FindStringSubmatch(path); m != nil {
+		account, ok := e.findServiceAccount(m[2])
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service account %s not found", m[2]))
+			return
+		}
+		name := fmt.Sprintf("%s/keys/%s", account.Name, m[3])
+		key, ok := e.keys[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("key %s not found", name))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			// the private key data is only returned on creation
+			copied := *key
+			copied.PrivateKeyData = ""
+			writeJson(w, http.StatusOK, &copied)
+		case http.MethodDelete:
+			delete(e.keys, name)
+			writeJson(w, http.StatusOK, struct{}{})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("path %s not found", path))
+}
+
+// findServiceAccount looks up the account by email or unique id, the project of the path is not checked
+// as the api accepts "-" for it
+func (e *Emulator) findServiceAccount(id string) (*iam.ServiceAccount, bool) {
+	if account, ok := e.accounts[id]; ok {
+		return account, true
+	}
+	for _, account := range e.accounts {
+		if account.UniqueId == id {
+			return account, true
+		}
+	}
+	return nil, false
+}
+
+func (e *Emulator) listServiceAccounts(w http.ResponseWriter, project string) {
+	response := &iam.ListServiceAccountsResponse{}
+	for _, account := range e.accounts {
+		if project == "-" || account.ProjectId == project {
+			response.Accounts = append(response.Accounts, account)
+		}
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func (e *Emulator) createServiceAccount(w http.ResponseWriter, r *http.Request, project string) {
+	request := &iam.CreateServiceAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(request.AccountId) < 6 || len(request.AccountId) > 30 || !accountIdPattern.MatchString(request.AccountId) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("account id %s is invalid", request.AccountId))
+		return
+	}
+	email := fmt.Sprintf("%s@%s.iam.gserviceaccount.com", request.AccountId, project)
+	if _, ok := e.accounts[email]; ok {
+		writeError(w, http.StatusConflict, fmt.Sprintf("service account %s already exists within project %s", request.AccountId, project))
+		return
+	}
+	account := &iam.ServiceAccount{
+		Name:      fmt.Sprintf("projects/%s/serviceAccounts/%s", project, email),
+		ProjectId: project,
+		Email:     email,
+		UniqueId:  fmt.Sprintf("1%020d", e.nextSequence()),
+		Etag:      base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", e.sequence))),
+	}
+	if request.ServiceAccount != nil {
+		account.DisplayName = request.ServiceAccount.DisplayName
+		account.Description = request.ServiceAccount.Description
+	}
+	e.accounts[email] = account
+	writeJson(w, http.StatusOK, account)
+}
+
+func (e *Emulator) deleteServiceAccount(account *iam.ServiceAccount) {
+	delete(e.accounts, account.Email)
+	delete(e.policies, ServiceIam+"/"+account.Name)
+	for name := range e.keys {
+		if strings.HasPrefix(name, account.Name+"/keys/") {
+			delete(e.keys, name)
+		}
+	}
+}
+
+func (e *Emulator) listKeys(w http.ResponseWriter, account *iam.ServiceAccount) {
+	response := &iam.ListServiceAccountKeysResponse{}
+	for name, key := range e.keys {
+		if strings.HasPrefix(name, account.Name+"/keys/") {
+			copied := *key
+			copied.PrivateKeyData = ""
+			response.Keys = append(response.Keys, &copied)
+		}
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+func (e *Emulator) createKey(w http.ResponseWriter, account *iam.ServiceAccount) {
+	keyId := fmt.Sprintf("%040x", e.nextSequence())
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     account.ProjectId,
+		"private_key_id": keyId,
+		"client_email":   account.Email,
+		"client_id":      account.UniqueId,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	key := &iam.ServiceAccountKey{
+		Name:            fmt.Sprintf("%s/keys/%s", account.Name, keyId),
+		KeyAlgorithm:    "KEY_ALG_RSA_2048",
+		KeyOrigin:       "GOOGLE_PROVIDED",
+		KeyType:         "USER_MANAGED",
+		PrivateKeyType:  "TYPE_GOOGLE_CREDENTIALS_FILE",
+		PrivateKeyData:  base64.StdEncoding.EncodeToString(credentials),
+		ValidAfterTime:  now.Format(time.RFC3339),
+		ValidBeforeTime: now.AddDate(10, 0, 0).Format(time.RFC3339),
+	}
+	e.keys[key.Name] = key
+	writeJson(w, http.StatusOK, key)
+}
@@ -0,0 +1,184 @@
+package gcpemulator
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+)
+
+var (
+	projectPolicyPattern = regexp.MustCompile(`^/v1/(projects/[^/:]+):(getIamPolicy|setIamPolicy)$`)
+	bucketPolicyPattern  = regexp.MustCompile(`^/storage/v1/(b/[^/]+)/iam$`)
+	pubSubPolicyPattern  = regexp.MustCompile(`^/v1/(projects/[^/]+/(?:topics|subscriptions)/[^/:]+):(getIamPolicy|setIamPolicy)$`)
+)
+
+// policyPath returns the relative resource name of a policy request and if the policy is set
+type policyPath func(r *http.Request) (resource string, set bool, ok bool)
+
+func projectPolicyPath(r *http.Request) (string, bool, bool) {
+	m := projectPolicyPattern.FindStringSubmatch(r.URL.Path)
+	if m == nil || r.Method != http.MethodPost {
+		return "", false, false
+	}
+	return m[1], m[2] == "setIamPolicy", true
+}
+
+func bucketPolicyPath(r *http.Request) (string, bool, bool) {
+	m := bucketPolicyPattern.FindStringSubmatch(r.URL.Path)
+	if m == nil || (r.Method != http.MethodGet && r.Method != http.MethodPut) {
+		return "", false, false
+	}
+	return m[1], r.Method == http.MethodPut, true
+}
+
+func pubSubPolicyPath(r *http.Request) (string, bool, bool) {
+	m := pubSubPolicyPattern.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return "", false, false
+	}
+	set := m[2] == "setIamPolicy"
+	if (set && r.Method != http.MethodPost) || (!set && r.Method != http.MethodGet) {
+		return "", false, false
+	}
+	return m[1], set, true
+}
+
+// servePolicy serves the policy requests of an api, every resource of these apis exists
+func (e *Emulator) servePolicy(w http.ResponseWriter, r *http.Request, service string, path policyPath) {
+	resource, set, ok := path(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s not found", r.Method, r.URL.Path))
+		return
+	}
+	// storage sends the policy itself, all other apis wrap it in a request
+	e.servePolicyAction(w, r, service+"/"+resource, set, service != ServiceStorage)
+}
+
+type setIamPolicyRequest struct {
+	Policy *iamutil.Policy `json:"policy"`
+}
+
+type getIamPolicyRequest struct {
+	Options struct {
+		RequestedPolicyVersion int `json:"requestedPolicyVersion"`
+	} `json:"options"`
+}
+
+// requestedPolicyVersion returns the policy version of a get request, the cloud resource manager takes it in the
+// body, storage and all other apis in a query parameter
+func requestedPolicyVersion(r *http.Request) int {
+	for _, parameter := range []string{"options.requestedPolicyVersion", "optionsRequestedPolicyVersion"} {
+		if version, err := strconv.Atoi(r.URL.Query().Get(parameter)); err == nil {
+			return version
+		}
+	}
+	request := &getIamPolicyRequest{}
+	if r.Body != nil && json.NewDecoder(r.Body).Decode(request) == nil {
+		return request.Options.RequestedPolicyVersion
+	}
+	return 1
+}
+
+// withoutConditions returns the policy like gcp returns it for a version below 3, the conditions are removed and
+// the roles of conditional bindings get a suffix
+func withoutConditions(policy *iamutil.Policy) *iamutil.Policy {
+	downgraded := copyPolicy(policy)
+	downgraded.Version = 1
+	for _, binding := range downgraded.Bindings {
+		if binding.Condition == nil {
+			continue
+		}
+		sum := sha256.Sum256([]byte(binding.Condition.Title + binding.Condition.Description + binding.Condition.Expression))
+		binding.Role = fmt.Sprintf("%s_withcond_%s", binding.Role, hex.EncodeToString(sum[:])[:20])
+		binding.Condition = nil
+	}
+	return downgraded
+}
+
+func hasConditions(policy *iamutil.Policy) bool {
+	for _, binding := range policy.Bindings {
+		if binding.Condition != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Emulator) servePolicyAction(w http.ResponseWriter, r *http.Request, resource string, set bool, wrapped bool) {
+	current := e.policy(resource)
+	if !set {
+		if hasConditions(current) && requestedPolicyVersion(r) < 3 {
+			writeJson(w, http.StatusOK, withoutConditions(current))
+			return
+		}
+		writeJson(w, http.StatusOK, current)
+		return
+	}
+
+	policy := &iamutil.Policy{}
+	var err error
+	if wrapped {
+		request := &setIamPolicyRequest{Policy: policy}
+		err = json.NewDecoder(r.Body).Decode(request)
+		if err == nil && request.Policy == nil {
+			err = fmt.Errorf("request contains no policy")
+		}
+		policy = request.Policy
+	} else {
+		err = json.NewDecoder(r.Body).Decode(policy)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if hasConditions(policy) && policy.Version < 3 {
+		writeError(w, http.StatusBadRequest, "Policies with conditions require version 3.")
+		return
+	}
+	if policy.Etag != "" && policy.Etag != current.Etag {
+		writeError(w, http.StatusConflict, "There were concurrent policy changes. Please retry the whole read-modify-write with exponential backoff.")
+		return
+	}
+
+	updated := copyPolicy(policy)
+	if updated.Version == 0 {
+		updated.Version = 1
+	}
+	updated.Etag = newEtag(e.nextSequence())
+	e.policies[resource] = updated
+	writeJson(w, http.StatusOK, updated)
+}
+
+// policy returns the stored policy, a resource without a policy gets an empty policy
+func (e *Emulator) policy(resource string) *iamutil.Policy {
+	policy, ok := e.policies[resource]
+	if !ok {
+		policy = &iamutil.Policy{Version: 1, Etag: newEtag(e.nextSequence())}
+		e.policies[resource] = policy
+	}
+	return policy
+}
+
+func newEtag(sequence int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("etag-%d", sequence)))
+}
+
+func copyPolicy(policy *iamutil.Policy) *iamutil.Policy {
+	copied := &iamutil.Policy{Etag: policy.Etag, Version: policy.Version}
+	for _, binding := range policy.Bindings {
+		b := &iamutil.Binding{Role: binding.Role, Members: append([]string(nil), binding.Members...)}
+		if binding.Condition != nil {
+			condition := *binding.Condition
+			b.Condition = &condition
+		}
+		copied.Bindings = append(copied.Bindings, b)
+	}
+	return copied
+}
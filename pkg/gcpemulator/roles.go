@@ -0,0 +1,159 @@
+package gcpemulator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/iam/v1"
+)
+
+var (
+	rolesPath        = regexp.MustCompile(`^/v1/projects/([^/]+)/roles$`)
+	rolePath         = regexp.MustCompile(`^/v1/projects/([^/]+)/roles/([^/:]+)$`)
+	roleUndeletePath = regexp.MustCompile(`^/v1/projects/([^/]+)/roles/([^/:]+):undelete$`)
+	roleIdPattern    = regexp.MustCompile(`^[a-zA-Z0-9_\.]{3,64}$`)
+)
+
+// Role returns the custom role of the name, e.g. "projects/my-project/roles/myRole", or nil if it does not exist
+func (e *Emulator) Role(name string) *iam.Role {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	role, ok := e.roles[name]
+	if !ok {
+		return nil
+	}
+	return copyRole(role)
+}
+
+// serveRoles serves the custom roles of projects, it returns false if the path is not a role path
+func (e *Emulator) serveRoles(w http.ResponseWriter, r *http.Request) bool {
+	path := r.URL.Path
+	if m := rolesPath.FindStringSubmatch(path); m != nil {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return true
+		}
+		e.createRole(w, r, m[1])
+		return true
+	}
+	if m := roleUndeletePath.FindStringSubmatch(path); m != nil {
+		role, ok := e.roles[fmt.Sprintf("projects/%s/roles/%s", m[1], m[2])]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("role %s not found", m[2]))
+			return true
+		}
+		if !role.Deleted {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("role %s is not deleted", role.Name))
+			return true
+		}
+		role.Deleted = false
+		e.touchRole(role)
+		writeJson(w, http.StatusOK, role)
+		return true
+	}
+	if m := rolePath.FindStringSubmatch(path); m != nil {
+		role, ok := e.roles[fmt.Sprintf("projects/%s/roles/%s", m[1], m[2])]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("role %s not found", m[2]))
+			return true
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, http.StatusOK, role)
+		case http.MethodPatch:
+			e.updateRole(w, r, role)
+		case http.MethodDelete:
+			if role.Deleted {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("role %s is already deleted", role.Name))
+				return true
+			}
+			role.Deleted = true
+			e.touchRole(role)
+			writeJson(w, http.StatusOK, role)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		}
+		return true
+	}
+	return false
+}
+
+func (e *Emulator) createRole(w http.ResponseWriter, r *http.Request, project string) {
+	request := &iam.CreateRoleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !roleIdPattern.MatchString(request.RoleId) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("role id %s is invalid", request.RoleId))
+		return
+	}
+	name := fmt.Sprintf("projects/%s/roles/%s", project, request.RoleId)
+	if _, ok := e.roles[name]; ok {
+		// the id of a deleted role can not be reused until the role is purged
+		writeError(w, http.StatusConflict, fmt.Sprintf("a role with id %s already exists or was recently deleted", request.RoleId))
+		return
+	}
+	role := &iam.Role{Name: name}
+	if request.Role != nil {
+		role.Title = request.Role.Title
+		role.Description = request.Role.Description
+		role.IncludedPermissions = request.Role.IncludedPermissions
+		role.Stage = request.Role.Stage
+	}
+	e.touchRole(role)
+	e.roles[name] = role
+	writeJson(w, http.StatusOK, role)
+}
+
+// updateRole changes the fields of the update mask, all fields if there is no mask
+func (e *Emulator) updateRole(w http.ResponseWriter, r *http.Request, role *iam.Role) {
+	if role.Deleted {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("role %s is deleted", role.Name))
+		return
+	}
+	update := &iam.Role{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if update.Etag != "" && update.Etag != role.Etag {
+		writeError(w, http.StatusConflict, fmt.Sprintf("etag of role %s does not match", role.Name))
+		return
+	}
+	mask := r.URL.Query().Get("updateMask")
+	if mask == "" {
+		mask = "title,description,includedPermissions,stage"
+	}
+	for _, field := range strings.Split(mask, ",") {
+		switch field {
+		case "title":
+			role.Title = update.Title
+		case "description":
+			role.Description = update.Description
+		case "includedPermissions":
+			role.IncludedPermissions = update.IncludedPermissions
+		case "stage":
+			role.Stage = update.Stage
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("field %s can not be updated", field))
+			return
+		}
+	}
+	e.touchRole(role)
+	writeJson(w, http.StatusOK, role)
+}
+
+func (e *Emulator) touchRole(role *iam.Role) {
+	role.Etag = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", e.nextSequence())))
+}
+
+func copyRole(role *iam.Role) *iam.Role {
+	copied := *role
+	copied.IncludedPermissions = append([]string(nil), role.IncludedPermissions...)
+	return &copied
+}
@@ -0,0 +1,558 @@
+// Package gcpfake provides an in-memory implementation of the gcp service used by the controllers.
+// It records every call and can inject errors, so reconciliation can be tested without gcp.
+package gcpfake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-plugin-secrets-gcp/plugin/iamutil"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iam/v1"
+)
+
+// names of the recorded methods
+const (
+	MethodDefaultProject          = "DefaultProject"
+	MethodGetServiceAccount       = "GetServiceAccount"
+	MethodCreateServiceAccount    = "CreateServiceAccount"
+	MethodDeleteServiceAccount    = "DeleteServiceAccount"
+	MethodGetServiceAccountKey    = "GetServiceAccountKey"
+	MethodListServiceAccountKeys  = "ListServiceAccountKeys"
+	MethodCreateServiceAccountKey = "CreateServiceAccountKey"
+	MethodDeleteServiceAccountKey = "DeleteServiceAccountKey"
+	MethodGetIamPolicy            = "GetIamPolicy"
+	MethodSetIamPolicy            = "SetIamPolicy"
+	MethodGetRole                 = "GetRole"
+	MethodCreateRole              = "CreateRole"
+	MethodUpdateRole              = "UpdateRole"
+	MethodDeleteRole              = "DeleteRole"
+	MethodUndeleteRole            = "UndeleteRole"
+)
+
+// Call is a recorded call of the fake
+type Call struct {
+	Method string
+	Args   []string
+}
+
+type injectedError struct {
+	err   error
+	times int
+}
+
+// GcpService keeps service accounts, keys, iam policies and custom roles in memory
+type GcpService struct {
+	project string
+
+	mu       sync.Mutex
+	accounts map[string]*iam.ServiceAccount
+	keys     map[string]*iam.ServiceAccountKey
+	policies map[string]*iamutil.Policy
+	roles    map[string]*iam.Role
+	calls    []Call
+	errors   map[string]*injectedError
+	sequence int
+}
+
+// NewGcpService creates an empty fake, project is returned as project of the credentials
+func NewGcpService(project string) *GcpService {
+	return &GcpService{
+		project:  project,
+		accounts: map[string]*iam.ServiceAccount{},
+		keys:     map[string]*iam.ServiceAccountKey{},
+		policies: map[string]*iamutil.Policy{},
+		roles:    map[string]*iam.Role{},
+		errors:   map[string]*injectedError{},
+	}
+}
+
+// NotFoundError returns the error the gcp apis return for a missing object
+func NotFoundError(name string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("%s not found", name)}
+}
+
+// InjectError makes all following calls of the method fail with the error
+func (f *GcpService) InjectError(method string, err error) {
+	f.InjectErrorTimes(method, err, 0)
+}
+
+// InjectErrorTimes makes the next calls of the method fail with the error, times <= 0 fails all calls
+func (f *GcpService) InjectErrorTimes(method string, err error, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[method] = &injectedError{err: err, times: times}
+}
+
+// ClearErrors removes all injected errors
+func (f *GcpService) ClearErrors() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = map[string]*injectedError{}
+}
+
+// Calls returns the recorded calls in order
+func (f *GcpService) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallCount returns how often the method was called
+func (f *GcpService) CallCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, call := range f.calls {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// ResetCalls forgets the recorded calls
+func (f *GcpService) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// ServiceAccounts returns all existing service accounts
+func (f *GcpService) ServiceAccounts() []*iam.ServiceAccount {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var accounts []*iam.ServiceAccount
+	for _, account := range f.accounts {
+		copied := *account
+		accounts = append(accounts, &copied)
+	}
+	return accounts
+}
+
+// HasServiceAccount reports if the service account exists
+func (f *GcpService) HasServiceAccount(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.accounts[path]
+	return ok
+}
+
+// KeyNames returns the names of the keys of the service account
+func (f *GcpService) KeyNames(path string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.keys {
+		if strings.HasPrefix(name, path+"/keys/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RemoveKey deletes a key without recording a call, as if it was deleted outside of the controller
+func (f *GcpService) RemoveKey(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, name)
+}
+
+// Policy returns a copy of the policy of the resource, nil if the resource has no policy
+func (f *GcpService) Policy(resource string) *iamutil.Policy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	policy, ok := f.policies[resource]
+	if !ok {
+		return nil
+	}
+	return copyPolicy(policy)
+}
+
+// Role returns a copy of the custom role, nil if it does not exist
+func (f *GcpService) Role(name string) *iam.Role {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	role, ok := f.roles[name]
+	if !ok {
+		return nil
+	}
+	return copyRole(role)
+}
+
+// Members returns the members of the unconditional binding of the role on the resource
+func (f *GcpService) Members(resource string, role string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	policy, ok := f.policies[resource]
+	if !ok {
+		return nil
+	}
+	for _, binding := range policy.Bindings {
+		if binding.Role == role && binding.Condition == nil {
+			return append([]string(nil), binding.Members...)
+		}
+	}
+	return nil
+}
+
+// record stores the call and returns the injected error of the method
+func (f *GcpService) record(method string, args ...string) error {
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+	injected, ok := f.errors[method]
+	if !ok {
+		return nil
+	}
+	if injected.times > 0 {
+		injected.times--
+		if injected.times == 0 {
+			delete(f.errors, method)
+		}
+	}
+	return injected.err
+}
+
+func (f *GcpService) DefaultProject() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDefaultProject); err != nil {
+		return "", err
+	}
+	return f.project, nil
+}
+
+func (f *GcpService) GetServiceAccount(path string) (*iam.ServiceAccount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodGetServiceAccount, path); err != nil {
+		return nil, err
+	}
+	account, ok := f.lookupServiceAccount(path)
+	if !ok {
+		return nil, NotFoundError(path)
+	}
+	copied := *account
+	return &copied, nil
+}
+
+// lookupServiceAccount returns the account of the path, the project "-" matches the account in any project
+func (f *GcpService) lookupServiceAccount(path string) (*iam.ServiceAccount, bool) {
+	if email := strings.TrimPrefix(path, "projects/-/serviceAccounts/"); email != path {
+		for _, account := range f.accounts {
+			if account.Email == email {
+				return account, true
+			}
+		}
+		return nil, false
+	}
+	account, ok := f.accounts[path]
+	return account, ok
+}
+
+func (f *GcpService) CreateServiceAccount(project string, accountId string, displayName string, description string) (*iam.ServiceAccount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodCreateServiceAccount, project, accountId, displayName, description); err != nil {
+		return nil, err
+	}
+	if project == "" {
+		project = f.project
+	}
+	email := fmt.Sprintf("%s@%s.iam.gserviceaccount.com", accountId, project)
+	path := fmt.Sprintf("projects/%s/serviceAccounts/%s", project, email)
+	if _, ok := f.accounts[path]; ok {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("service account %s already exists", email)}
+	}
+	f.sequence++
+	account := &iam.ServiceAccount{
+		Name:        path,
+		Email:       email,
+		ProjectId:   project,
+		DisplayName: displayName,
+		Description: description,
+		UniqueId:    fmt.Sprintf("%021d", f.sequence),
+	}
+	f.accounts[path] = account
+	copied := *account
+	return &copied, nil
+}
+
+func (f *GcpService) DeleteServiceAccount(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDeleteServiceAccount, path); err != nil {
+		return err
+	}
+	if _, ok := f.accounts[path]; !ok {
+		return NotFoundError(path)
+	}
+	delete(f.accounts, path)
+	delete(f.policies, path)
+	for name := range f.keys {
+		if strings.HasPrefix(name, path+"/keys/") {
+			delete(f.keys, name)
+		}
+	}
+	return nil
+}
+
+func (f *GcpService) GetServiceAccountKey(name string) (*iam.ServiceAccountKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodGetServiceAccountKey, name); err != nil {
+		return nil, err
+	}
+	key, ok := f.keys[name]
+	if !ok {
+		return nil, NotFoundError(name)
+	}
+	// the private key data is only returned on creation
+	copied := *key
+	copied.PrivateKeyData = ""
+	return &copied, nil
+}
+
+func (f *GcpService) ListServiceAccountKeys(path string) ([]*iam.ServiceAccountKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodListServiceAccountKeys, path); err != nil {
+		return nil, err
+	}
+	if _, ok := f.accounts[path]; !ok {
+		return nil, NotFoundError(path)
+	}
+	var keys []*iam.ServiceAccountKey
+	for name, key := range f.keys {
+		if strings.HasPrefix(name, path+"/keys/") {
+			copied := *key
+			copied.PrivateKeyData = ""
+			keys = append(keys, &copied)
+		}
+	}
+	return keys, nil
+}
+
+func (f *GcpService) CreateServiceAccountKey(path string) (*iam.ServiceAccountKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodCreateServiceAccountKey, path); err != nil {
+		return nil, err
+	}
+	account, ok := f.accounts[path]
+	if !ok {
+		return nil, NotFoundError(path)
+	}
+	f.sequence++
+	keyId := fmt.Sprintf("%040x", f.sequence)
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     account.ProjectId,
+		"private_key_id": keyId,
+		"client_email":   account.Email,
+		"client_id":      account.UniqueId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	key := &iam.ServiceAccountKey{
+		Name:            fmt.Sprintf("%s/keys/%s", path, keyId),
+		KeyType:         "USER_MANAGED",
+		PrivateKeyType:  "TYPE_GOOGLE_CREDENTIALS_FILE",
+		PrivateKeyData:  base64.StdEncoding.EncodeToString(credentials),
+		ValidAfterTime:  now.Format(time.RFC3339),
+		ValidBeforeTime: now.AddDate(10, 0, 0).Format(time.RFC3339),
+	}
+	f.keys[key.Name] = key
+	copied := *key
+	return &copied, nil
+}
+
+func (f *GcpService) DeleteServiceAccountKey(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDeleteServiceAccountKey, name); err != nil {
+		return err
+	}
+	if _, ok := f.keys[name]; !ok {
+		return NotFoundError(name)
+	}
+	delete(f.keys, name)
+	return nil
+}
+
+// GetIamPolicy returns the policy of the resource, every resource except a missing service account
+// starts with an empty policy
+func (f *GcpService) GetIamPolicy(resource string) (*iamutil.Policy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodGetIamPolicy, resource); err != nil {
+		return nil, err
+	}
+	if err := f.checkPolicyResource(resource); err != nil {
+		return nil, err
+	}
+	return copyPolicy(f.policy(resource)), nil
+}
+
+// SetIamPolicy replaces the policy of the resource, a policy with an outdated etag is rejected
+func (f *GcpService) SetIamPolicy(resource string, policy *iamutil.Policy) (*iamutil.Policy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodSetIamPolicy, resource); err != nil {
+		return nil, err
+	}
+	if err := f.checkPolicyResource(resource); err != nil {
+		return nil, err
+	}
+	for _, binding := range policy.Bindings {
+		if binding.Condition != nil && policy.Version < 3 {
+			return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("policy of %s has conditions and requires version 3", resource)}
+		}
+	}
+	current := f.policy(resource)
+	if policy.Etag != "" && policy.Etag != current.Etag {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("etag of the policy of %s does not match", resource)}
+	}
+	updated := copyPolicy(policy)
+	f.sequence++
+	updated.Etag = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", f.sequence)))
+	f.policies[resource] = updated
+	return copyPolicy(updated), nil
+}
+
+func (f *GcpService) checkPolicyResource(resource string) error {
+	if strings.Contains(resource, "/serviceAccounts/") {
+		if _, ok := f.accounts[resource]; !ok {
+			return NotFoundError(resource)
+		}
+	}
+	return nil
+}
+
+func (f *GcpService) policy(resource string) *iamutil.Policy {
+	policy, ok := f.policies[resource]
+	if !ok {
+		f.sequence++
+		policy = &iamutil.Policy{Etag: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", f.sequence))), Version: 1}
+		f.policies[resource] = policy
+	}
+	return policy
+}
+
+func copyPolicy(policy *iamutil.Policy) *iamutil.Policy {
+	copied := &iamutil.Policy{Etag: policy.Etag, Version: policy.Version}
+	for _, binding := range policy.Bindings {
+		b := &iamutil.Binding{Role: binding.Role, Members: append([]string(nil), binding.Members...)}
+		if binding.Condition != nil {
+			condition := *binding.Condition
+			b.Condition = &condition
+		}
+		copied.Bindings = append(copied.Bindings, b)
+	}
+	return copied
+}
+
+func (f *GcpService) GetRole(name string) (*iam.Role, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodGetRole, name); err != nil {
+		return nil, err
+	}
+	role, ok := f.roles[name]
+	if !ok {
+		return nil, NotFoundError(name)
+	}
+	return copyRole(role), nil
+}
+
+// CreateRole creates the custom role, the id of a deleted role can not be used again
+func (f *GcpService) CreateRole(project string, roleId string, role *iam.Role) (*iam.Role, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodCreateRole, project, roleId); err != nil {
+		return nil, err
+	}
+	if project == "" {
+		project = f.project
+	}
+	name := fmt.Sprintf("projects/%s/roles/%s", project, roleId)
+	if _, ok := f.roles[name]; ok {
+		return nil, &googleapi.Error{Code: http.StatusConflict, Message: fmt.Sprintf("role %s already exists or was recently deleted", name)}
+	}
+	created := copyRole(role)
+	created.Name = name
+	created.Deleted = false
+	f.sequence++
+	created.Etag = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", f.sequence)))
+	f.roles[name] = created
+	return copyRole(created), nil
+}
+
+func (f *GcpService) UpdateRole(name string, role *iam.Role) (*iam.Role, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodUpdateRole, name); err != nil {
+		return nil, err
+	}
+	existing, ok := f.roles[name]
+	if !ok {
+		return nil, NotFoundError(name)
+	}
+	if existing.Deleted {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("role %s is deleted", name)}
+	}
+	existing.Title = role.Title
+	existing.Description = role.Description
+	existing.IncludedPermissions = append([]string(nil), role.IncludedPermissions...)
+	existing.Stage = role.Stage
+	f.sequence++
+	existing.Etag = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", f.sequence)))
+	return copyRole(existing), nil
+}
+
+// DeleteRole marks the role deleted, it is kept until it is undeleted
+func (f *GcpService) DeleteRole(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodDeleteRole, name); err != nil {
+		return err
+	}
+	role, ok := f.roles[name]
+	if !ok {
+		return NotFoundError(name)
+	}
+	if role.Deleted {
+		return &googleapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("role %s is already deleted", name)}
+	}
+	role.Deleted = true
+	return nil
+}
+
+func (f *GcpService) UndeleteRole(name string) (*iam.Role, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record(MethodUndeleteRole, name); err != nil {
+		return nil, err
+	}
+	role, ok := f.roles[name]
+	if !ok {
+		return nil, NotFoundError(name)
+	}
+	if !role.Deleted {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("role %s is not deleted", name)}
+	}
+	role.Deleted = false
+	return copyRole(role), nil
+}
+
+func copyRole(role *iam.Role) *iam.Role {
+	copied := *role
+	copied.IncludedPermissions = append([]string(nil), role.IncludedPermissions...)
+	return &copied
+}